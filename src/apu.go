@@ -0,0 +1,407 @@
+package main
+
+// The audio processing unit (APU) has four channels: two square waves (channel 1 with a frequency sweep),
+// a wave channel playing samples from wave RAM and a noise channel. Its registers are mapped at
+// 0xff10 - 0xff26, followed by the wave RAM at 0xff30 - 0xff3f:
+//
+//  ------------------------------------------------------------------------
+// | channel | NRx0        | NRx1          | NRx2     | NRx3    | NRx4      |
+// | 1       | sweep       | duty, length  | envelope | freq lo | control   |
+// | 2       | -           | duty, length  | envelope | freq lo | control   |
+// | 3       | DAC enable  | length        | volume   | freq lo | control   |
+// | 4       | -           | length        | envelope | noise   | control   |
+//  ------------------------------------------------------------------------
+//
+// NRx4 holds the trigger in bit 7, the length enable in bit 6 and the upper 3 bits of the frequency.
+//
+// == Frame sequencer ==
+//
+// A 512 Hz clock steps through 8 steps clocking the length counters, the sweep and the envelopes:
+//
+//  ---------------------------------------
+// | step   | 0 | 1 | 2 | 3 | 4 | 5 | 6 | 7 |
+// | length | x |   | x |   | x |   | x |   |
+// | sweep  |   |   | x |   |   |   | x |   |
+// | volume |   |   |   |   |   |   |   | x |
+//  ---------------------------------------
+//
+// == Mixing ==
+//
+// NR51 (0xff25) routes every channel to the left (bits 7 - 4) and right (bits 3 - 0) output, NR50 (0xff24)
+// sets the volume of the left (bits 6 - 4) and right (bits 2 - 0) output from 1/8 to 8/8.
+//
+// NR52 (0xff26) turns the whole APU on and off with bit 7 and shows the active channels in bits 3 - 0.
+// While it is off all other registers are cleared and can't be written, only the wave RAM stays accessible.
+// The DMG still loads the length counters from NR11, NR21, NR31 and NR41 then.
+//
+// The APU runs from the system clock, so it keeps its speed in CGB double speed mode.
+
+const (
+	// system clock in Hz
+	clockRate = 4194304
+
+	// dots per step of the frame sequencer
+	frameSequencerDots = clockRate / 512
+
+	defaultSampleRate = 48000
+)
+
+// Bits which always read as 1, for the registers 0xff10 - 0xff2f.
+var apuReadMasks = [0x20]uint8{
+	0x80, 0x3f, 0x00, 0xff, 0xbf, // NR10 - NR14
+	0xff, 0x3f, 0x00, 0xff, 0xbf, // NR20 - NR24
+	0x7f, 0xff, 0x9f, 0xff, 0xbf, // NR30 - NR34
+	0xff, 0xff, 0x00, 0x00, 0xbf, // NR40 - NR44
+	0x00, 0x00, 0x70, // NR50 - NR52
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
+type Apu struct {
+	power bool
+	regs  [0x20]uint8
+	// CGB hardware, which clears the length counters along with the registers
+	cgb bool
+
+	square1 squareChannel
+	square2 squareChannel
+	wave    waveChannel
+	noise   noiseChannel
+
+	sequencerTimer int
+	sequencerStep  int
+
+	// stereo samples at sampleRate, interleaved left and right
+	sampleRate  int
+	sampleClock int
+	samples     []float32
+
+	// band-limited synthesis of the samples, nil to take a sample of the mixer output every 1/sampleRate seconds
+	blep *blepSynth
+	// filter on the output, nil for none
+	highPass *highPass
+	// WAV recording of the output and the channels, nil while not recording
+	recorder *wavRecorder
+	// VGM log of the register writes, nil while not logging
+	vgm *vgmLogger
+}
+
+func newApu(sampleRate int) *Apu {
+	apu := &Apu{sampleRate: sampleRate, sequencerTimer: frameSequencerDots}
+	apu.square1.sweep = true
+	apu.square1.length.max = 64
+	apu.square2.length.max = 64
+	apu.wave.length.max = 256
+	apu.noise.length.max = 64
+	return apu
+}
+
+// Check whether the given address belongs to the APU.
+func apuAddr(addr uint16) bool {
+	return addr >= 0xff10 && addr < 0xff40
+}
+
+func (apu *Apu) read(addr uint16) uint8 {
+	if addr >= 0xff30 {
+		return apu.wave.ram[addr-0xff30]
+	}
+	i := addr - 0xff10
+	if addr == 0xff26 {
+		val := apuReadMasks[i]
+		if apu.power {
+			val |= 0x80
+		}
+		for n, enabled := range []bool{apu.square1.enabled, apu.square2.enabled, apu.wave.enabled, apu.noise.enabled} {
+			if enabled {
+				val |= 1 << n
+			}
+		}
+		return val
+	}
+	return apu.regs[i] | apuReadMasks[i]
+}
+
+func (apu *Apu) write(addr uint16, val uint8) {
+	if addr >= 0xff30 {
+		apu.logWrite(addr, val)
+		apu.wave.ram[addr-0xff30] = val
+		return
+	}
+	if addr == 0xff26 {
+		apu.logWrite(addr, val)
+		apu.setPower(val&0x80 != 0)
+		return
+	}
+	if addr >= 0xff27 {
+		return
+	}
+	if !apu.power {
+		// the DMG still loads the length counters while the power is off, the CGB ignores the write
+		if !apu.cgb && apu.loadLength(addr, val) {
+			apu.logWrite(addr, val)
+		}
+		return
+	}
+	apu.logWrite(addr, val)
+	apu.regs[addr-0xff10] = val
+
+	switch addr {
+	// channel 1
+	case 0xff10:
+		ch := &apu.square1
+		ch.sweepPeriod = (val >> 4) & 0x07
+		ch.sweepShift = val & 0x07
+		negate := val&0x08 != 0
+		if ch.sweepNegate && !negate && ch.sweepNegated {
+			ch.enabled = false
+		}
+		ch.sweepNegate = negate
+	case 0xff11:
+		apu.square1.duty = val >> 6
+		apu.square1.length.load(val & 0x3f)
+	case 0xff12:
+		apu.setSquareDac(&apu.square1, val)
+	case 0xff13:
+		apu.square1.frequency = apu.square1.frequency&0x700 | uint16(val)
+	case 0xff14:
+		apu.writeSquareControl(&apu.square1, val, apu.regs[0x02])
+
+	// channel 2
+	case 0xff16:
+		apu.square2.duty = val >> 6
+		apu.square2.length.load(val & 0x3f)
+	case 0xff17:
+		apu.setSquareDac(&apu.square2, val)
+	case 0xff18:
+		apu.square2.frequency = apu.square2.frequency&0x700 | uint16(val)
+	case 0xff19:
+		apu.writeSquareControl(&apu.square2, val, apu.regs[0x07])
+
+	// channel 3
+	case 0xff1a:
+		apu.wave.dac = val&0x80 != 0
+		if !apu.wave.dac {
+			apu.wave.enabled = false
+		}
+	case 0xff1b:
+		apu.wave.length.load(val)
+	case 0xff1c:
+		apu.wave.volume = (val >> 5) & 0x03
+	case 0xff1d:
+		apu.wave.frequency = apu.wave.frequency&0x700 | uint16(val)
+	case 0xff1e:
+		apu.wave.frequency = apu.wave.frequency&0xff | uint16(val&0x07)<<8
+		apu.wave.length.enabled = val&0x40 != 0
+		if val&0x80 != 0 {
+			apu.wave.trigger()
+		}
+
+	// channel 4
+	case 0xff20:
+		apu.noise.length.load(val & 0x3f)
+	case 0xff21:
+		apu.noise.dac = val&0xf8 != 0
+		if !apu.noise.dac {
+			apu.noise.enabled = false
+		}
+	case 0xff22:
+		apu.noise.shift = val >> 4
+		apu.noise.width7 = val&0x08 != 0
+		apu.noise.divisor = val & 0x07
+	case 0xff23:
+		apu.noise.length.enabled = val&0x40 != 0
+		if val&0x80 != 0 {
+			apu.noise.trigger(apu.regs[0x12])
+		}
+	}
+}
+
+// Log a write the APU accepted to the VGM file.
+func (apu *Apu) logWrite(addr uint16, val uint8) {
+	if apu.vgm != nil {
+		apu.vgm.write(addr, val)
+	}
+}
+
+// The DAC of the square and noise channels is on as long as the upper 5 bits of NRx2 are not all 0.
+func (apu *Apu) setSquareDac(ch *squareChannel, nrx2 uint8) {
+	ch.dac = nrx2&0xf8 != 0
+	if !ch.dac {
+		ch.enabled = false
+	}
+}
+
+// Load the length counter from its part of NR11, NR21, NR31 or NR41. Returns false for the other registers.
+func (apu *Apu) loadLength(addr uint16, val uint8) bool {
+	switch addr {
+	case 0xff11:
+		apu.square1.length.load(val & 0x3f)
+	case 0xff16:
+		apu.square2.length.load(val & 0x3f)
+	case 0xff1b:
+		apu.wave.length.load(val)
+	case 0xff20:
+		apu.noise.length.load(val & 0x3f)
+	default:
+		return false
+	}
+	return true
+}
+
+func (apu *Apu) writeSquareControl(ch *squareChannel, nrx4 uint8, nrx2 uint8) {
+	ch.frequency = ch.frequency&0xff | uint16(nrx4&0x07)<<8
+	ch.length.enabled = nrx4&0x40 != 0
+	if nrx4&0x80 != 0 {
+		ch.trigger(nrx2)
+	}
+}
+
+// Turning the APU off clears all registers and the channels, turning it on restarts the frame sequencer. The
+// wave RAM is kept, and so are the length counters except on the CGB.
+func (apu *Apu) setPower(on bool) {
+	if on == apu.power {
+		return
+	}
+	if !on {
+		apu.regs = [0x20]uint8{}
+		square1, square2, wave, noise := apu.square1.length, apu.square2.length, apu.wave.length, apu.noise.length
+		apu.square1 = squareChannel{sweep: true, length: square1}
+		apu.square2 = squareChannel{length: square2}
+		apu.wave = waveChannel{ram: apu.wave.ram, length: wave}
+		apu.noise = noiseChannel{length: noise}
+		for _, length := range []*lengthCounter{&apu.square1.length, &apu.square2.length, &apu.wave.length, &apu.noise.length} {
+			length.enabled = false
+			if apu.cgb {
+				length.counter = 0
+			}
+		}
+	} else {
+		apu.sequencerStep = 0
+		apu.sequencerTimer = frameSequencerDots
+		apu.square1.dutyPos = 0
+		apu.square2.dutyPos = 0
+		apu.wave.position = 0
+	}
+	apu.power = on
+}
+
+// Advance the APU by the given number of dots.
+func (apu *Apu) tick(dots int) {
+	if apu.vgm != nil {
+		apu.vgm.tick(dots)
+	}
+	if apu.power {
+		apu.square1.tick(dots)
+		apu.square2.tick(dots)
+		apu.wave.tick(dots)
+		apu.noise.tick(dots)
+
+		apu.sequencerTimer -= dots
+		for apu.sequencerTimer <= 0 {
+			apu.sequencerTimer += frameSequencerDots
+			apu.stepSequencer()
+		}
+	}
+
+	if apu.blep != nil {
+		left, right := apu.mix()
+		apu.blep.update(left, right, float64(apu.sampleClock)/clockRate)
+	}
+	apu.sampleClock += dots * apu.sampleRate
+	for apu.sampleClock >= clockRate {
+		apu.sampleClock -= clockRate
+		if apu.blep != nil {
+			apu.output(apu.blep.next())
+		} else {
+			apu.output(apu.mix())
+		}
+	}
+}
+
+func (apu *Apu) output(left, right float32) {
+	if apu.highPass != nil {
+		left, right = apu.highPass.apply(left, right)
+	}
+	if apu.recorder != nil {
+		apu.recorder.record(left, right, apu.channelLevels())
+	}
+	// without anyone taking the samples, keep at most a second of them
+	if len(apu.samples) < apu.sampleRate*2 {
+		apu.samples = append(apu.samples, left, right)
+	}
+}
+
+func (apu *Apu) stepSequencer() {
+	step := apu.sequencerStep
+	apu.sequencerStep = (apu.sequencerStep + 1) % 8
+
+	if step%2 == 0 {
+		if !apu.square1.length.clock() {
+			apu.square1.enabled = false
+		}
+		if !apu.square2.length.clock() {
+			apu.square2.enabled = false
+		}
+		if !apu.wave.length.clock() {
+			apu.wave.enabled = false
+		}
+		if !apu.noise.length.clock() {
+			apu.noise.enabled = false
+		}
+	}
+	if (step == 2 || step == 6) && apu.square1.clockSweep() {
+		apu.regs[0x03] = uint8(apu.square1.frequency)
+		apu.regs[0x04] = apu.regs[0x04]&0xf8 | uint8(apu.square1.frequency>>8)
+	}
+	if step == 7 {
+		apu.square1.envelope.clock()
+		apu.square2.envelope.clock()
+		apu.noise.envelope.clock()
+	}
+}
+
+// Return the analog level of every channel from -1 to 1. A DAC which is off outputs 0.
+func (apu *Apu) channelLevels() [4]float32 {
+	var levels [4]float32
+	for i, ch := range []struct {
+		dac    bool
+		output uint8
+	}{
+		{apu.square1.dac, apu.square1.output()},
+		{apu.square2.dac, apu.square2.output()},
+		{apu.wave.dac, apu.wave.output()},
+		{apu.noise.dac, apu.noise.output()},
+	} {
+		if ch.dac {
+			levels[i] = 1 - float32(ch.output)/7.5
+		}
+	}
+	return levels
+}
+
+// Mix the channels into the left and right output according to NR50 and NR51.
+func (apu *Apu) mix() (float32, float32) {
+	if !apu.power {
+		return 0, 0
+	}
+	nr50, nr51 := apu.regs[0x14], apu.regs[0x15]
+
+	var left, right float32
+	for i, level := range apu.channelLevels() {
+		if nr51&(0x10<<i) != 0 {
+			left += level
+		}
+		if nr51&(0x01<<i) != 0 {
+			right += level
+		}
+	}
+	left *= float32((nr50>>4)&0x07+1) / 8
+	right *= float32(nr50&0x07+1) / 8
+	return left / 4, right / 4
+}
+
+// Return the samples produced since the last call. The slice is reused by the following ticks.
+func (apu *Apu) takeSamples() []float32 {
+	samples := apu.samples
+	apu.samples = apu.samples[:0]
+	return samples
+}
@@ -0,0 +1,302 @@
+package main
+
+// The four channels of the APU. Every channel produces a digital value from 0 to 15, which its DAC turns
+// into an analog level. A channel is turned on by writing bit 7 of NRx4 (trigger) and turned off again
+// when its length counter runs out, when the sweep overflows or when its DAC is turned off.
+//
+// == Envelope (NRx2) ==
+//
+//  --------------------------------------------
+// | bit 7 - 4 | initial volume                 |
+// | bit 3     | direction: 1 = up, 0 = down    |
+// | bit 2 - 0 | period in steps of 64 Hz       |
+//  --------------------------------------------
+//
+// The upper 5 bits also turn the DAC of the square and noise channels on, as long as they are not all 0.
+//
+// == Noise (NR43) ==
+//
+//  ----------------------------------------------------
+// | bit 7 - 4 | clock shift                            |
+// | bit 3     | width: 1 = 7 bits, 0 = 15 bits         |
+// | bit 2 - 0 | divisor code                           |
+//  ----------------------------------------------------
+//
+// The shift register is clocked every divisor << shift dots, where the divisor codes 0 - 7 stand for
+// 8, 16, 32, 48, 64, 80, 96 and 112.
+
+// Length counter, which turns the channel off after 64 (256 for the wave channel) steps of 256 Hz when
+// enabled in bit 6 of NRx4.
+type lengthCounter struct {
+	max     int
+	counter int
+	enabled bool
+}
+
+func (l *lengthCounter) load(val uint8) {
+	l.counter = l.max - int(val)
+}
+
+func (l *lengthCounter) trigger() {
+	if l.counter == 0 {
+		l.counter = l.max
+	}
+}
+
+// Clock the length counter, returns false once it runs out.
+func (l *lengthCounter) clock() bool {
+	if !l.enabled || l.counter == 0 {
+		return true
+	}
+	l.counter--
+	return l.counter != 0
+}
+
+// Volume envelope of the square and noise channels, stepping at 64 Hz.
+type envelope struct {
+	volume uint8
+	up     bool
+	period uint8
+	timer  uint8
+}
+
+func (e *envelope) trigger(nrx2 uint8) {
+	e.volume = nrx2 >> 4
+	e.up = nrx2&0x08 != 0
+	e.period = nrx2 & 0x07
+	e.timer = e.period
+}
+
+func (e *envelope) clock() {
+	if e.period == 0 {
+		return
+	}
+	e.timer--
+	if e.timer > 0 {
+		return
+	}
+	e.timer = e.period
+	if e.up && e.volume < 15 {
+		e.volume++
+	} else if !e.up && e.volume > 0 {
+		e.volume--
+	}
+}
+
+// Waveforms of the four duty cycles, 12.5%, 25%, 50% and 75%.
+var dutyCycles = [4][8]uint8{
+	{0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 1, 1, 1},
+	{0, 1, 1, 1, 1, 1, 1, 0},
+}
+
+// Channel 1 and 2 play a square wave. Channel 1 can sweep its frequency up or down.
+type squareChannel struct {
+	enabled bool
+	dac     bool
+
+	duty      uint8
+	dutyPos   int
+	frequency uint16
+	timer     int
+
+	length   lengthCounter
+	envelope envelope
+
+	// frequency sweep, channel 1 only
+	sweep        bool
+	sweepPeriod  uint8
+	sweepNegate  bool
+	sweepShift   uint8
+	sweepTimer   uint8
+	sweepEnabled bool
+	sweepShadow  uint16
+	// set once a sweep calculation subtracted, clearing the negate bit afterwards turns the channel off
+	sweepNegated bool
+}
+
+// The period of the square wave is 8 steps of (2048 - frequency) * 4 dots.
+func (ch *squareChannel) period() int {
+	return (2048 - int(ch.frequency)) * 4
+}
+
+func (ch *squareChannel) trigger(nrx2 uint8) {
+	ch.enabled = ch.dac
+	ch.length.trigger()
+	ch.timer = ch.period()
+	ch.envelope.trigger(nrx2)
+
+	if ch.sweep {
+		ch.sweepShadow = ch.frequency
+		ch.sweepTimer = sweepReload(ch.sweepPeriod)
+		ch.sweepEnabled = ch.sweepPeriod != 0 || ch.sweepShift != 0
+		ch.sweepNegated = false
+		if ch.sweepShift != 0 {
+			ch.sweepFrequency()
+		}
+	}
+}
+
+// A sweep period of 0 is treated as 8 by the sweep timer.
+func sweepReload(period uint8) uint8 {
+	if period == 0 {
+		return 8
+	}
+	return period
+}
+
+// Calculate the next frequency of the sweep, turning the channel off if it overflows.
+func (ch *squareChannel) sweepFrequency() uint16 {
+	delta := ch.sweepShadow >> ch.sweepShift
+	freq := ch.sweepShadow + delta
+	if ch.sweepNegate {
+		freq = ch.sweepShadow - delta
+		ch.sweepNegated = true
+	}
+	if freq > 2047 {
+		ch.enabled = false
+	}
+	return freq
+}
+
+// Clock the sweep at 128 Hz. Returns true if the frequency changed and has to be written back to NR13
+// and NR14.
+func (ch *squareChannel) clockSweep() bool {
+	ch.sweepTimer--
+	if ch.sweepTimer > 0 {
+		return false
+	}
+	ch.sweepTimer = sweepReload(ch.sweepPeriod)
+	if !ch.sweepEnabled || ch.sweepPeriod == 0 {
+		return false
+	}
+
+	freq := ch.sweepFrequency()
+	if freq > 2047 || ch.sweepShift == 0 {
+		return false
+	}
+	ch.sweepShadow = freq
+	ch.frequency = freq
+	// check the following step for an overflow right away
+	ch.sweepFrequency()
+	return true
+}
+
+func (ch *squareChannel) tick(dots int) {
+	ch.timer -= dots
+	for ch.timer <= 0 {
+		ch.timer += ch.period()
+		ch.dutyPos = (ch.dutyPos + 1) % 8
+	}
+}
+
+func (ch *squareChannel) output() uint8 {
+	if !ch.enabled {
+		return 0
+	}
+	return dutyCycles[ch.duty][ch.dutyPos] * ch.envelope.volume
+}
+
+// Channel 3 plays back the 32 4-bit samples of the wave RAM (0xff30 - 0xff3f), the high nibble of every
+// byte first.
+type waveChannel struct {
+	enabled bool
+	dac     bool
+
+	volume    uint8
+	frequency uint16
+	timer     int
+	position  int
+	ram       [16]uint8
+
+	length lengthCounter
+}
+
+// Every sample plays for (2048 - frequency) * 2 dots.
+func (ch *waveChannel) period() int {
+	return (2048 - int(ch.frequency)) * 2
+}
+
+func (ch *waveChannel) trigger() {
+	ch.enabled = ch.dac
+	ch.length.trigger()
+	ch.timer = ch.period()
+	ch.position = 0
+}
+
+func (ch *waveChannel) tick(dots int) {
+	ch.timer -= dots
+	for ch.timer <= 0 {
+		ch.timer += ch.period()
+		ch.position = (ch.position + 1) % 32
+	}
+}
+
+// The volume in bits 6 - 5 of NR32 shifts the sample right: mute, 100%, 50% or 25%.
+var waveShifts = [4]uint8{4, 0, 1, 2}
+
+func (ch *waveChannel) output() uint8 {
+	if !ch.enabled {
+		return 0
+	}
+	sample := ch.ram[ch.position/2]
+	if ch.position%2 == 0 {
+		sample >>= 4
+	}
+	return (sample & 0x0f) >> waveShifts[ch.volume]
+}
+
+// Channel 4 plays noise from a 15-bit linear feedback shift register.
+type noiseChannel struct {
+	enabled bool
+	dac     bool
+
+	shift   uint8
+	width7  bool
+	divisor uint8
+	timer   int
+	lfsr    uint16
+
+	length   lengthCounter
+	envelope envelope
+}
+
+func (ch *noiseChannel) period() int {
+	divisor := 8
+	if ch.divisor != 0 {
+		divisor = int(ch.divisor) * 16
+	}
+	return divisor << ch.shift
+}
+
+func (ch *noiseChannel) trigger(nrx2 uint8) {
+	ch.enabled = ch.dac
+	ch.length.trigger()
+	ch.timer = ch.period()
+	ch.envelope.trigger(nrx2)
+	ch.lfsr = 0x7fff
+}
+
+func (ch *noiseChannel) tick(dots int) {
+	ch.timer -= dots
+	for ch.timer <= 0 {
+		ch.timer += ch.period()
+		// shifts of 14 and 15 don't clock the register at all
+		if ch.shift >= 14 {
+			continue
+		}
+		bit := (ch.lfsr ^ ch.lfsr>>1) & 1
+		ch.lfsr = ch.lfsr>>1 | bit<<14
+		if ch.width7 {
+			ch.lfsr = ch.lfsr&^(1<<6) | bit<<6
+		}
+	}
+}
+
+func (ch *noiseChannel) output() uint8 {
+	if !ch.enabled {
+		return 0
+	}
+	return uint8(^ch.lfsr&1) * ch.envelope.volume
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Two stages between the mixer of the APU and the samples handed to the host.
+//
+// == Band-limited synthesis ==
+//
+// The channels switch their level instantly, so every edge of a square wave contains frequencies far above
+// the sample rate. Taking a sample every 1/sampleRate seconds folds those back into the audible range as
+// aliasing, which gets bad for high notes. The band-limited path instead adds every change of the mixed level
+// as a band-limited step (BLEP) at its exact position between two samples: the derivative of a step is an
+// impulse, so the change is spread over blepWidth samples with a windowed sinc kernel and the samples are
+// integrated again on the way out. The kernel is precomputed for blepPhases positions between two samples
+// and delays the output by blepWidth / 2 samples.
+//
+// == High-pass filter ==
+//
+// The analog output of the Game Boy goes through a capacitor which blocks the DC offset of the DACs. It
+// charges towards the input by a constant factor every clock, which differs between the models:
+//
+//  -------------------------------------------
+// | model          | charge factor per clock  |
+// | DMG, SGB       | 0.999958                 |
+// | MGB, SGB2, CGB | 0.998943                 |
+//  -------------------------------------------
+
+const (
+	blepWidth  = 16
+	blepPhases = 32
+
+	// cutoff of the kernel as a fraction of the Nyquist frequency
+	blepCutoff = 0.9
+
+	dmgHighPassCharge = 0.999958
+	cgbHighPassCharge = 0.998943
+)
+
+type blepSynth struct {
+	kernel [blepPhases][blepWidth]float32
+
+	// level of the last input and the output integrated so far, left and right
+	level [2]float32
+	sum   [2]float32
+	// pending changes of the next blepWidth samples
+	deltas [2][blepWidth]float32
+}
+
+func newBlepSynth() *blepSynth {
+	b := &blepSynth{}
+	center := float64(blepWidth / 2)
+	for phase := range b.kernel {
+		offset := float64(phase) / blepPhases
+		var total float64
+		var taps [blepWidth]float64
+		for k := range taps {
+			// time of the sample relative to the center of the step
+			t := float64(k) + 1 - offset - center
+			window := 0.42 + 0.5*math.Cos(math.Pi*t/center) + 0.08*math.Cos(2*math.Pi*t/center)
+			taps[k] = sinc(blepCutoff*t) * window
+			total += taps[k]
+		}
+		// every phase adds up to a step of exactly 1
+		for k := range taps {
+			b.kernel[phase][k] = float32(taps[k] / total)
+		}
+	}
+	return b
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Change the level of the output. The change happens at the given fraction (0 to 1) of the time between the
+// last sample and the next one.
+func (b *blepSynth) update(left, right float32, position float64) {
+	kernel := &b.kernel[int(position*blepPhases)%blepPhases]
+	for side, level := range [2]float32{left, right} {
+		delta := level - b.level[side]
+		if delta == 0 {
+			continue
+		}
+		b.level[side] = level
+		for k, tap := range kernel {
+			b.deltas[side][k] += delta * tap
+		}
+	}
+}
+
+// Return the next sample, once no later change can affect it anymore.
+func (b *blepSynth) next() (float32, float32) {
+	for side := range b.deltas {
+		b.sum[side] += b.deltas[side][0]
+		copy(b.deltas[side][:], b.deltas[side][1:])
+		b.deltas[side][blepWidth-1] = 0
+	}
+	return b.sum[0], b.sum[1]
+}
+
+// High-pass filter modelling the capacitor on the audio output.
+type highPass struct {
+	// charge factor per sample
+	charge    float32
+	capacitor [2]float32
+}
+
+func newHighPass(chargePerClock float64, sampleRate int) *highPass {
+	return &highPass{charge: float32(math.Pow(chargePerClock, float64(clockRate)/float64(sampleRate)))}
+}
+
+// Create the high-pass filter by name: model picks the one of the given hardware model, off turns it off.
+func parseHighPass(name string, model Model, sampleRate int) (*highPass, error) {
+	switch name {
+	case "model":
+		return newHighPass(model.highPassCharge(), sampleRate), nil
+	case "dmg":
+		return newHighPass(dmgHighPassCharge, sampleRate), nil
+	case "cgb":
+		return newHighPass(cgbHighPassCharge, sampleRate), nil
+	case "off":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown high-pass filter %q", name)
+}
+
+func (model Model) highPassCharge() float64 {
+	if model == DMG || model == SGB {
+		return dmgHighPassCharge
+	}
+	return cgbHighPassCharge
+}
+
+func (h *highPass) apply(left, right float32) (float32, float32) {
+	var out [2]float32
+	for side, in := range [2]float32{left, right} {
+		out[side] = in - h.capacitor[side]
+		h.capacitor[side] = in - out[side]*h.charge
+	}
+	return out[0], out[1]
+}
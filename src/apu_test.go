@@ -0,0 +1,274 @@
+package main
+
+import "testing"
+
+func apuTestMemory() (*Memory, *Apu) {
+	mem := &Memory{}
+	apu := newApu(defaultSampleRate)
+	mem.apu = apu
+	mem.Write(0xff26, 0x80)
+	return mem, apu
+}
+
+// Test that turning the APU off clears the registers and ignores writes, except for the wave RAM
+func TestApuPower(t *testing.T) {
+	mem, _ := apuTestMemory()
+	mem.Write(0xff24, 0x77)
+	mem.Write(0xff11, 0x80)
+	if val := mem.Read(0xff11); val != 0xbf {
+		t.Errorf("Only the duty of NR11 should be readable. Expected 0xBF but got 0x%X", val)
+	}
+
+	mem.Write(0xff26, 0x00)
+	if val := mem.Read(0xff24); val != 0x00 {
+		t.Errorf("NR50 was not cleared. Expected 0x00 but got 0x%X", val)
+	}
+	if val := mem.Read(0xff26); val != 0x70 {
+		t.Errorf("NR52 should show the APU off. Expected 0x70 but got 0x%X", val)
+	}
+	mem.Write(0xff24, 0x77)
+	if val := mem.Read(0xff24); val != 0x00 {
+		t.Errorf("Writes should be ignored while the APU is off. Expected 0x00 but got 0x%X", val)
+	}
+	mem.Write(0xff30, 0x12)
+	if val := mem.Read(0xff30); val != 0x12 {
+		t.Errorf("Wave RAM should stay accessible. Expected 0x12 but got 0x%X", val)
+	}
+}
+
+// Test that only the CGB clears the length counters when the APU is turned off
+func TestApuPowerLength(t *testing.T) {
+	for _, cgb := range []bool{false, true} {
+		mem, apu := apuTestMemory()
+		apu.cgb = cgb
+		mem.Write(0xff16, 0x30) // length 16
+		mem.Write(0xff1b, 0xf0) // length 16
+		mem.Write(0xff19, 0x40)
+
+		mem.Write(0xff26, 0x00)
+		expected := 16
+		if cgb {
+			expected = 0
+		}
+		if apu.square2.length.counter != expected || apu.wave.length.counter != expected {
+			t.Errorf("Wrong length counters after turning the APU off with cgb = %t. Expected %d but got %d and %d",
+				cgb, expected, apu.square2.length.counter, apu.wave.length.counter)
+		}
+		if apu.square2.length.enabled {
+			t.Errorf("The length enable of channel 2 should be cleared with NR24")
+		}
+
+		// only the DMG loads the lengths while the power is off, but not the duty
+		mem.Write(0xff16, 0xff) // length 1
+		mem.Write(0xff1b, 0xff) // length 1
+		expected = 1
+		if cgb {
+			expected = 0
+		}
+		if apu.square2.length.counter != expected || apu.wave.length.counter != expected {
+			t.Errorf("Wrong length counters after writing them while off with cgb = %t. Expected %d but got %d and %d",
+				cgb, expected, apu.square2.length.counter, apu.wave.length.counter)
+		}
+		if val := mem.Read(0xff16); val != 0x3f {
+			t.Errorf("The duty should be ignored while off. Expected NR21 0x3F but got 0x%X", val)
+		}
+	}
+}
+
+// Test that the length counter turns a triggered channel off and NR52 shows it
+func TestApuLength(t *testing.T) {
+	mem, apu := apuTestMemory()
+	mem.Write(0xff17, 0xf0)
+	mem.Write(0xff16, 0x3e) // length 2
+	mem.Write(0xff19, 0xc0)
+	if val := mem.Read(0xff26); val != 0xf2 {
+		t.Errorf("Channel 2 should be on. Expected 0xF2 but got 0x%X", val)
+	}
+
+	// the length counter is clocked on steps 0 and 2
+	apu.tick(frameSequencerDots)
+	if val := mem.Read(0xff26); val != 0xf2 {
+		t.Errorf("Channel 2 should still be on. Expected 0xF2 but got 0x%X", val)
+	}
+	apu.tick(2 * frameSequencerDots)
+	if val := mem.Read(0xff26); val != 0xf0 {
+		t.Errorf("Channel 2 should be off. Expected 0xF0 but got 0x%X", val)
+	}
+}
+
+// Test that a sweep overflowing the frequency turns channel 1 off
+func TestApuSweepOverflow(t *testing.T) {
+	mem, apu := apuTestMemory()
+	mem.Write(0xff12, 0xf0)
+	mem.Write(0xff10, 0x11) // period 1, shift 1, up
+	mem.Write(0xff13, 0x00)
+	mem.Write(0xff14, 0x85) // frequency 0x500
+	if !apu.square1.enabled {
+		t.Fatalf("Channel 1 should be on")
+	}
+
+	apu.tick(3 * frameSequencerDots)
+	if val := apu.regs[0x03]; val != 0x80 {
+		t.Errorf("The sweep should write back NR13. Expected 0x80 but got 0x%X", val)
+	}
+	if apu.square1.frequency != 0x780 {
+		t.Errorf("Expected frequency 0x780 but got 0x%X", apu.square1.frequency)
+	}
+	if apu.square1.enabled {
+		t.Errorf("The next sweep step overflows and should turn channel 1 off")
+	}
+}
+
+// Test that the envelope changes the volume every period on step 7
+func TestApuEnvelope(t *testing.T) {
+	mem, apu := apuTestMemory()
+	mem.Write(0xff17, 0x51) // volume 5, down, period 1
+	mem.Write(0xff19, 0x80)
+
+	apu.tick(8 * frameSequencerDots)
+	if apu.square2.envelope.volume != 4 {
+		t.Errorf("Expected volume 4 but got %d", apu.square2.envelope.volume)
+	}
+	apu.tick(5 * 8 * frameSequencerDots)
+	if apu.square2.envelope.volume != 0 {
+		t.Errorf("The volume should stop at 0 but got %d", apu.square2.envelope.volume)
+	}
+}
+
+// Test the shift register of the noise channel in 15 and 7 bit mode
+func TestApuNoise(t *testing.T) {
+	mem, apu := apuTestMemory()
+	mem.Write(0xff21, 0xf0)
+	mem.Write(0xff22, 0x00) // clocked every 8 dots
+	mem.Write(0xff23, 0x80)
+	if apu.noise.lfsr != 0x7fff {
+		t.Errorf("Trigger should fill the register. Expected 0x7FFF but got 0x%X", apu.noise.lfsr)
+	}
+	if apu.noise.output() != 0 {
+		t.Errorf("Expected output 0 but got %d", apu.noise.output())
+	}
+
+	apu.tick(8)
+	if apu.noise.lfsr != 0x3fff {
+		t.Errorf("Expected 0x3FFF but got 0x%X", apu.noise.lfsr)
+	}
+	if apu.noise.output() != 0 {
+		t.Errorf("Expected output 0 but got %d", apu.noise.output())
+	}
+
+	mem.Write(0xff22, 0x08)
+	apu.tick(8)
+	if apu.noise.lfsr != 0x1fbf {
+		t.Errorf("Bit 6 should be cleared in 7 bit mode. Expected 0x1FBF but got 0x%X", apu.noise.lfsr)
+	}
+}
+
+// Test that the wave channel plays the high nibble first and shifts it by the volume
+func TestApuWave(t *testing.T) {
+	mem, apu := apuTestMemory()
+	mem.Write(0xff30, 0xc4)
+	mem.Write(0xff1a, 0x80)
+	mem.Write(0xff1c, 0x40) // 50%
+	mem.Write(0xff1d, 0x00)
+	mem.Write(0xff1e, 0x87) // a sample every 512 dots
+
+	if out := apu.wave.output(); out != 0x06 {
+		t.Errorf("Expected 0x06 but got 0x%X", out)
+	}
+	apu.tick(512)
+	if out := apu.wave.output(); out != 0x02 {
+		t.Errorf("Expected 0x02 but got 0x%X", out)
+	}
+
+	mem.Write(0xff1a, 0x00)
+	if val := mem.Read(0xff26); val&0x04 != 0 {
+		t.Errorf("Turning the DAC off should turn channel 3 off")
+	}
+}
+
+// Test the number of samples at the host rate and that NR51 pans the channels
+func TestApuSamples(t *testing.T) {
+	mem, apu := apuTestMemory()
+	mem.Write(0xff24, 0x77)
+	mem.Write(0xff25, 0x02) // channel 2 right only
+	mem.Write(0xff17, 0xf0)
+	mem.Write(0xff19, 0x80)
+
+	apu.tick(dotsPerFrame)
+	samples := apu.takeSamples()
+	expected := dotsPerFrame * defaultSampleRate / clockRate * 2
+	if len(samples) != expected {
+		t.Errorf("Expected %d samples but got %d", expected, len(samples))
+	}
+	for i := 0; i < len(samples); i += 2 {
+		if samples[i] != 0 {
+			t.Fatalf("Left output should be silent but got %f", samples[i])
+		}
+	}
+	if len(apu.takeSamples()) != 0 {
+		t.Errorf("Samples should only be returned once")
+	}
+}
+
+// Test that a band-limited step settles at the new level after the kernel has passed
+func TestBlepStep(t *testing.T) {
+	b := newBlepSynth()
+	b.update(1, -0.5, 0.25)
+
+	var left, right float32
+	for i := 0; i < blepWidth/2-2; i++ {
+		left, _ = b.next()
+		if left > 0.1 || left < -0.1 {
+			t.Errorf("Sample %d before the step should be close to 0 but got %f", i, left)
+		}
+	}
+	for i := blepWidth/2 - 2; i < blepWidth; i++ {
+		left, right = b.next()
+	}
+	if left < 0.999 || left > 1.001 || right < -0.501 || right > -0.499 {
+		t.Errorf("Expected 1/-0.5 after the step but got %f/%f", left, right)
+	}
+}
+
+// Test that the band-limited path produces as many samples as plain sampling
+func TestApuBlepSamples(t *testing.T) {
+	mem, apu := apuTestMemory()
+	apu.blep = newBlepSynth()
+	mem.Write(0xff24, 0x77)
+	mem.Write(0xff25, 0xff)
+	mem.Write(0xff17, 0xf0)
+	mem.Write(0xff18, 0xff)
+	mem.Write(0xff19, 0x87)
+
+	for i := 0; i < dotsPerFrame; i += 4 {
+		apu.tick(4)
+	}
+	samples := apu.takeSamples()
+	expected := dotsPerFrame * defaultSampleRate / clockRate * 2
+	if len(samples) != expected {
+		t.Errorf("Expected %d samples but got %d", expected, len(samples))
+	}
+	for _, sample := range samples {
+		if sample > 1 || sample < -1 {
+			t.Fatalf("Sample %f out of range", sample)
+		}
+	}
+}
+
+// Test that the high-pass filter removes a DC offset, faster on the CGB than on the DMG
+func TestHighPass(t *testing.T) {
+	dmg := newHighPass(DMG.highPassCharge(), defaultSampleRate)
+	cgb := newHighPass(CGB.highPassCharge(), defaultSampleRate)
+
+	var dmgOut, cgbOut float32
+	for i := 0; i < defaultSampleRate/10; i++ {
+		dmgOut, _ = dmg.apply(1, 1)
+		cgbOut, _ = cgb.apply(1, 1)
+	}
+	if cgbOut > 0.01 {
+		t.Errorf("The CGB filter should have removed the offset but got %f", cgbOut)
+	}
+	if dmgOut <= cgbOut {
+		t.Errorf("The DMG filter should charge slower. Got %f on the DMG and %f on the CGB", dmgOut, cgbOut)
+	}
+}
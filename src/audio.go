@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2/audio"
+)
+
+// Audio plays the samples of the APU through ebiten.
+type Audio struct {
+	buffer *sampleBuffer
+	player *audio.Player
+}
+
+func newAudio(sampleRate int, volume float64, muted bool) (*Audio, error) {
+	buffer := newSampleBuffer(sampleRate, volume)
+	buffer.muted = muted
+	player, err := audio.NewContext(sampleRate).NewPlayer(buffer)
+	if err != nil {
+		return nil, err
+	}
+	// the player reads ahead by its buffer size, on top of the latency of the sample buffer
+	player.SetBufferSize(time.Second / 20)
+	player.Play()
+	return &Audio{buffer: buffer, player: player}, nil
+}
+
+func (a *Audio) push(samples []float32) {
+	a.buffer.push(samples)
+}
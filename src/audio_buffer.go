@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// The samples of the APU travel to the audio device through a ring buffer: the emulator pushes the samples of
+// every frame from Update, the audio player reads them from its own goroutine as 16-bit stereo.
+//
+// The emulator is driven by the update rate of ebiten, which never exactly matches the 59.73 frames per second
+// of the Game Boy or the clock of the audio device. Instead of letting the buffer run empty (crackling) or fill
+// up (growing latency), the samples are resampled on the way in with a ratio slightly off 1 depending on the
+// fill level: a buffer below its target stretches the samples, a buffer above it squeezes them. The ratio
+// deviates by at most maxRateDelta, which isn't audible as a change in pitch.
+
+const (
+	// fill level the buffer aims for, in seconds
+	audioLatency = 0.05
+
+	// maximum deviation of the resampling ratio from 1
+	maxRateDelta = 0.005
+)
+
+type sampleBuffer struct {
+	mutex sync.Mutex
+
+	// ring of interleaved left and right samples
+	ring  []float32
+	start int
+	count int
+	// number of samples the buffer aims to hold
+	target int
+
+	// last input frame and the position of the next output frame after it, from 0 to 1
+	prev [2]float32
+	pos  float64
+
+	// last frame played, repeated when the buffer runs empty
+	last [2]float32
+
+	volume float64
+	muted  bool
+}
+
+func newSampleBuffer(sampleRate int, volume float64) *sampleBuffer {
+	target := int(float64(sampleRate)*audioLatency) * 2
+	return &sampleBuffer{ring: make([]float32, target*4), target: target, volume: volume}
+}
+
+// Resampling ratio of output to input samples for the current fill level.
+func (b *sampleBuffer) ratio() float64 {
+	deviation := float64(b.target-b.count) / float64(b.target)
+	return 1 + maxRateDelta*math.Max(-1, math.Min(1, deviation))
+}
+
+// Add interleaved stereo samples, interpolating linearly between them at the current ratio.
+func (b *sampleBuffer) push(samples []float32) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	step := 1 / b.ratio()
+	for i := 0; i+1 < len(samples); i += 2 {
+		left, right := samples[i], samples[i+1]
+		for ; b.pos < 1; b.pos += step {
+			t := float32(b.pos)
+			b.add(b.prev[0]+(left-b.prev[0])*t, b.prev[1]+(right-b.prev[1])*t)
+		}
+		b.pos--
+		b.prev = [2]float32{left, right}
+	}
+}
+
+// Append a frame to the ring, dropping it if the ring is full.
+func (b *sampleBuffer) add(left, right float32) {
+	if b.count+2 > len(b.ring) {
+		return
+	}
+	end := (b.start + b.count) % len(b.ring)
+	b.ring[end] = left
+	b.ring[end+1] = right
+	b.count += 2
+}
+
+// Read the buffered samples as 16-bit little endian stereo. The buffer never runs dry for the audio player:
+// once it is empty the last frame is repeated.
+func (b *sampleBuffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	gain := b.volume
+	if b.muted {
+		gain = 0
+	}
+	n := len(p) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		if b.count >= 2 {
+			b.last = [2]float32{b.ring[b.start], b.ring[b.start+1]}
+			b.start = (b.start + 2) % len(b.ring)
+			b.count -= 2
+		}
+		binary.LittleEndian.PutUint16(p[i:], uint16(toInt16(b.last[0], gain)))
+		binary.LittleEndian.PutUint16(p[i+2:], uint16(toInt16(b.last[1], gain)))
+	}
+	return n, nil
+}
+
+func toInt16(sample float32, gain float64) int16 {
+	val := math.Max(-1, math.Min(1, float64(sample)*gain))
+	return int16(val * math.MaxInt16)
+}
+
+func (b *sampleBuffer) toggleMute() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.muted = !b.muted
+}
+
+// Change the master volume by the given amount, keeping it between 0 and 1.
+func (b *sampleBuffer) changeVolume(delta float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.volume = math.Max(0, math.Min(1, b.volume+delta))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func constantSamples(frames int, left, right float32) []float32 {
+	samples := make([]float32, 0, frames*2)
+	for i := 0; i < frames; i++ {
+		samples = append(samples, left, right)
+	}
+	return samples
+}
+
+// Test that the samples are read as 16-bit stereo with the master volume and mute applied
+func TestSampleBufferRead(t *testing.T) {
+	b := newSampleBuffer(defaultSampleRate, 0.5)
+	b.push(constantSamples(100, 1, -1))
+
+	p := make([]byte, 40)
+	if n, _ := b.Read(p); n != 40 {
+		t.Errorf("Expected 40 bytes but got %d", n)
+	}
+	// the first frame is interpolated from silence
+	left, right := int16(binary.LittleEndian.Uint16(p[36:])), int16(binary.LittleEndian.Uint16(p[38:]))
+	if left != 16383 || right != -16383 {
+		t.Errorf("Expected 16383/-16383 but got %d/%d", left, right)
+	}
+
+	b.toggleMute()
+	b.Read(p)
+	if left := int16(binary.LittleEndian.Uint16(p[36:])); left != 0 {
+		t.Errorf("Muted output should be silent but got %d", left)
+	}
+}
+
+// Test that the last frame is repeated once the buffer runs empty
+func TestSampleBufferUnderrun(t *testing.T) {
+	b := newSampleBuffer(defaultSampleRate, 1)
+	b.push(constantSamples(2, 0.5, 0.5))
+
+	p := make([]byte, 400)
+	b.Read(p)
+	if left := int16(binary.LittleEndian.Uint16(p[396:])); left != 16383 {
+		t.Errorf("Expected 16383 but got %d", left)
+	}
+}
+
+// Test that the resampling ratio stretches the samples while the buffer is below its target and squeezes them
+// above it
+func TestSampleBufferRateControl(t *testing.T) {
+	b := newSampleBuffer(defaultSampleRate, 1)
+	frames := 1000
+	b.push(constantSamples(frames, 0, 0))
+	if b.count/2 <= frames {
+		t.Errorf("An empty buffer should stretch the samples. Expected more than %d frames but got %d", frames, b.count/2)
+	}
+
+	b.push(constantSamples(b.target, 0, 0))
+	count := b.count
+	b.push(constantSamples(frames, 0, 0))
+	if b.count-count >= 2*frames {
+		t.Errorf("A full buffer should squeeze the samples. Expected less than %d frames but got %d", frames, (b.count-count)/2)
+	}
+	if b.count > len(b.ring) {
+		t.Errorf("The buffer should never hold more than its capacity")
+	}
+}
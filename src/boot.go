@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The hardware models the emulator can pretend to be. Games can tell them apart by the register values the
+// boot ROM leaves behind, e.g. CGB games check for A = 0x11 to enable their color features.
+type Model int
+
+const (
+	DMG  Model = iota // original Gameboy
+	MGB               // Gameboy Pocket and Gameboy Light
+	SGB               // Super Gameboy
+	SGB2              // Super Gameboy 2
+	CGB               // Gameboy Color
+	AGB               // Gameboy Advance running Gameboy software
+)
+
+var modelNames = map[string]Model{
+	"dmg":  DMG,
+	"mgb":  MGB,
+	"sgb":  SGB,
+	"sgb2": SGB2,
+	"cgb":  CGB,
+	"agb":  AGB,
+}
+
+func parseModel(name string) (Model, error) {
+	model, ok := modelNames[strings.ToLower(name)]
+	if !ok {
+		return DMG, fmt.Errorf("unknown hardware model %q", name)
+	}
+	return model, nil
+}
+
+func (model Model) isCGB() bool {
+	return model == CGB || model == AGB
+}
+
+func (model Model) isSGB() bool {
+	return model == SGB || model == SGB2
+}
+
+// Size of the boot ROM of the given model in bytes.
+func (model Model) bootROMSize() int {
+	if model.isCGB() {
+		return 0x0900
+	}
+	return 0x0100
+}
+
+// Load a boot ROM dump for the given model from disk.
+func loadBootROM(path string, model Model) ([]uint8, error) {
+	rom, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rom) != model.bootROMSize() {
+		return nil, fmt.Errorf("%s is %d bytes, expected a %d byte boot ROM", path, len(rom), model.bootROMSize())
+	}
+	return rom, nil
+}
+
+// Return the register values the boot ROM of the given model leaves behind when it jumps to the cartridge
+// at 0x0100. The DMG and MGB boot ROMs leave the H and C flags set if the header checksum is not zero.
+func postBootCpu(model Model, cart *Cartridge, cgbMode bool) Cpu {
+	cpu := Cpu{PC: 0x0100, SP: 0xfffe}
+
+	switch model {
+	case DMG, MGB:
+		cpu.AF = 0x0180
+		if cart != nil && cart.headerChecksum() != 0 {
+			cpu.AF |= 0x0030
+		}
+		if model == MGB {
+			cpu.setA(0xff)
+		}
+		cpu.BC = 0x0013
+		cpu.DE = 0x00d8
+		cpu.HL = 0x014d
+	case SGB, SGB2:
+		cpu.AF = 0x0100
+		if model == SGB2 {
+			cpu.setA(0xff)
+		}
+		cpu.BC = 0x0014
+		cpu.DE = 0x0000
+		cpu.HL = 0xc060
+	case CGB, AGB:
+		cpu.AF = 0x1180
+		if cgbMode {
+			cpu.DE = 0xff56
+			cpu.HL = 0x000d
+		} else {
+			cpu.DE = 0x0008
+			cpu.HL = 0x007c
+		}
+		if model == AGB {
+			cpu.setF(0x00)
+			cpu.setB(0x01)
+		}
+	}
+	return cpu
+}
+
+// The value of an I/O register after the boot ROM has finished, for the DMG family (DMG, MGB, SGB, SGB2)
+// and the CGB family (CGB, AGB).
+type ioReset struct {
+	addr uint16
+	dmg  uint8
+	cgb  uint8
+}
+
+// NR52 has to come before the other sound registers, as they can only be written while the APU is powered.
+var postBootIO = []ioReset{
+	{0xff00, 0xcf, 0xcf}, // P1
+	{0xff01, 0x00, 0x00}, // SB
+	{0xff02, 0x7e, 0x7f}, // SC
+	{0xff04, 0xab, 0x1e}, // DIV, depends on how long the boot ROM took to run
+	{0xff05, 0x00, 0x00}, // TIMA
+	{0xff06, 0x00, 0x00}, // TMA
+	{0xff07, 0xf8, 0xf8}, // TAC
+	{0xff0f, 0xe1, 0xe1}, // IF
+	{0xff26, 0xf1, 0xf1}, // NR52
+	{0xff10, 0x80, 0x80}, // NR10
+	{0xff11, 0xbf, 0xbf}, // NR11
+	{0xff12, 0xf3, 0xf3}, // NR12
+	{0xff13, 0xff, 0xff}, // NR13
+	{0xff14, 0xbf, 0xbf}, // NR14
+	{0xff16, 0x3f, 0x3f}, // NR21
+	{0xff17, 0x00, 0x00}, // NR22
+	{0xff18, 0xff, 0xff}, // NR23
+	{0xff19, 0xbf, 0xbf}, // NR24
+	{0xff1a, 0x7f, 0x7f}, // NR30
+	{0xff1b, 0xff, 0xff}, // NR31
+	{0xff1c, 0x9f, 0x9f}, // NR32
+	{0xff1d, 0xff, 0xff}, // NR33
+	{0xff1e, 0xbf, 0xbf}, // NR34
+	{0xff20, 0xff, 0xff}, // NR41
+	{0xff21, 0x00, 0x00}, // NR42
+	{0xff22, 0x00, 0x00}, // NR43
+	{0xff23, 0xbf, 0xbf}, // NR44
+	{0xff24, 0x77, 0x77}, // NR50
+	{0xff25, 0xf3, 0xf3}, // NR51
+	{0xff40, 0x91, 0x91}, // LCDC
+	{0xff41, 0x85, 0x85}, // STAT
+	{0xff42, 0x00, 0x00}, // SCY
+	{0xff43, 0x00, 0x00}, // SCX
+	{0xff44, 0x00, 0x00}, // LY
+	{0xff45, 0x00, 0x00}, // LYC
+	{0xff46, 0xff, 0x00}, // DMA
+	{0xff47, 0xfc, 0xfc}, // BGP
+	{0xff48, 0xff, 0xff}, // OBP0
+	{0xff49, 0xff, 0xff}, // OBP1
+	{0xff4a, 0x00, 0x00}, // WY
+	{0xff4b, 0x00, 0x00}, // WX
+	{0xff4d, 0xff, 0x7e}, // KEY1
+	{0xff4f, 0xff, 0xfe}, // VBK
+	{0xff51, 0xff, 0xff}, // HDMA1
+	{0xff52, 0xff, 0xff}, // HDMA2
+	{0xff53, 0xff, 0xff}, // HDMA3
+	{0xff54, 0xff, 0xff}, // HDMA4
+	{0xff55, 0xff, 0xff}, // HDMA5
+	{0xff56, 0xff, 0x3e}, // RP
+	{0xff68, 0xff, 0xc0}, // BCPS
+	{0xff6a, 0xff, 0xc1}, // OCPS
+	{0xff70, 0xff, 0xf8}, // SVBK
+	{0xffff, 0x00, 0x00}, // IE
+}
+
+// The ® symbol the DMG boot ROM draws next to the logo.
+var registeredTile = [8]uint8{0x3c, 0x42, 0xb9, 0xa5, 0xb9, 0xa5, 0x42, 0x3c}
+
+// Put the memory into the state the boot ROM of the given model leaves behind.
+func postBootMemory(mem *Memory, model Model) {
+	for _, reg := range postBootIO {
+		val := reg.dmg
+		if model.isCGB() {
+			val = reg.cgb
+		}
+		if reg.addr == 0xff26 && model.isSGB() {
+			val = 0xf0
+		}
+		if reg.addr == 0xff46 || reg.addr == 0xff55 {
+			// don't start a transfer
+			mem.ram[reg.addr] = val
+			continue
+		}
+		if reg.addr == 0xff00 {
+			// without the SGB seeing a reset pulse for a packet
+			mem.ram[reg.addr] = val
+			if mem.sgb != nil {
+				mem.sgb.p1 = val & 0x30
+			}
+			if mem.joypad != nil {
+				mem.joypad.write(mem, val)
+			}
+			continue
+		}
+		if reg.addr == 0xff04 && mem.timer != nil {
+			// writing DIV would reset the counter
+			mem.timer.counter = uint16(val) << 8
+			continue
+		}
+		mem.Write(reg.addr, val)
+	}
+
+	// The CGB boot ROM sets all background colors of a CGB cartridge to white.
+	if mem.ppu != nil && mem.ppu.cgb {
+		for i := 0; i < len(mem.ppu.bgPalettes); i += 2 {
+			mem.ppu.bgPalettes[i] = 0xff
+			mem.ppu.bgPalettes[i+1] = 0x7f
+		}
+	}
+
+	// The DMG family boot ROMs leave the logo from the cartridge header in video RAM. The CGB boot ROM
+	// draws its own animation which is not reproduced.
+	if !model.isCGB() && mem.cart != nil {
+		loadLogo(mem, mem.cart.logo())
+	}
+}
+
+// Decompress the 48 byte logo from the cartridge header into tiles 0x01 - 0x18 the way the DMG boot ROM
+// does, put the ® symbol into tile 0x19 and arrange them in the background map.
+//
+// Every nibble of the logo is a row of four pixels which gets doubled in width and height, so every byte
+// ends up as four rows of a tile. Only the low bitplane is written.
+func loadLogo(mem *Memory, logo []uint8) {
+	addr := uint16(0x8010)
+	for _, b := range logo {
+		for _, nibble := range []uint8{b >> 4, b & 0x0f} {
+			var row uint8
+			for bit := 3; bit >= 0; bit-- {
+				row <<= 2
+				if nibble&(1<<bit) != 0 {
+					row |= 0x03
+				}
+			}
+			mem.Write(addr, row)
+			mem.Write(addr+2, row)
+			addr += 4
+		}
+	}
+	for i, row := range registeredTile {
+		mem.Write(0x8190+uint16(i)*2, row)
+	}
+
+	mem.Write(0x9910, 0x19)
+	tile := uint8(0x18)
+	for _, end := range []uint16{0x992f, 0x990f} {
+		for addr := end; addr > end-12; addr-- {
+			mem.Write(addr, tile)
+			tile--
+		}
+	}
+}
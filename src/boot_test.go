@@ -0,0 +1,112 @@
+package main
+
+import "testing"
+
+func testCartridge() *Cartridge {
+	rom := make([]uint8, 0x8000)
+	copy(rom[0x0134:], "TESTCART")
+	rom[0x014d] = 0x42
+	return &Cartridge{rom: rom}
+}
+
+// Test that the boot ROM is mapped over the cartridge until 0xff50 is written
+func TestBootROMUnmap(t *testing.T) {
+	initOpCodes()
+	cart := testCartridge()
+	cart.rom[0x0000] = 0xaa
+	bootROM := make([]uint8, 0x0100)
+	bootROM[0x0000] = 0x3e // LD A,0x01
+	bootROM[0x0001] = 0x01
+	bootROM[0x0002] = 0x0e // LD C,0x50
+	bootROM[0x0003] = 0x50
+	bootROM[0x0004] = 0xe2 // LD (C),A
+
+	gb := newGameboy(DMG, cart, bootROM)
+	if gb.cpu.PC != 0x0000 {
+		t.Errorf("Execution should start in the boot ROM. Expected PC 0x0000 but got 0x%X", gb.cpu.PC)
+	}
+
+	gb.step()
+	if gb.mem.Read(0x0000) != 0x3e {
+		t.Errorf("Boot ROM is not mapped. Expected 0x3E but got 0x%X", gb.mem.Read(0x0000))
+	}
+	if gb.mem.Read(0x0134) != 'T' {
+		t.Errorf("Cartridge header should be visible. Expected 0x%X but got 0x%X", 'T', gb.mem.Read(0x0134))
+	}
+
+	gb.step()
+	gb.step()
+	if gb.mem.Read(0x0000) != 0xaa {
+		t.Errorf("Boot ROM was not unmapped. Expected 0xAA but got 0x%X", gb.mem.Read(0x0000))
+	}
+}
+
+// Test that the CGB boot ROM leaves a gap for the cartridge header
+func TestCgbBootROMMapping(t *testing.T) {
+	cart := testCartridge()
+	bootROM := make([]uint8, 0x0900)
+	for i := range bootROM {
+		bootROM[i] = 0xbb
+	}
+	gb := newGameboy(CGB, cart, bootROM)
+
+	if gb.mem.Read(0x00ff) != 0xbb || gb.mem.Read(0x0200) != 0xbb || gb.mem.Read(0x08ff) != 0xbb {
+		t.Errorf("CGB boot ROM is not mapped at 0x0000 - 0x00ff and 0x0200 - 0x08ff")
+	}
+	if gb.mem.Read(0x0134) != 'T' {
+		t.Errorf("Cartridge header should be visible. Expected 0x%X but got 0x%X", 'T', gb.mem.Read(0x0134))
+	}
+	if gb.mem.Read(0x0900) != 0x00 {
+		t.Errorf("Cartridge should be visible after the boot ROM. Expected 0x00 but got 0x%X", gb.mem.Read(0x0900))
+	}
+}
+
+// Test the register values left behind by the boot ROM of each model
+func TestPostBootRegisters(t *testing.T) {
+	cart := testCartridge()
+	tests := []struct {
+		model Model
+		cpu   Cpu
+	}{
+		{DMG, Cpu{AF: 0x01b0, BC: 0x0013, DE: 0x00d8, HL: 0x014d, PC: 0x0100, SP: 0xfffe}},
+		{MGB, Cpu{AF: 0xffb0, BC: 0x0013, DE: 0x00d8, HL: 0x014d, PC: 0x0100, SP: 0xfffe}},
+		{SGB, Cpu{AF: 0x0100, BC: 0x0014, DE: 0x0000, HL: 0xc060, PC: 0x0100, SP: 0xfffe}},
+		{SGB2, Cpu{AF: 0xff00, BC: 0x0014, DE: 0x0000, HL: 0xc060, PC: 0x0100, SP: 0xfffe}},
+		{CGB, Cpu{AF: 0x1180, BC: 0x0000, DE: 0x0008, HL: 0x007c, PC: 0x0100, SP: 0xfffe}},
+		{AGB, Cpu{AF: 0x1100, BC: 0x0100, DE: 0x0008, HL: 0x007c, PC: 0x0100, SP: 0xfffe}},
+	}
+
+	for _, test := range tests {
+		gb := newGameboy(test.model, cart, nil)
+		cpu := gb.cpu
+		cpu.bus = nil
+		if cpu != test.cpu {
+			t.Errorf("Wrong post-boot registers for model %d. Expected %+v but got %+v", test.model, test.cpu, cpu)
+		}
+	}
+
+	cart.rom[0x0143] = 0x80
+	gb := newGameboy(CGB, cart, nil)
+	if gb.cpu.DE != 0xff56 || gb.cpu.HL != 0x000d {
+		t.Errorf("Wrong post-boot registers for CGB mode. Expected DE 0xFF56, HL 0x000D but got DE 0x%X, HL 0x%X", gb.cpu.DE, gb.cpu.HL)
+	}
+}
+
+// Test that the logo from the cartridge header is decompressed into video RAM
+func TestPostBootLogo(t *testing.T) {
+	cart := testCartridge()
+	cart.rom[0x0104] = 0xce // first byte of the Nintendo logo
+	gb := newGameboy(DMG, cart, nil)
+
+	// 0xc = 1100 -> 11110000, 0xe = 1110 -> 11111100
+	expected := []uint8{0xf0, 0x00, 0xf0, 0x00, 0xfc, 0x00, 0xfc, 0x00}
+	for i, val := range expected {
+		if got := gb.mem.Read(0x8010 + uint16(i)); got != val {
+			t.Errorf("Logo tile row %d is wrong. Expected 0x%X but got 0x%X", i, val, got)
+		}
+	}
+
+	if gb.mem.Read(0x9904) != 0x01 || gb.mem.Read(0x992f) != 0x18 || gb.mem.Read(0x9910) != 0x19 {
+		t.Errorf("Logo tiles are not arranged in the background map")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The cartridge header is located at 0x0100 - 0x014f of the cartridge ROM:
+//
+//  -------------------------------------------------
+// | 0x0104 - 0x0133 | Nintendo logo                 |
+// | 0x0134 - 0x0143 | title (0x0143 is the CGB flag |
+// |                 | on newer cartridges)          |
+// | 0x0144 - 0x0145 | new licensee code             |
+// | 0x0146          | SGB flag                      |
+// | 0x0147          | cartridge type                |
+// | 0x014b          | old licensee code             |
+// | 0x014d          | header checksum               |
+//  -------------------------------------------------
+
+type Cartridge struct {
+	rom []uint8
+}
+
+func loadCartridge(path string) (*Cartridge, error) {
+	rom, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rom) < 0x0150 {
+		return nil, fmt.Errorf("%s is too small to be a cartridge ROM (%d bytes)", path, len(rom))
+	}
+	return &Cartridge{rom: rom}, nil
+}
+
+// Read from the cartridge ROM. Without a memory bank controller only the first 32KB are visible.
+func (cart *Cartridge) read(addr uint16) uint8 {
+	if int(addr) >= len(cart.rom) {
+		return 0xff
+	}
+	return cart.rom[addr]
+}
+
+// Return the title from the cartridge header.
+func (cart *Cartridge) title() string {
+	title := cart.rom[0x0134:0x0144]
+	if cart.cgbFlag()&0x80 != 0 {
+		title = title[:15]
+	}
+	return strings.TrimRight(string(title), "\x00")
+}
+
+// Return the CGB flag from the cartridge header. Bit 7 is set if the cartridge supports CGB functions.
+func (cart *Cartridge) cgbFlag() uint8 {
+	return cart.rom[0x0143]
+}
+
+// Return the header checksum from the cartridge header.
+func (cart *Cartridge) headerChecksum() uint8 {
+	return cart.rom[0x014d]
+}
+
+// Return the 48 byte Nintendo logo from the cartridge header.
+func (cart *Cartridge) logo() []uint8 {
+	return cart.rom[0x0104:0x0134]
+}
+
+// Check whether the cartridge was published by Nintendo, either through the old licensee code or, if that
+// is 0x33, through the new one.
+func (cart *Cartridge) nintendo() bool {
+	old := cart.rom[0x014b]
+	if old == 0x33 {
+		return string(cart.rom[0x0144:0x0146]) == "01"
+	}
+	return old == 0x01
+}
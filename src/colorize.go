@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// When the CGB runs a cartridge without CGB functions, the boot ROM picks colors for background palette 0
+// and object palettes 0 and 1. The PPU then maps the shades of BGP, OBP0 and OBP1 to these colors.
+//
+// For cartridges published by Nintendo, the boot ROM sums up the 16 bytes of the title and looks the sum up
+// in a table of known games. Some sums are shared by several games, for those the fourth letter of the
+// title decides. Every other cartridge gets the default palettes.
+//
+// Holding one of these button combinations while the logo is shown overrides the choice:
+//
+//  --------------------------------------------------------
+// | button | alone        | with A        | with B        |
+// | up     | brown        | red           | dark brown    |
+// | left   | blue         | dark blue     | grayscale     |
+// | down   | pastel       | orange        | yellow        |
+// | right  | green        | dark green(*) | inverted      |
+//  --------------------------------------------------------
+//
+// (*) default palettes
+
+// The colors of the boot ROM in RGB555, four per palette.
+var compatColors = [30 * 4]uint16{
+	0x7fff, 0x32bf, 0x00d0, 0x0000,
+	0x639f, 0x4279, 0x15b0, 0x04cb,
+	0x7fff, 0x6e31, 0x454a, 0x0000,
+	0x7fff, 0x1bef, 0x0200, 0x0000,
+	0x7fff, 0x421f, 0x1cf2, 0x0000,
+	0x7fff, 0x5294, 0x294a, 0x0000,
+	0x7fff, 0x03ff, 0x012f, 0x0000,
+	0x7fff, 0x03ef, 0x01d6, 0x0000,
+	0x7fff, 0x42b5, 0x3dc8, 0x0000,
+	0x7e74, 0x03ff, 0x0180, 0x0000,
+	0x67ff, 0x77ac, 0x1a13, 0x2d6b,
+	0x7ed6, 0x4bff, 0x2175, 0x0000,
+	0x53ff, 0x4a5f, 0x7e52, 0x0000,
+	0x4fff, 0x7ed2, 0x3a4c, 0x1ce0,
+	0x03ed, 0x7fff, 0x255f, 0x0000,
+	0x036a, 0x021f, 0x03ff, 0x7fff,
+	0x7fff, 0x01df, 0x0112, 0x0000,
+	0x231f, 0x035f, 0x00f2, 0x0009,
+	0x7fff, 0x03ea, 0x011f, 0x0000,
+	0x299f, 0x001a, 0x000c, 0x0000,
+	0x7fff, 0x027f, 0x001f, 0x0000,
+	0x7fff, 0x03e0, 0x0206, 0x0120,
+	0x7fff, 0x7eeb, 0x001f, 0x7c00,
+	0x7fff, 0x3fff, 0x7e00, 0x001f,
+	0x7fff, 0x03ff, 0x001f, 0x0000,
+	0x03ff, 0x001f, 0x000c, 0x0000,
+	0x7fff, 0x033f, 0x0193, 0x0000,
+	0x0000, 0x4200, 0x037f, 0x7fff,
+	0x7fff, 0x7e8c, 0x7c00, 0x0000,
+	0x7fff, 0x1bef, 0x6180, 0x0000,
+}
+
+// A combination of palettes, given as the index of their first color in compatColors. A few combinations
+// don't start at a palette boundary, which the boot ROM does just the same.
+type compatPalettes struct {
+	obj0, obj1, bg int
+}
+
+// Return a combination of the given palettes in compatColors.
+func palettes(obj0, obj1, bg int) compatPalettes {
+	return compatPalettes{obj0 * 4, obj1 * 4, bg * 4}
+}
+
+var compatCombinations = []compatPalettes{
+	palettes(4, 4, 29),         // 0, default
+	palettes(18, 18, 18),       // 1
+	palettes(20, 20, 20),       // 2
+	palettes(24, 24, 24),       // 3
+	palettes(9, 9, 9),          // 4
+	palettes(0, 0, 0),          // 5
+	palettes(27, 27, 27),       // 6
+	palettes(5, 5, 5),          // 7
+	palettes(12, 12, 12),       // 8
+	palettes(26, 26, 26),       // 9
+	palettes(16, 8, 8),         // 10
+	palettes(4, 28, 28),        // 11
+	palettes(4, 2, 2),          // 12
+	palettes(3, 4, 4),          // 13
+	palettes(4, 29, 29),        // 14
+	palettes(28, 4, 28),        // 15
+	palettes(2, 17, 2),         // 16
+	palettes(16, 16, 8),        // 17
+	palettes(4, 4, 7),          // 18
+	palettes(4, 4, 18),         // 19
+	palettes(4, 4, 20),         // 20
+	palettes(19, 19, 9),        // 21
+	{4*4 - 1, 4*4 - 1, 11 * 4}, // 22
+	palettes(17, 17, 2),        // 23
+	palettes(4, 4, 2),          // 24
+	palettes(4, 4, 3),          // 25
+	palettes(28, 28, 0),        // 26
+	palettes(3, 3, 0),          // 27
+	palettes(0, 0, 1),          // 28
+	palettes(18, 22, 18),       // 29
+	palettes(20, 22, 20),       // 30
+	palettes(24, 22, 24),       // 31
+	palettes(16, 22, 8),        // 32
+	palettes(17, 4, 13),        // 33
+	{28*4 - 1, 0 * 4, 14 * 4},  // 34
+	{28*4 - 1, 4 * 4, 15 * 4},  // 35
+	palettes(19, 22, 9),        // 36
+	palettes(16, 28, 10),       // 37
+	palettes(4, 23, 28),        // 38
+	palettes(17, 22, 2),        // 39
+	palettes(4, 0, 2),          // 40
+	palettes(4, 28, 3),         // 41
+	palettes(28, 3, 0),         // 42
+	palettes(3, 28, 4),         // 43
+	palettes(21, 28, 4),        // 44
+	palettes(3, 28, 0),         // 45
+	palettes(25, 3, 28),        // 46
+	palettes(0, 28, 8),         // 47
+	palettes(4, 3, 28),         // 48
+	palettes(28, 3, 6),         // 49
+	palettes(4, 28, 29),        // 50
+}
+
+// Title checksums of the known games and the combination they use. From the 66th entry on, the checksums
+// are shared and the fourth letter of the title has to match the corresponding entry in titleLetters too.
+var titleChecksums = []struct {
+	checksum    uint8
+	combination int
+}{
+	{0x00, 0},  // default
+	{0x88, 4},  // ALLEY WAY
+	{0x16, 5},  // YAKUMAN
+	{0x36, 35}, // BASEBALL
+	{0xd1, 34}, // TENNIS
+	{0xdb, 3},  // TETRIS
+	{0xf2, 31}, // QIX
+	{0x3c, 15}, // DR.MARIO
+	{0x8c, 10}, // RADARMISSION
+	{0x92, 5},  // F1RACE
+	{0x3d, 19}, // YOSSY NO TAMAGO
+	{0x5c, 36},
+	{0x58, 7},  // X
+	{0xc9, 37}, // MARIOLAND2
+	{0x3e, 30}, // YOSSY NO COOKIE
+	{0x70, 44}, // ZELDA
+	{0x1d, 21},
+	{0x59, 32},
+	{0x69, 31}, // TETRIS FLASH
+	{0x19, 20}, // DONKEY KONG
+	{0x35, 5},  // MARIO'S PICROSS
+	{0xa8, 33},
+	{0x14, 13}, // POKEMON RED
+	{0xaa, 14}, // POKEMON GREEN
+	{0x75, 5},  // PICROSS 2
+	{0x95, 29}, // YOSSY NO PANEPON
+	{0x99, 5},  // KIRAKIRA KIDS
+	{0x34, 18}, // GAMEBOY GALLERY
+	{0x6f, 9},  // POCKETCAMERA
+	{0x15, 3},
+	{0xff, 2},  // BALLOON KID
+	{0x97, 26}, // KINGOFTHEZOO
+	{0x4b, 25}, // DMG FOOTBALL
+	{0x90, 25}, // WORLD CUP
+	{0x17, 41}, // OTHELLO
+	{0x10, 42}, // SUPER RC PRO-AM
+	{0x39, 26}, // DYNABLASTER
+	{0xf7, 45}, // BOY AND BLOB GB2
+	{0xf6, 42}, // MEGAMAN
+	{0xa2, 45}, // STAR WARS-NOA
+	{0x49, 36},
+	{0x4e, 38}, // WAVERACE
+	{0x43, 26},
+	{0x68, 42}, // LOLO2
+	{0xe0, 30}, // YOSHI'S COOKIE
+	{0x8b, 41}, // MYSTIC QUEST
+	{0xf0, 34},
+	{0xce, 34}, // TOPRANKINGTENNIS
+	{0x0c, 5},  // MANSELL
+	{0x29, 42}, // MEGAMAN3
+	{0xe8, 6},  // SPACE INVADERS
+	{0xb7, 5},  // GAME&WATCH
+	{0x86, 33}, // DONKEYKONGLAND95
+	{0x9a, 25}, // ASTEROIDS/MISCMD
+	{0x52, 42}, // STREET FIGHTER 2
+	{0x01, 42}, // DEFENDER/JOUST
+	{0x9d, 40}, // KILLERINSTINCT95
+	{0x71, 2},  // TETRIS BLAST
+	{0x9c, 16}, // PINOCCHIO
+	{0xbd, 25},
+	{0x5d, 42}, // BA.TOSHINDEN
+	{0x6d, 42}, // NETTOU KOF 95
+	{0x67, 5},
+	{0x3f, 0},  // TETRIS PLUS
+	{0x6b, 39}, // DONKEYKONGLAND 3
+
+	{0xb3, 36},
+	{0x46, 32}, // SUPER MARIOLAND
+	{0x28, 25}, // GOLF
+	{0xa5, 6},  // SOLARSTRIKER
+	{0xc6, 32}, // GBWARS
+	{0xd3, 12}, // KAERUNOTAMENI
+	{0x27, 36},
+	{0x61, 11}, // POKEMON BLUE
+	{0x18, 39}, // DONKEYKONGLAND
+	{0x66, 18}, // GAMEBOY GALLERY2
+	{0x6a, 39}, // DONKEYKONGLAND 2
+	{0xbf, 24}, // KID ICARUS
+	{0x0d, 31}, // TETRIS2
+	{0xf4, 50},
+	{0xb3, 17}, // MOGURANYA
+	{0x46, 46},
+	{0x28, 6},  // GALAGA&GALAXIAN
+	{0xa5, 27}, // BT2RAGNAROKWORLD
+	{0xc6, 0},  // KEN GRIFFEY JR
+	{0xd3, 47},
+	{0x27, 41}, // MAGNETIC SOCCER
+	{0x61, 41}, // VEGAS STAKES
+	{0x18, 0},
+	{0x66, 0},  // MILLI/CENTI/PEDE
+	{0x6a, 19}, // MARIO & YOSHI
+	{0xbf, 34}, // SOCCER
+	{0x0d, 23}, // POKEBALL
+	{0xf4, 18}, // BIG SCORE
+	{0xb3, 29},
+}
+
+const firstSharedChecksum = 65
+
+// The fourth letter of the titles with shared checksums.
+const titleLetters = "BEFAARBEKEK R-URAR INAILICE R"
+
+// The combinations chosen by holding a button combination during boot.
+var comboCombinations = map[string]int{
+	"right":   1,
+	"left":    48,
+	"up":      5,
+	"down":    8,
+	"right+a": 0,
+	"left+a":  40,
+	"up+a":    43,
+	"down+a":  3,
+	"right+b": 6,
+	"left+b":  7,
+	"up+b":    28,
+	"down+b":  49,
+}
+
+// Return the combination selected by a button combination like "up+a".
+func parseButtonCombo(name string) (int, error) {
+	combination, ok := comboCombinations[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown button combination %q", name)
+	}
+	return combination, nil
+}
+
+// Return the combination the boot ROM picks for the given cartridge.
+func titleCombination(cart *Cartridge) int {
+	if cart == nil || !cart.nintendo() {
+		return 0
+	}
+
+	var checksum uint8
+	for _, b := range cart.rom[0x0134:0x0144] {
+		checksum += b
+	}
+	letter := cart.rom[0x0137]
+
+	for i, entry := range titleChecksums {
+		if entry.checksum != checksum {
+			continue
+		}
+		if i < firstSharedChecksum || titleLetters[i-firstSharedChecksum] == letter {
+			return entry.combination
+		}
+	}
+	return 0
+}
+
+// Load background palette 0 and object palettes 0 and 1 with the given combination.
+func (ppu *Ppu) loadCompatPalettes(combination int) {
+	c := compatCombinations[combination]
+	for color := uint8(0); color < 4; color++ {
+		setPaletteColor(ppu.bgPalettes[:], 0, color, compatColors[c.bg+int(color)])
+		setPaletteColor(ppu.objPalettes[:], 0, color, compatColors[c.obj0+int(color)])
+		setPaletteColor(ppu.objPalettes[:], 1, color, compatColors[c.obj1+int(color)])
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The controls are configured in gbemu/config.json in the config directory of the user (e.g. ~/.config on
+// Linux). Every entry is optional and replaces the default of the same name, e.g.:
+//
+//	{
+//	    "keys": {"a": ["X", "Space"], "b": ["Z"]},
+//	    "gamepad": {"a": ["RightRight"], "b": ["RightBottom"]},
+//	    "hotkeys": {"fullscreen": "F11"},
+//	    "turbo-rate": 2,
+//	    "roms": {
+//	        "TETRIS": {"keys": {"a": ["Up"]}},
+//	        "0x3B": {"gamepad": {"start": ["RightTop"]}}
+//	    }
+//	}
+//
+// keys and gamepad bind the joypad buttons (right, left, up, down, a, b, select, start) and the turbo buttons
+// (turbo-a, turbo-b) to lists of keys and buttons of the standard gamepad layout. turbo-rate is the number of
+// frames the turbo buttons stay pressed and released in turn. hotkeys bind the functions of the emulator to a
+// key each. Entries in roms override the bindings of single joypad buttons for the cartridge with the given
+// title, or with the given header checksum in hex. The gbs- hotkeys only work while playing GBS files. The
+// file can be reloaded while running with the reload hotkey, and is also reloaded whenever it changes.
+
+// Functions of the emulator which can be bound to hotkeys.
+const (
+	hotkeyOverlay    = "overlay"
+	hotkeyDisplay    = "display"
+	hotkeyFullscreen = "fullscreen"
+	hotkeyMute       = "mute"
+	hotkeyVolumeDown = "volume-down"
+	hotkeyVolumeUp   = "volume-up"
+	hotkeyRecord     = "record"
+	hotkeyVgm        = "vgm"
+	hotkeyReload     = "reload"
+	hotkeyMacroRec   = "macro-record"
+	hotkeyMacroPlay  = "macro-play"
+	hotkeyGbsNext    = "gbs-next"
+	hotkeyGbsPrev    = "gbs-prev"
+	hotkeyGbsLoop    = "gbs-loop"
+)
+
+var buttonNames = map[string]uint8{
+	"right":  buttonRight,
+	"left":   buttonLeft,
+	"up":     buttonUp,
+	"down":   buttonDown,
+	"a":      buttonA,
+	"b":      buttonB,
+	"select": buttonSelect,
+	"start":  buttonStart,
+}
+
+var turboNames = map[string]uint8{
+	"turbo-a": buttonA,
+	"turbo-b": buttonB,
+}
+
+type Bindings struct {
+	Keys    map[string][]string `json:"keys,omitempty"`
+	Gamepad map[string][]string `json:"gamepad,omitempty"`
+}
+
+type Config struct {
+	Bindings
+	Hotkeys   map[string]string   `json:"hotkeys,omitempty"`
+	TurboRate int                 `json:"turbo-rate,omitempty"`
+	Roms      map[string]Bindings `json:"roms,omitempty"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Bindings: Bindings{
+			// A to the right of B like on the Game Boy
+			Keys: map[string][]string{
+				"right":   {"ArrowRight"},
+				"left":    {"ArrowLeft"},
+				"up":      {"ArrowUp"},
+				"down":    {"ArrowDown"},
+				"a":       {"X"},
+				"b":       {"Z"},
+				"select":  {"Backspace"},
+				"start":   {"Enter"},
+				"turbo-a": {"S"},
+				"turbo-b": {"A"},
+			},
+			Gamepad: map[string][]string{
+				"right":   {"LeftRight"},
+				"left":    {"LeftLeft"},
+				"up":      {"LeftTop"},
+				"down":    {"LeftBottom"},
+				"a":       {"RightRight"},
+				"b":       {"RightBottom"},
+				"select":  {"CenterLeft"},
+				"start":   {"CenterRight"},
+				"turbo-a": {"RightTop"},
+				"turbo-b": {"RightLeft"},
+			},
+		},
+		Hotkeys: map[string]string{
+			hotkeyOverlay:    "F1",
+			hotkeyDisplay:    "F2",
+			hotkeyMute:       "F3",
+			hotkeyVolumeDown: "F4",
+			hotkeyVolumeUp:   "F5",
+			hotkeyRecord:     "F6",
+			hotkeyVgm:        "F7",
+			hotkeyMacroRec:   "F8",
+			hotkeyReload:     "F9",
+			hotkeyMacroPlay:  "F10",
+			hotkeyFullscreen: "F11",
+			hotkeyGbsNext:    "ArrowRight",
+			hotkeyGbsPrev:    "ArrowLeft",
+			hotkeyGbsLoop:    "L",
+		},
+		TurboRate: defaultTurboRate,
+	}
+}
+
+// Return the path of the config file in the config directory of the user.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gbemu", "config.json"), nil
+}
+
+// Load the config file on top of the defaults. A missing file gives the defaults.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file Config
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := file.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config.merge(&file)
+	return config, nil
+}
+
+// Replace the entries of the config with the ones given in the file.
+func (config *Config) merge(file *Config) {
+	config.Bindings.merge(file.Bindings)
+	for name, key := range file.Hotkeys {
+		config.Hotkeys[name] = key
+	}
+	if file.TurboRate != 0 {
+		config.TurboRate = file.TurboRate
+	}
+	config.Roms = map[string]Bindings{}
+	for name, rom := range file.Roms {
+		if strings.HasPrefix(strings.ToLower(name), "0x") {
+			name = "0x" + strings.ToUpper(name[2:])
+		}
+		config.Roms[name] = rom
+	}
+}
+
+// Replace the bindings of the buttons given in other.
+func (b *Bindings) merge(other Bindings) {
+	for name, keys := range other.Keys {
+		b.Keys[strings.ToLower(name)] = keys
+	}
+	for name, buttons := range other.Gamepad {
+		b.Gamepad[strings.ToLower(name)] = buttons
+	}
+}
+
+func (config *Config) validate() error {
+	all := []Bindings{config.Bindings}
+	for _, rom := range config.Roms {
+		all = append(all, rom)
+	}
+	for _, bindings := range all {
+		for _, names := range []map[string][]string{bindings.Keys, bindings.Gamepad} {
+			for name := range names {
+				_, turbo := turboNames[strings.ToLower(name)]
+				if _, ok := buttonNames[strings.ToLower(name)]; !ok && !turbo {
+					return fmt.Errorf("unknown joypad button %q", name)
+				}
+			}
+		}
+	}
+	if config.TurboRate < 0 {
+		return fmt.Errorf("turbo rate %d is negative", config.TurboRate)
+	}
+	defaults := defaultConfig().Hotkeys
+	for name := range config.Hotkeys {
+		if _, ok := defaults[name]; !ok {
+			return fmt.Errorf("unknown hotkey %q", name)
+		}
+	}
+	return nil
+}
+
+// Return the bindings for the given cartridge, with the overrides for its title or header checksum.
+func (config *Config) bindings(cart *Cartridge) Bindings {
+	merged := Bindings{Keys: map[string][]string{}, Gamepad: map[string][]string{}}
+	merged.merge(config.Bindings)
+	if cart != nil {
+		// the title wins over the checksum
+		for _, name := range []string{fmt.Sprintf("0x%02X", cart.headerChecksum()), cart.title()} {
+			if rom, ok := config.Roms[name]; ok {
+				merged.merge(rom)
+			}
+		}
+	}
+	return merged
+}
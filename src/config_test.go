@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Test that a missing config file gives the defaults
+func TestConfigMissing(t *testing.T) {
+	config, err := loadConfig(filepath.Join(t.TempDir(), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, defaultConfig()) {
+		t.Errorf("Expected the default config but got %v", config)
+	}
+}
+
+// Test that the entries of the file replace the defaults of the same name only
+func TestConfigMerge(t *testing.T) {
+	path := writeConfig(t, `{"keys": {"A": ["Space"], "Turbo-A": ["D"]}, "hotkeys": {"fullscreen": "F12", "gbs-next": "N"}, "turbo-rate": 3}`)
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := config.bindings(nil)
+	if keys := bindings.Keys["a"]; !reflect.DeepEqual(keys, []string{"Space"}) {
+		t.Errorf("Expected the keys of A to be replaced but got %v", keys)
+	}
+	if keys := bindings.Keys["b"]; !reflect.DeepEqual(keys, []string{"Z"}) {
+		t.Errorf("Expected the default keys of B but got %v", keys)
+	}
+	if keys := bindings.Keys["turbo-a"]; !reflect.DeepEqual(keys, []string{"D"}) {
+		t.Errorf("Expected the keys of turbo A to be replaced but got %v", keys)
+	}
+	if config.TurboRate != 3 {
+		t.Errorf("Expected turbo rate 3 but got %d", config.TurboRate)
+	}
+	if key := config.Hotkeys[hotkeyFullscreen]; key != "F12" {
+		t.Errorf("Expected the fullscreen hotkey F12 but got %s", key)
+	}
+	if key := config.Hotkeys[hotkeyOverlay]; key != "F1" {
+		t.Errorf("Expected the default overlay hotkey F1 but got %s", key)
+	}
+	if key := config.Hotkeys[hotkeyGbsNext]; key != "N" {
+		t.Errorf("Expected the GBS next song hotkey N but got %s", key)
+	}
+}
+
+// Test the overrides for a cartridge by title and by header checksum, where the title wins
+func TestConfigRomOverrides(t *testing.T) {
+	path := writeConfig(t, `{"roms": {
+		"TESTCART": {"keys": {"a": ["Q"]}},
+		"0x42": {"keys": {"a": ["W"], "b": ["E"]}, "gamepad": {"start": ["RightTop"]}}
+	}}`)
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := config.bindings(testCartridge())
+	if keys := bindings.Keys["a"]; !reflect.DeepEqual(keys, []string{"Q"}) {
+		t.Errorf("Expected the keys of A by title but got %v", keys)
+	}
+	if keys := bindings.Keys["b"]; !reflect.DeepEqual(keys, []string{"E"}) {
+		t.Errorf("Expected the keys of B by checksum but got %v", keys)
+	}
+	if buttons := bindings.Gamepad["start"]; !reflect.DeepEqual(buttons, []string{"RightTop"}) {
+		t.Errorf("Expected the gamepad buttons of Start by checksum but got %v", buttons)
+	}
+	if keys := bindings.Keys["up"]; !reflect.DeepEqual(keys, []string{"ArrowUp"}) {
+		t.Errorf("Expected the default keys of Up but got %v", keys)
+	}
+	if keys := config.bindings(nil).Keys["a"]; !reflect.DeepEqual(keys, []string{"X"}) {
+		t.Errorf("Expected no overrides without a cartridge but got %v", keys)
+	}
+}
+
+// Test that unknown names and broken files are reported
+func TestConfigErrors(t *testing.T) {
+	for _, text := range []string{
+		`{"keys": {"turbo": ["T"]}}`,
+		`{"roms": {"TESTCART": {"gamepad": {"x": ["RightTop"]}}}}`,
+		`{"hotkeys": {"rewind": "R"}}`,
+		`{"turbo-rate": -1}`,
+		`{"keys": `,
+	} {
+		if _, err := loadConfig(writeConfig(t, text)); err == nil {
+			t.Errorf("Expected an error for %s", text)
+		}
+	}
+}
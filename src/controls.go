@@ -0,0 +1,68 @@
+package main
+
+// Controls sit between the host input and the joypad and produce the buttons for every frame. Turbo buttons
+// alternate between pressed and released every turboRate frames while held, starting with pressed. A macro
+// records the buttons of every frame and replays them frame by frame, in place of the host input, so the
+// game sees exactly the same sequence through P1 as when it was recorded.
+
+const defaultTurboRate = 2
+
+type Controls struct {
+	turboRate int
+	// frames the turbo buttons have been held
+	turboFrames int
+
+	macro     []uint8
+	recording bool
+	replaying bool
+	// next frame of the macro to replay
+	position int
+}
+
+func newControls(turboRate int) *Controls {
+	return &Controls{turboRate: turboRate}
+}
+
+// Return the buttons for the next frame from the held buttons and the held turbo buttons.
+func (c *Controls) next(held uint8, turbo uint8) uint8 {
+	if c.replaying {
+		buttons := c.macro[c.position]
+		c.position++
+		c.replaying = c.position < len(c.macro)
+		return buttons
+	}
+
+	buttons := held
+	if turbo == 0 {
+		c.turboFrames = 0
+	} else {
+		if c.turboFrames/c.turboRate%2 == 0 {
+			buttons |= turbo
+		}
+		c.turboFrames++
+	}
+	if c.recording {
+		c.macro = append(c.macro, buttons)
+	}
+	return buttons
+}
+
+// Start recording a new macro, or stop the recording.
+func (c *Controls) toggleRecording() {
+	if c.recording {
+		c.recording = false
+		return
+	}
+	c.replaying = false
+	c.recording = true
+	c.macro = nil
+}
+
+// Replay the macro from the start. Does nothing while recording or without a macro.
+func (c *Controls) replay() {
+	if c.recording || len(c.macro) == 0 {
+		return
+	}
+	c.replaying = true
+	c.position = 0
+}
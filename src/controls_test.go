@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+// Test that turbo buttons alternate every turboRate frames, starting pressed
+func TestControlsTurbo(t *testing.T) {
+	c := newControls(2)
+	expected := []uint8{buttonA, buttonA, 0, 0, buttonA, buttonA}
+	for i, want := range expected {
+		if got := c.next(0, buttonA); got != want {
+			t.Errorf("Frame %d: expected 0x%X but got 0x%X", i, want, got)
+		}
+	}
+
+	// releasing restarts the cycle, held buttons stay pressed
+	c.next(0, 0)
+	if got := c.next(buttonUp, buttonB); got != buttonUp|buttonB {
+		t.Errorf("Expected 0x%X but got 0x%X", buttonUp|buttonB, got)
+	}
+}
+
+// Test that a macro replays the recorded frames in place of the held buttons
+func TestControlsMacro(t *testing.T) {
+	c := newControls(1)
+	c.replay()
+	if got := c.next(buttonB, 0); got != buttonB {
+		t.Errorf("Replaying without a macro should do nothing. Expected 0x%X but got 0x%X", buttonB, got)
+	}
+
+	c.toggleRecording()
+	recorded := []uint8{buttonA, 0, buttonStart}
+	for _, buttons := range recorded {
+		c.next(buttons, 0)
+	}
+	c.next(0, buttonB) // turbo frames are recorded as pressed
+	c.toggleRecording()
+	recorded = append(recorded, buttonB)
+
+	c.replay()
+	for i, want := range recorded {
+		if got := c.next(buttonLeft, 0); got != want {
+			t.Errorf("Frame %d: expected 0x%X but got 0x%X", i, want, got)
+		}
+	}
+	if got := c.next(buttonLeft, 0); got != buttonLeft {
+		t.Errorf("The held buttons should be back after the macro. Expected 0x%X but got 0x%X", buttonLeft, got)
+	}
+}
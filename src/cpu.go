@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 // The CPU in the original Gameboy has eight general purpose 8-bit registers (A,..,F,H,L).
 // and two 16 bit registers acting as the program counter (PC) and stack pointer (SP).
 //
@@ -35,6 +37,25 @@ type Cpu struct {
 	// program counter and stack pointer
 	PC uint16
 	SP uint16
+
+	// the last instruction jumped, which takes longer for the conditional ones
+	branched bool
+
+	// interrupt master enable (IME), EI sets it only after the following instruction
+	ime     bool
+	eiDelay bool
+	// HALT sleeps until an interrupt is pending, or with the HALT bug makes the CPU read the next byte twice
+	halted  bool
+	haltBug bool
+
+	// set when the CPU ran into an opcode it cannot execute, the CPU stays at the opcode from then on
+	err error
+
+	// the other components on the bus, advanced once every M-cycle before the memory access of the M-cycle,
+	// so they are in step with the CPU when it reads or writes them
+	bus ticker
+	// M-cycles the current instruction took so far
+	cycles int
 }
 
 func init() {
@@ -96,8 +117,16 @@ func (cpu *Cpu) setHL(val uint8) {
 	cpu.HL = (cpu.HL & 0x00ff) | (uint16(val) << 8)
 }
 
+// A component which advances by one M-cycle at a time.
+type ticker interface {
+	tick()
+}
+
 var opcodes map[uint8]func(*Cpu, *Memory)
 
+// Operations of the opcodes prefixed with 0xcb, indexed by their second byte.
+var cbopcodes map[uint8]func(*Cpu, *Memory)
+
 // Initalize opcodes map
 func initOpCodes() {
 	opcodes = make(map[uint8]func(*Cpu, *Memory))
@@ -120,7 +149,7 @@ func initOpCodes() {
 	// |        A | 111           |
 	// |        B | 000           |
 	// |        C | 001           |
-	// |        D | 101           |
+	// |        D | 010           |
 	// |        E | 011           |
 	// |        H | 100           |
 	// |        L | 101           |
@@ -143,42 +172,42 @@ func initOpCodes() {
 	// LD B,n
 	opcodes[0x06] = func(cpu *Cpu, mem *Memory) {
 		cpu.PC++
-		val := mem.Read(cpu.PC)
+		val := cpu.read(mem, cpu.PC)
 		cpu.setB(val)
 	}
 
 	// LD C,n
 	opcodes[0x0e] = func(cpu *Cpu, mem *Memory) {
 		cpu.PC++
-		val := mem.Read(cpu.PC)
+		val := cpu.read(mem, cpu.PC)
 		cpu.setC(val)
 	}
 
 	// LD D,n
 	opcodes[0x16] = func(cpu *Cpu, mem *Memory) {
 		cpu.PC++
-		val := mem.Read(cpu.PC)
+		val := cpu.read(mem, cpu.PC)
 		cpu.setD(val)
 	}
 
 	// LD E,n
 	opcodes[0x1e] = func(cpu *Cpu, mem *Memory) {
 		cpu.PC++
-		val := mem.Read(cpu.PC)
+		val := cpu.read(mem, cpu.PC)
 		cpu.setE(val)
 	}
 
 	// LD H,n
 	opcodes[0x26] = func(cpu *Cpu, mem *Memory) {
 		cpu.PC++
-		val := mem.Read(cpu.PC)
+		val := cpu.read(mem, cpu.PC)
 		cpu.setH(val)
 	}
 
 	// LD L,n
 	opcodes[0x2e] = func(cpu *Cpu, mem *Memory) {
 		cpu.PC++
-		val := mem.Read(cpu.PC)
+		val := cpu.read(mem, cpu.PC)
 		cpu.setL(val)
 	}
 
@@ -219,22 +248,22 @@ func initOpCodes() {
 
 	// LD A,(C)
 	opcodes[0xf2] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(mem.Read(0xff00 + uint16(lowByte(cpu.BC))))
+		cpu.setA(cpu.read(mem, 0xff00+uint16(lowByte(cpu.BC))))
 	}
 
 	// LD A,(BC)
 	opcodes[0x0a] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(mem.Read(cpu.BC))
+		cpu.setA(cpu.read(mem, cpu.BC))
 	}
 
 	// LD A,(DE)
 	opcodes[0x1a] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(mem.Read(cpu.DE))
+		cpu.setA(cpu.read(mem, cpu.DE))
 	}
 
 	// LD A,(HL)
 	opcodes[0x7e] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(mem.Read(cpu.HL))
+		cpu.setA(cpu.read(mem, cpu.HL))
 	}
 
 	// LD A,(nn)
@@ -242,9 +271,9 @@ func initOpCodes() {
 		cpu.setA(readNN(cpu, mem))
 	}
 
-	// LA A,(n)
+	// LD A,(n)
 	opcodes[0xf0] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(readN(cpu, mem))
+		cpu.setA(cpu.read(mem, 0xff00+uint16(readN(cpu, mem))))
 	}
 
 	// LD A,(#)
@@ -254,13 +283,13 @@ func initOpCodes() {
 
 	// LD A,(HLI)
 	opcodes[0x2a] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(mem.Read(cpu.HL))
+		cpu.setA(cpu.read(mem, cpu.HL))
 		cpu.HL++
 	}
 
 	// LD A,(HLD)
 	opcodes[0x3a] = func(cpu *Cpu, mem *Memory) {
-		cpu.setA(mem.Read(cpu.HL))
+		cpu.setA(cpu.read(mem, cpu.HL))
 		cpu.HL--
 	}
 
@@ -301,7 +330,7 @@ func initOpCodes() {
 
 	// LD B,(HL)
 	opcodes[0x46] = func(cpu *Cpu, mem *Memory) {
-		cpu.setB(mem.Read(cpu.HL))
+		cpu.setB(cpu.read(mem, cpu.HL))
 	}
 
 	// LD C,A
@@ -341,12 +370,12 @@ func initOpCodes() {
 
 	// LD C,(HL)
 	opcodes[0x4e] = func(cpu *Cpu, mem *Memory) {
-		cpu.setC(mem.Read(cpu.HL))
+		cpu.setC(cpu.read(mem, cpu.HL))
 	}
 
 	// LD (C),A
 	opcodes[0xe2] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[0xff00+uint16(lowByte(cpu.BC))] = highByte(cpu.AF)
+		cpu.write(mem, 0xff00+uint16(lowByte(cpu.BC)), highByte(cpu.AF))
 	}
 
 	// LD D,A
@@ -386,7 +415,7 @@ func initOpCodes() {
 
 	// LD D,(HL)
 	opcodes[0x56] = func(cpu *Cpu, mem *Memory) {
-		cpu.setD(mem.Read(cpu.HL))
+		cpu.setD(cpu.read(mem, cpu.HL))
 	}
 
 	// LD E,A
@@ -426,7 +455,7 @@ func initOpCodes() {
 
 	// LD E,(HL)
 	opcodes[0x5e] = func(cpu *Cpu, mem *Memory) {
-		cpu.setE(mem.Read(cpu.HL))
+		cpu.setE(cpu.read(mem, cpu.HL))
 	}
 
 	// LD H,A
@@ -466,7 +495,7 @@ func initOpCodes() {
 
 	// LD H,(HL)
 	opcodes[0x66] = func(cpu *Cpu, mem *Memory) {
-		cpu.setH(mem.Read(cpu.HL))
+		cpu.setH(cpu.read(mem, cpu.HL))
 	}
 
 	// LD L,A
@@ -506,68 +535,68 @@ func initOpCodes() {
 
 	// LD L,(HL)
 	opcodes[0x6e] = func(cpu *Cpu, mem *Memory) {
-		cpu.setL(mem.Read(cpu.HL))
+		cpu.setL(cpu.read(mem, cpu.HL))
 	}
 
 	// LD (BC),A
 	opcodes[0x02] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.AF)
+		cpu.write(mem, cpu.BC, highByte(cpu.AF))
 	}
 
 	// LD (DE),A
 	opcodes[0x12] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.DE] = highByte(cpu.AF)
+		cpu.write(mem, cpu.DE, highByte(cpu.AF))
 	}
 
 	// LD (HL),A
 	opcodes[0x77] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.AF)
+		cpu.write(mem, cpu.HL, highByte(cpu.AF))
 	}
 
 	// LD (HL),B
 	opcodes[0x70] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.BC)
+		cpu.write(mem, cpu.HL, highByte(cpu.BC))
 	}
 
 	// LD (HL),C
 	opcodes[0x71] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = lowByte(cpu.BC)
+		cpu.write(mem, cpu.HL, lowByte(cpu.BC))
 	}
 
 	// LD (HL),D
 	opcodes[0x72] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.DE)
+		cpu.write(mem, cpu.HL, highByte(cpu.DE))
 	}
 
 	// LD (HL),E
 	opcodes[0x73] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = lowByte(cpu.DE)
+		cpu.write(mem, cpu.HL, lowByte(cpu.DE))
 	}
 
 	// LD (HL),H
 	opcodes[0x74] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.HL)
+		cpu.write(mem, cpu.HL, highByte(cpu.HL))
 	}
 
 	// LD (HL),L
 	opcodes[0x75] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = lowByte(cpu.HL)
+		cpu.write(mem, cpu.HL, lowByte(cpu.HL))
 	}
 
 	// LD (HL),n
 	opcodes[0x36] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = readN(cpu, mem)
+		cpu.write(mem, cpu.HL, readN(cpu, mem))
 	}
 
 	// LD (HLI),A
 	opcodes[0x22] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.AF)
+		cpu.write(mem, cpu.HL, highByte(cpu.AF))
 		cpu.HL++
 	}
 
 	// LD (HLD),A
 	opcodes[0x32] = func(cpu *Cpu, mem *Memory) {
-		mem.ram[cpu.HL] = highByte(cpu.AF)
+		cpu.write(mem, cpu.HL, highByte(cpu.AF))
 		cpu.HL--
 	}
 
@@ -598,55 +627,716 @@ func initOpCodes() {
 
 	// LDHL SP,e
 	opcodes[0xf8] = func(cpu *Cpu, mem *Memory) {
-		n := readN(cpu, mem)
-		add32 := int32(cpu.SP) + int32(n)
-		cpu.HL = uint16(int16(cpu.SP) + int16(n))
-		cFlag := uint8((add32 & 0x10000) >> 12) // mask 17th bit (overflow) and shift 16 to the right and 4 to the left
-		hFlag := uint8((add32 & 0x100) >> 3)    // mask 9th bit (half-carry overflow) and shift 8 to the right and 5 to the left
-		nFlag := uint8(0)                       // reset to 0
-		zFlag := uint8(0)                       // reset to 0
-		cpu.setF(cFlag | hFlag | nFlag | zFlag)
+		cpu.HL = cpu.addSP(readN(cpu, mem))
 	}
 
 	// LD (nn),A
 	opcodes[0xea] = func(cpu *Cpu, mem *Memory) {
-		addr := readNN(cpu, mem)
-		mem.ram[addr] = highByte(cpu.AF)
+		addr := readNNVal(cpu, mem)
+		cpu.write(mem, addr, highByte(cpu.AF))
 	}
 
 	// LD (nn),SP
 	opcodes[0x08] = func(cpu *Cpu, mem *Memory) {
 		nn := readNNVal(cpu, mem)
-		mem.ram[nn] = lowByte(cpu.SP)
-		mem.ram[nn+1] = highByte(cpu.SP)
+		cpu.write(mem, nn, lowByte(cpu.SP))
+		cpu.write(mem, nn+1, highByte(cpu.SP))
 	}
 
 	// LD (n),A
 	opcodes[0xe0] = func(cpu *Cpu, mem *Memory) {
-		addr := readN(cpu, mem)
-		mem.ram[addr] = highByte(cpu.AF)
+		addr := 0xff00 + uint16(readN(cpu, mem))
+		cpu.write(mem, addr, highByte(cpu.AF))
+	}
+
+	//
+	// Stack, jumps, calls and returns
+	//
+	// The conditions of the conditional jumps, calls and returns test a flag of the F-register:
+	//
+	//  ----------------------------
+	// | condition | taken if       |
+	// | NZ        | Z flag is 0    |
+	// | Z         | Z flag is 1    |
+	// | NC        | C flag is 0    |
+	// | C         | C flag is 1    |
+	//  ----------------------------
+	//
+	// The condition is encoded in bits 4 - 3 of the opcode in this order, e.g. JP C,nn = 0xda.
+	//
+	// Note: 16-bit values in the code and on the stack are stored low byte first.
+	//
+
+	// PUSH BC, PUSH DE, PUSH HL, PUSH AF
+	opcodes[0xc5] = func(cpu *Cpu, mem *Memory) { push(cpu, mem, cpu.BC) }
+	opcodes[0xd5] = func(cpu *Cpu, mem *Memory) { push(cpu, mem, cpu.DE) }
+	opcodes[0xe5] = func(cpu *Cpu, mem *Memory) { push(cpu, mem, cpu.HL) }
+	opcodes[0xf5] = func(cpu *Cpu, mem *Memory) { push(cpu, mem, cpu.AF) }
+
+	// POP BC, POP DE, POP HL, POP AF
+	// The lower 4 bits of the F-register always stay 0.
+	opcodes[0xc1] = func(cpu *Cpu, mem *Memory) { cpu.BC = pop(cpu, mem) }
+	opcodes[0xd1] = func(cpu *Cpu, mem *Memory) { cpu.DE = pop(cpu, mem) }
+	opcodes[0xe1] = func(cpu *Cpu, mem *Memory) { cpu.HL = pop(cpu, mem) }
+	opcodes[0xf1] = func(cpu *Cpu, mem *Memory) { cpu.AF = pop(cpu, mem) & 0xfff0 }
+
+	// JP nn
+	opcodes[0xc3] = func(cpu *Cpu, mem *Memory) {
+		jump(cpu, readNNVal(cpu, mem))
+	}
+
+	// JP (HL)
+	opcodes[0xe9] = func(cpu *Cpu, mem *Memory) {
+		jump(cpu, cpu.HL)
+	}
+
+	// JR e
+	// Jump relative to the address of the next instruction.
+	opcodes[0x18] = func(cpu *Cpu, mem *Memory) {
+		e := readE(cpu, mem)
+		jump(cpu, cpu.PC+1+uint16(e))
+	}
+
+	// CALL nn
+	opcodes[0xcd] = func(cpu *Cpu, mem *Memory) {
+		addr := readNNVal(cpu, mem)
+		push(cpu, mem, cpu.PC+1)
+		jump(cpu, addr)
+	}
+
+	// RET
+	opcodes[0xc9] = func(cpu *Cpu, mem *Memory) {
+		jump(cpu, pop(cpu, mem))
+	}
+
+	// RETI
+	// Unlike EI, enables the interrupts right away.
+	opcodes[0xd9] = func(cpu *Cpu, mem *Memory) {
+		jump(cpu, pop(cpu, mem))
+		cpu.ime = true
+	}
+
+	for cc := uint8(0); cc < 4; cc++ {
+		cc := cc
+
+		// JR cc,e
+		opcodes[0x20|cc<<3] = func(cpu *Cpu, mem *Memory) {
+			e := readE(cpu, mem)
+			if cpu.condition(cc) {
+				jump(cpu, cpu.PC+1+uint16(e))
+			}
+		}
+
+		// JP cc,nn
+		opcodes[0xc2|cc<<3] = func(cpu *Cpu, mem *Memory) {
+			addr := readNNVal(cpu, mem)
+			if cpu.condition(cc) {
+				jump(cpu, addr)
+			}
+		}
+
+		// CALL cc,nn
+		opcodes[0xc4|cc<<3] = func(cpu *Cpu, mem *Memory) {
+			addr := readNNVal(cpu, mem)
+			if cpu.condition(cc) {
+				push(cpu, mem, cpu.PC+1)
+				jump(cpu, addr)
+			}
+		}
+
+		// RET cc
+		opcodes[0xc0|cc<<3] = func(cpu *Cpu, mem *Memory) {
+			if cpu.condition(cc) {
+				jump(cpu, pop(cpu, mem))
+			}
+		}
+	}
+
+	// RST n
+	// Call one of the eight vectors 0x00, 0x08, ..., 0x38, encoded in bits 5 - 3 of the opcode. GBS files have
+	// no code at the vectors, there they are relative to the load address.
+	for n := uint16(0); n < 8; n++ {
+		vector := n << 3
+		opcodes[0xc7|uint8(vector)] = func(cpu *Cpu, mem *Memory) {
+			push(cpu, mem, cpu.PC+1)
+			if mem.gbs != nil {
+				jump(cpu, mem.gbs.load+vector)
+				return
+			}
+			jump(cpu, vector)
+		}
+	}
+
+	//
+	// 8-bit arithmetic and logic
+	//
+	// The operation is encoded in bits 5 - 3 and the register holding the operand in bits 2 - 0 of the opcode,
+	// using the register values of the loads with 110 for (HL), e.g. XOR A = 10<op><-r-> = 10101111 = 0xaf.
+	// The operations with an immediate operand are encoded as 11<op>110, e.g. CP # = 0xfe.
+	//
+	//  ----------------------------
+	// | operation | value (binary) |
+	// | ADD A,r   | 000            |
+	// | ADC A,r   | 001            |
+	// | SUB r     | 010            |
+	// | SBC A,r   | 011            |
+	// | AND r     | 100            |
+	// | XOR r     | 101            |
+	// | OR r      | 110            |
+	// | CP r      | 111            |
+	//  ----------------------------
+	//
+	// CP is a SUB which only sets the flags and keeps A.
+	//
+	for op := uint8(0); op < 8; op++ {
+		op := op
+		for r := uint8(0); r < 8; r++ {
+			r := r
+			opcodes[0x80|op<<3|r] = func(cpu *Cpu, mem *Memory) {
+				cpu.alu(op, cpu.reg(mem, r))
+			}
+		}
+
+		// ADD A,#, ADC A,#, SUB #, SBC A,#, AND #, XOR #, OR #, CP #
+		opcodes[0xc6|op<<3] = func(cpu *Cpu, mem *Memory) {
+			cpu.alu(op, readN(cpu, mem))
+		}
+	}
+
+	// INC r, DEC r
+	// The register is encoded in bits 5 - 3 like for the loads. The C flag is kept.
+	for r := uint8(0); r < 8; r++ {
+		r := r
+		opcodes[0x04|r<<3] = func(cpu *Cpu, mem *Memory) {
+			val := cpu.reg(mem, r) + 1
+			cpu.setReg(mem, r, val)
+			cpu.setF(zero(val) | boolFlag(val&0x0f == 0, flagH) | lowByte(cpu.AF)&flagC)
+		}
+		opcodes[0x05|r<<3] = func(cpu *Cpu, mem *Memory) {
+			val := cpu.reg(mem, r) - 1
+			cpu.setReg(mem, r, val)
+			cpu.setF(zero(val) | flagN | boolFlag(val&0x0f == 0x0f, flagH) | lowByte(cpu.AF)&flagC)
+		}
+	}
+
+	//
+	// 16-bit arithmetic
+	//
+	// The register pair is encoded in bits 5 - 4 of the opcode: BC, DE, HL, SP (00 - 11).
+	//
+	for rr := uint8(0); rr < 4; rr++ {
+		rr := rr
+
+		// INC rr, DEC rr
+		// The flags are not affected.
+		opcodes[0x03|rr<<4] = func(cpu *Cpu, mem *Memory) {
+			*cpu.pair(rr)++
+		}
+		opcodes[0x0b|rr<<4] = func(cpu *Cpu, mem *Memory) {
+			*cpu.pair(rr)--
+		}
+
+		// ADD HL,rr
+		// H is the carry out of bit 11, C out of bit 15. The Z flag is kept.
+		opcodes[0x09|rr<<4] = func(cpu *Cpu, mem *Memory) {
+			val := *cpu.pair(rr)
+			sum := uint32(cpu.HL) + uint32(val)
+			hFlag := boolFlag((cpu.HL&0x0fff)+(val&0x0fff) > 0x0fff, flagH)
+			cpu.setF(lowByte(cpu.AF)&flagZ | hFlag | boolFlag(sum > 0xffff, flagC))
+			cpu.HL = uint16(sum)
+		}
+	}
+
+	// ADD SP,e
+	opcodes[0xe8] = func(cpu *Cpu, mem *Memory) {
+		cpu.SP = cpu.addSP(readN(cpu, mem))
+	}
+
+	//
+	// Rotates and shifts
+	//
+	// RLCA, RRCA, RLA and RRA work like the 0xcb prefixed rotates on A below, but always reset the Z flag.
+	//
+	opcodes[0x07] = func(cpu *Cpu, mem *Memory) { cpu.rotateA(0) }
+	opcodes[0x0f] = func(cpu *Cpu, mem *Memory) { cpu.rotateA(1) }
+	opcodes[0x17] = func(cpu *Cpu, mem *Memory) { cpu.rotateA(2) }
+	opcodes[0x1f] = func(cpu *Cpu, mem *Memory) { cpu.rotateA(3) }
+
+	//
+	// Miscellaneous
+	//
+
+	// NOP
+	opcodes[0x00] = func(cpu *Cpu, mem *Memory) {}
+
+	// DI
+	opcodes[0xf3] = func(cpu *Cpu, mem *Memory) {
+		cpu.ime = false
+		cpu.eiDelay = false
+	}
+
+	// EI
+	// The interrupts are enabled after the next instruction, so EI followed by RET returns before one is
+	// serviced.
+	opcodes[0xfb] = func(cpu *Cpu, mem *Memory) {
+		cpu.eiDelay = true
+	}
+
+	// HALT
+	// The CPU sleeps until an interrupt is both requested and enabled, even with the interrupts disabled. If
+	// one already is while they are disabled, the CPU does not halt but reads the next byte twice (HALT bug).
+	opcodes[0x76] = func(cpu *Cpu, mem *Memory) {
+		switch {
+		case mem.pendingInterrupts() == 0:
+			cpu.halted = true
+		case !cpu.ime:
+			cpu.haltBug = true
+		}
+	}
+
+	// DAA
+	// Adjust A to a binary coded decimal after an addition or subtraction of two BCD values.
+	opcodes[0x27] = func(cpu *Cpu, mem *Memory) {
+		a, f := highByte(cpu.AF), lowByte(cpu.AF)
+		if f&flagN == 0 {
+			if f&flagC != 0 || a > 0x99 {
+				a += 0x60
+				f |= flagC
+			}
+			if f&flagH != 0 || a&0x0f > 0x09 {
+				a += 0x06
+			}
+		} else {
+			if f&flagC != 0 {
+				a -= 0x60
+			}
+			if f&flagH != 0 {
+				a -= 0x06
+			}
+		}
+		cpu.setA(a)
+		cpu.setF(zero(a) | f&(flagN|flagC))
+	}
+
+	// CPL
+	opcodes[0x2f] = func(cpu *Cpu, mem *Memory) {
+		cpu.setA(^highByte(cpu.AF))
+		cpu.setF(lowByte(cpu.AF) | flagN | flagH)
+	}
+
+	// SCF
+	opcodes[0x37] = func(cpu *Cpu, mem *Memory) {
+		cpu.setF(lowByte(cpu.AF)&flagZ | flagC)
+	}
+
+	// CCF
+	opcodes[0x3f] = func(cpu *Cpu, mem *Memory) {
+		cpu.setF((lowByte(cpu.AF) & flagZ) | (lowByte(cpu.AF)&flagC ^ flagC))
+	}
+
+	// STOP
+	// Takes two bytes, the second one is ignored. In CGB mode a speed switch prepared through KEY1 (0xff4d)
+	// happens here. Otherwise the CPU would stop until a button is pressed, which is not emulated.
+	opcodes[0x10] = func(cpu *Cpu, mem *Memory) {
+		cpu.PC++
+		if mem.cgb && mem.speed != nil {
+			mem.speed.stop()
+		}
+	}
+
+	//
+	// 0xcb prefixed opcodes
+	//
+	// The second byte encodes the operation in bits 7 - 3 and the register in bits 2 - 0 like the ALU
+	// operations. The first quarter holds the rotates and shifts:
+	//
+	//  --------------------------------------------------------------------------
+	// | operation | value (binary) | result                                      |
+	// | RLC r     | 00000          | rotate left, bit 7 to C and bit 0           |
+	// | RRC r     | 00001          | rotate right, bit 0 to C and bit 7          |
+	// | RL r      | 00010          | rotate left through C                       |
+	// | RR r      | 00011          | rotate right through C                      |
+	// | SLA r     | 00100          | shift left, bit 7 to C                      |
+	// | SRA r     | 00101          | shift right keeping bit 7, bit 0 to C       |
+	// | SWAP r    | 00110          | swap the upper and lower 4 bits, resets C   |
+	// | SRL r     | 00111          | shift right, bit 0 to C                     |
+	//  --------------------------------------------------------------------------
+	//
+	// The rest are BIT b,r (01<b>), RES b,r (10<b>) and SET b,r (11<b>) with the bit number b in bits 5 - 3.
+	// BIT sets the Z flag if the bit is 0, e.g. BIT 7,H = 01111100 = 0x7c.
+	//
+	cbopcodes = make(map[uint8]func(*Cpu, *Memory))
+	for r := uint8(0); r < 8; r++ {
+		r := r
+		for op := uint8(0); op < 8; op++ {
+			op := op
+
+			// RLC r, RRC r, RL r, RR r, SLA r, SRA r, SWAP r, SRL r
+			cbopcodes[op<<3|r] = func(cpu *Cpu, mem *Memory) {
+				cpu.setReg(mem, r, cpu.shift(op, cpu.reg(mem, r)))
+			}
+
+			bit := uint8(1) << op
+
+			// BIT b,r
+			cbopcodes[0x40|op<<3|r] = func(cpu *Cpu, mem *Memory) {
+				zFlag := boolFlag(cpu.reg(mem, r)&bit == 0, flagZ)
+				cpu.setF(zFlag | flagH | lowByte(cpu.AF)&flagC)
+			}
+
+			// RES b,r
+			cbopcodes[0x80|op<<3|r] = func(cpu *Cpu, mem *Memory) {
+				cpu.setReg(mem, r, cpu.reg(mem, r)&^bit)
+			}
+
+			// SET b,r
+			cbopcodes[0xc0|op<<3|r] = func(cpu *Cpu, mem *Memory) {
+				cpu.setReg(mem, r, cpu.reg(mem, r)|bit)
+			}
+		}
+	}
+}
+
+// Flags of the F-register
+const (
+	flagZ uint8 = 0x80
+	flagN uint8 = 0x40
+	flagH uint8 = 0x20
+	flagC uint8 = 0x10
+)
+
+// Return the flag if the condition holds, otherwise 0.
+func boolFlag(cond bool, flag uint8) uint8 {
+	if cond {
+		return flag
+	}
+	return 0
+}
+
+// Return the Z flag if the result is 0.
+func zero(val uint8) uint8 {
+	return boolFlag(val == 0, flagZ)
+}
+
+// Return the register encoded as r in an opcode: B, C, D, E, H, L, (HL), A (0 - 7).
+func (cpu *Cpu) reg(mem *Memory, r uint8) uint8 {
+	switch r {
+	case 0:
+		return highByte(cpu.BC)
+	case 1:
+		return lowByte(cpu.BC)
+	case 2:
+		return highByte(cpu.DE)
+	case 3:
+		return lowByte(cpu.DE)
+	case 4:
+		return highByte(cpu.HL)
+	case 5:
+		return lowByte(cpu.HL)
+	case 6:
+		return cpu.read(mem, cpu.HL)
+	}
+	return highByte(cpu.AF)
+}
+
+// Set the register encoded as r in an opcode to the given value.
+func (cpu *Cpu) setReg(mem *Memory, r uint8, val uint8) {
+	switch r {
+	case 0:
+		cpu.setB(val)
+	case 1:
+		cpu.setC(val)
+	case 2:
+		cpu.setD(val)
+	case 3:
+		cpu.setE(val)
+	case 4:
+		cpu.setH(val)
+	case 5:
+		cpu.setL(val)
+	case 6:
+		cpu.write(mem, cpu.HL, val)
+	default:
+		cpu.setA(val)
 	}
+}
 
+// Return the register pair encoded as rr in an opcode: BC, DE, HL, SP (0 - 3).
+func (cpu *Cpu) pair(rr uint8) *uint16 {
+	switch rr {
+	case 0:
+		return &cpu.BC
+	case 1:
+		return &cpu.DE
+	case 2:
+		return &cpu.HL
+	}
+	return &cpu.SP
+}
+
+// Apply the ALU operation encoded as op in an opcode to A and the given value.
+func (cpu *Cpu) alu(op uint8, val uint8) {
+	a := highByte(cpu.AF)
+	carry := uint8(0)
+	if op == 1 || op == 3 { // ADC, SBC
+		carry = (lowByte(cpu.AF) & flagC) >> 4
+	}
+
+	switch op {
+	case 0, 1: // ADD, ADC
+		sum := uint16(a) + uint16(val) + uint16(carry)
+		hFlag := boolFlag((a&0x0f)+(val&0x0f)+carry > 0x0f, flagH)
+		cpu.setA(uint8(sum))
+		cpu.setF(zero(uint8(sum)) | hFlag | boolFlag(sum > 0xff, flagC))
+	case 2, 3, 7: // SUB, SBC, CP
+		diff := uint8(int(a) - int(val) - int(carry))
+		hFlag := boolFlag(int(a&0x0f)-int(val&0x0f)-int(carry) < 0, flagH)
+		cFlag := boolFlag(int(a)-int(val)-int(carry) < 0, flagC)
+		if op != 7 {
+			cpu.setA(diff)
+		}
+		cpu.setF(zero(diff) | flagN | hFlag | cFlag)
+	case 4: // AND
+		cpu.setA(a & val)
+		cpu.setF(zero(a&val) | flagH)
+	case 5: // XOR
+		cpu.setA(a ^ val)
+		cpu.setF(zero(a ^ val))
+	case 6: // OR
+		cpu.setA(a | val)
+		cpu.setF(zero(a | val))
+	}
+}
+
+// Apply the rotate or shift encoded as op in a 0xcb prefixed opcode to the value and set the flags.
+func (cpu *Cpu) shift(op uint8, val uint8) uint8 {
+	carry := (lowByte(cpu.AF) & flagC) >> 4
+	var result, out uint8
+	switch op {
+	case 0: // RLC
+		result, out = val<<1|val>>7, val>>7
+	case 1: // RRC
+		result, out = val>>1|val<<7, val&1
+	case 2: // RL
+		result, out = val<<1|carry, val>>7
+	case 3: // RR
+		result, out = val>>1|carry<<7, val&1
+	case 4: // SLA
+		result, out = val<<1, val>>7
+	case 5: // SRA
+		result, out = val>>1|val&0x80, val&1
+	case 6: // SWAP
+		result, out = val<<4|val>>4, 0
+	default: // SRL
+		result, out = val>>1, val&1
+	}
+	cpu.setF(zero(result) | out<<4)
+	return result
+}
+
+// Rotate A for RLCA, RRCA, RLA and RRA, which always reset the Z flag.
+func (cpu *Cpu) rotateA(op uint8) {
+	cpu.setA(cpu.shift(op, highByte(cpu.AF)))
+	cpu.setF(lowByte(cpu.AF) &^ flagZ)
+}
+
+// Add the signed immediate to SP for ADD SP,e and LDHL SP,e. The H and C flags are set by the carry out of
+// bit 3 and bit 7 of the lower byte, Z and N are reset.
+func (cpu *Cpu) addSP(n uint8) uint16 {
+	cFlag := boolFlag((cpu.SP&0xff)+uint16(n) > 0xff, flagC)
+	hFlag := boolFlag((cpu.SP&0x0f)+uint16(n&0x0f) > 0x0f, flagH)
+	cpu.setF(cFlag | hFlag)
+	return cpu.SP + uint16(int8(n))
 }
 
 // Read unsigned integer
 func readN(cpu *Cpu, mem *Memory) uint8 {
 	cpu.PC++
-	return mem.Read(cpu.PC)
+	return cpu.read(mem, cpu.PC)
 }
 
 func readNN(cpu *Cpu, mem *Memory) uint8 {
-	return mem.Read(readNNVal(cpu, mem))
+	return cpu.read(mem, readNNVal(cpu, mem))
 }
 
 func readNNVal(cpu *Cpu, mem *Memory) uint16 {
-	highByte := readN(cpu, mem)
 	lowByte := readN(cpu, mem)
+	highByte := readN(cpu, mem)
 	return (uint16(highByte) << 8) + uint16(lowByte)
 }
 
 // Read signed integer
 func readE(cpu *Cpu, mem *Memory) int8 {
 	cpu.PC++
-	return int8(mem.Read(cpu.PC))
+	return int8(cpu.read(mem, cpu.PC))
+}
+
+// Push the 16-bit value onto the stack, which grows downwards. Takes an M-cycle to decrease SP before the high
+// byte and then the low byte are written.
+func push(cpu *Cpu, mem *Memory, val uint16) {
+	cpu.cycle()
+	cpu.SP -= 2
+	cpu.write(mem, cpu.SP+1, highByte(val))
+	cpu.write(mem, cpu.SP, lowByte(val))
+}
+
+// Pop a 16-bit value off the stack.
+func pop(cpu *Cpu, mem *Memory) uint16 {
+	val := uint16(cpu.read(mem, cpu.SP)) | uint16(cpu.read(mem, cpu.SP+1))<<8
+	cpu.SP += 2
+	return val
+}
+
+// Let an M-cycle pass for the current instruction.
+func (cpu *Cpu) cycle() {
+	cpu.cycles++
+	if cpu.bus != nil {
+		cpu.bus.tick()
+	}
+}
+
+// Read from the bus in the next M-cycle of the current instruction.
+func (cpu *Cpu) read(mem *Memory, addr uint16) uint8 {
+	cpu.cycle()
+	return mem.Read(addr)
+}
+
+// Write to the bus in the next M-cycle of the current instruction.
+func (cpu *Cpu) write(mem *Memory, addr uint16, val uint8) {
+	cpu.cycle()
+	mem.Write(addr, val)
+}
+
+// Continue at the given address. step advances PC past the instruction after executing it, so PC is set to
+// the address before.
+func jump(cpu *Cpu, addr uint16) {
+	cpu.PC = addr - 1
+	cpu.branched = true
+}
+
+// Check the condition NZ, Z, NC or C (0 - 3) against the flags.
+func (cpu *Cpu) condition(cc uint8) bool {
+	flag := lowByte(cpu.AF) & flagZ
+	if cc >= 2 {
+		flag = lowByte(cpu.AF) & flagC
+	}
+	return (flag != 0) == (cc&1 != 0)
+}
+
+// Number of machine cycles (M-cycles) each opcode takes. One M-cycle equals four clock cycles (T-cycles)
+// of the 4.194304 MHz system clock. Conditional jumps, calls and returns list the cost of the branch
+// not being taken. 0xcb prefixed opcodes (see cbopcycles) and the unused opcodes are listed with 0.
+var opcycles = [256]uint8{
+	1, 3, 2, 2, 1, 1, 2, 1, 5, 2, 2, 2, 1, 1, 2, 1, // 0x00
+	1, 3, 2, 2, 1, 1, 2, 1, 3, 2, 2, 2, 1, 1, 2, 1, // 0x10
+	2, 3, 2, 2, 1, 1, 2, 1, 2, 2, 2, 2, 1, 1, 2, 1, // 0x20
+	2, 3, 2, 2, 3, 3, 3, 1, 2, 2, 2, 2, 1, 1, 2, 1, // 0x30
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0x40
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0x50
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0x60
+	2, 2, 2, 2, 2, 2, 1, 2, 1, 1, 1, 1, 1, 1, 2, 1, // 0x70
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0x80
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0x90
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0xa0
+	1, 1, 1, 1, 1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 2, 1, // 0xb0
+	2, 3, 3, 4, 3, 4, 2, 4, 2, 4, 3, 0, 3, 6, 2, 4, // 0xc0
+	2, 3, 3, 0, 3, 4, 2, 4, 2, 4, 3, 0, 3, 0, 2, 4, // 0xd0
+	3, 3, 2, 0, 0, 4, 2, 4, 4, 1, 4, 0, 0, 0, 2, 4, // 0xe0
+	3, 3, 2, 1, 0, 4, 2, 4, 3, 2, 4, 1, 0, 0, 2, 4, // 0xf0
+}
+
+// Number of M-cycles of the conditional jumps, calls and returns when the branch is taken.
+var opcyclesTaken = map[uint8]uint8{
+	0x20: 3, 0x28: 3, 0x30: 3, 0x38: 3, // JR cc,e
+	0xc2: 4, 0xca: 4, 0xd2: 4, 0xda: 4, // JP cc,nn
+	0xc4: 6, 0xcc: 6, 0xd4: 6, 0xdc: 6, // CALL cc,nn
+	0xc0: 5, 0xc8: 5, 0xd0: 5, 0xd8: 5, // RET cc
+}
+
+// Service the requested and enabled interrupt with the highest priority, which is the lowest bit: disable the
+// interrupts, clear its flag in IF and call its handler at 0x40 (VBlank), 0x48 (STAT), 0x50 (timer), 0x58
+// (serial) or 0x60 (joypad), which takes 5 M-cycles.
+func (cpu *Cpu) interrupt(mem *Memory, pending uint8) {
+	bit := uint16(0)
+	for pending&(1<<bit) == 0 {
+		bit++
+	}
+	cpu.ime = false
+	mem.ram[0xff0f] &^= 1 << bit
+	cpu.cycle()
+	push(cpu, mem, cpu.PC)
+	cpu.PC = 0x40 + bit*8
+	cpu.cycle()
+}
+
+// Number of M-cycles of the 0xcb prefixed opcodes including the prefix. The ones on (HL) read it and write it
+// back, except for BIT which only reads it.
+func cbopcycles(op uint8) int {
+	switch {
+	case op&0x07 != 6:
+		return 2
+	case op&0xc0 == 0x40:
+		return 3
+	}
+	return 4
+}
+
+// Execute the instruction at PC and advance PC to the next instruction, or service a pending interrupt
+// instead. Returns the number of M-cycles it took. While halted or after running into an opcode which is not
+// implemented, which stops the CPU with an error in err, every step only lets a single M-cycle pass.
+//
+// Every memory access takes an M-cycle of its own, the M-cycles without one follow at the end of the
+// instruction. That is exact for most instructions, only the conditional returns read the stack an M-cycle
+// early.
+func (cpu *Cpu) step(mem *Memory) int {
+	cpu.cycles = 0
+	if cpu.err != nil {
+		cpu.cycle()
+		return cpu.cycles
+	}
+	if cpu.halted {
+		if mem.pendingInterrupts() == 0 {
+			cpu.cycle()
+			return cpu.cycles
+		}
+		cpu.halted = false
+	}
+	if pending := mem.pendingInterrupts(); cpu.ime && pending != 0 {
+		cpu.interrupt(mem, pending)
+		return cpu.cycles
+	}
+	if cpu.eiDelay {
+		cpu.eiDelay = false
+		cpu.ime = true
+	}
+
+	opcode := cpu.read(mem, cpu.PC)
+	if cpu.haltBug {
+		// PC is not advanced past the opcode, so it is read again as the next byte
+		cpu.haltBug = false
+		cpu.PC--
+	}
+	cycles := int(opcycles[opcode])
+	if opcode == 0xcb {
+		op := readN(cpu, mem)
+		cbopcodes[op](cpu, mem)
+		cycles = cbopcycles(op)
+	} else {
+		exec, ok := opcodes[opcode]
+		if !ok {
+			cpu.err = fmt.Errorf("unimplemented opcode 0x%02x at PC 0x%04x", opcode, cpu.PC)
+			return cpu.cycles
+		}
+		cpu.branched = false
+		exec(cpu, mem)
+		if taken, ok := opcyclesTaken[opcode]; ok && cpu.branched {
+			cycles = int(taken)
+		}
+	}
+	cpu.PC++
+
+	for cpu.cycles < cycles {
+		cpu.cycle()
+	}
+	return cpu.cycles
 }
@@ -164,7 +164,7 @@ func TestLoadBCToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{AF: 0xffcc, BC: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x0a](&cpu, &mem)
 
@@ -178,7 +178,7 @@ func TestLoadDEToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{AF: 0xffcc, DE: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x1a](&cpu, &mem)
 
@@ -192,7 +192,7 @@ func TestLoadHLToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{AF: 0xffcc, HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x7e](&cpu, &mem)
 
@@ -278,7 +278,7 @@ func TestLoadHLToB(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{BC: 0xffcc, HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x46](&cpu, &mem)
 
@@ -364,7 +364,7 @@ func TestLoadHLToC(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{BC: 0xffcc, HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x4e](&cpu, &mem)
 
@@ -450,7 +450,7 @@ func TestLoadHLToD(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{DE: 0xffcc, HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x56](&cpu, &mem)
 
@@ -536,7 +536,7 @@ func TestLoadHLtoE(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{DE: 0xffcc, HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x5e](&cpu, &mem)
 
@@ -622,7 +622,7 @@ func TestLoadHLtoH(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x66](&cpu, &mem)
 
@@ -708,7 +708,7 @@ func TestLoadHLtoL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x6e](&cpu, &mem)
 
@@ -722,7 +722,7 @@ func TestLoadBToHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012, BC: 0xaabb}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x70](&cpu, &mem)
 
@@ -736,7 +736,7 @@ func TestLoadCtoHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012, BC: 0xaabb}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x71](&cpu, &mem)
 
@@ -750,7 +750,7 @@ func TestLoadDtoHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012, DE: 0xaabb}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x72](&cpu, &mem)
 
@@ -764,7 +764,7 @@ func TestLoadEtoHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012, DE: 0xaabb}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x73](&cpu, &mem)
 
@@ -778,7 +778,7 @@ func TestLoadHtoHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x74](&cpu, &mem)
 
@@ -792,7 +792,7 @@ func TestLoadLtoHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012}
 	ram := [20]uint8{0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x75](&cpu, &mem)
 
@@ -806,7 +806,7 @@ func TestLoadValtoHL(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{HL: 0x0012}
 	ram := [20]uint8{0x0: 0x36, 0x0001: 0xee, 0x0012: 0xab}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0x36](&cpu, &mem)
 
@@ -890,8 +890,8 @@ func TestLoadValToL(t *testing.T) {
 func TestLoadValAt16bitAddressToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{BC: 0xffcc, HL: 0x0012, PC: 0x0009}
-	ram := [20]uint8{0x0009: 0xab, 0x000a: 0x00, 0x000b: 0x10, 0x0010: 0xe3}
-	mem := Memory{ram[:]}
+	ram := [20]uint8{0x0009: 0xab, 0x000a: 0x10, 0x000b: 0x00, 0x0010: 0xe3}
+	mem := Memory{ram: ram[:]}
 	opcodes[0xfa](&cpu, &mem)
 
 	if highByte(cpu.AF) != 0xe3 {
@@ -903,12 +903,12 @@ func TestLoadValAt16bitAddressToA(t *testing.T) {
 func TestLoadValAt8bitAddressToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{BC: 0xffcc, HL: 0x0012, PC: 0x0009}
-	ram := [20]uint8{0x0009: 0xab, 0x000a: 0xe3, 0x000b: 0x10, 0x0010: 0xe3}
-	mem := Memory{ram[:]}
+	ram := [0x10000]uint8{0x0009: 0xab, 0x000a: 0xe3, 0x000b: 0x10, 0x0010: 0xe3, 0xffe3: 0x42}
+	mem := Memory{ram: ram[:]}
 	opcodes[0xf0](&cpu, &mem)
 
-	if highByte(cpu.AF) != 0xe3 {
-		t.Errorf("Load L,(n) did not work correctly. Expected 0xe3 but got 0x%X", highByte(cpu.AF))
+	if highByte(cpu.AF) != 0x42 {
+		t.Errorf("Load A,(n) did not work correctly. Expected 0x42 but got 0x%X", highByte(cpu.AF))
 	}
 }
 
@@ -917,7 +917,7 @@ func TestLoadImmedateToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{BC: 0xffcc, HL: 0x0012, PC: 0x0009}
 	ram := [20]uint8{0x0009: 0xab, 0x000a: 0xfe}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 	opcodes[0x3e](&cpu, &mem)
 
 	if highByte(cpu.AF) != 0xfe {
@@ -930,7 +930,7 @@ func TestLoadValAtCToA(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{AF: 0xffcc, BC: 0x0004}
 	ram := [65285]uint8{0xff04: 0xfa}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0xf2](&cpu, &mem)
 
@@ -944,7 +944,7 @@ func TestLhdl(t *testing.T) {
 	initOpCodes()
 	cpu := Cpu{AF: 0xffcc, BC: 0x0004, SP: 0x0102, PC: 0x0000}
 	ram := [65285]uint8{0x0000: 0xf8, 0x0001: 0x03, 0x0002: 0x05}
-	mem := Memory{ram[:]}
+	mem := Memory{ram: ram[:]}
 
 	opcodes[0xf8](&cpu, &mem)
 
@@ -957,3 +957,309 @@ func TestLhdl(t *testing.T) {
 	}
 
 }
+
+// LDHL SP,e with a negative offset and carries out of bit 3 and bit 7
+func TestLhdlFlags(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{SP: 0x10ff, PC: 0x0000}
+	ram := [20]uint8{0x0000: 0xf8, 0x0001: 0xff}
+	mem := Memory{ram: ram[:]}
+
+	opcodes[0xf8](&cpu, &mem)
+
+	if cpu.HL != 0x10fe {
+		t.Errorf("LDHL SP,e did not work correctly. Expected 0x10FE but got 0x%X", cpu.HL)
+	}
+
+	if lowByte(cpu.AF) != 0x30 {
+		t.Errorf("LDHL SP,e did not work correctly. Expected F-register to be 0x30 but got 0x%X", lowByte(cpu.AF))
+	}
+}
+
+// Test LD (BC),A (opcode 0x02)
+func TestLoadAToBC(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{AF: 0xaacc, BC: 0x0012, HL: 0x0005}
+	ram := [20]uint8{}
+	mem := Memory{ram: ram[:]}
+
+	opcodes[0x02](&cpu, &mem)
+
+	if mem.ram[0x0012] != 0xaa {
+		t.Errorf("Load (BC),A did not work correctly. Expected 0xAA but got 0x%X", mem.ram[0x0012])
+	}
+	if mem.ram[0x0005] != 0x00 {
+		t.Errorf("Load (BC),A should not write to (HL). Expected 0x00 but got 0x%X", mem.ram[0x0005])
+	}
+}
+
+// Test LD (nn),A
+func TestLoadAToValAt16bitAddress(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{AF: 0xe3cc, PC: 0x0009}
+	ram := [20]uint8{0x0009: 0xea, 0x000a: 0x10, 0x000b: 0x00, 0x0010: 0x05}
+	mem := Memory{ram: ram[:]}
+
+	opcodes[0xea](&cpu, &mem)
+
+	if mem.ram[0x0010] != 0xe3 {
+		t.Errorf("Load (nn),A did not work correctly. Expected 0xE3 but got 0x%X", mem.ram[0x0010])
+	}
+	if mem.ram[0x0005] != 0x00 {
+		t.Errorf("Load (nn),A should not write to the address stored at nn. Expected 0x00 but got 0x%X", mem.ram[0x0005])
+	}
+}
+
+// Test LD (n),A
+func TestLoadAToValAt8bitAddress(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{AF: 0xe3cc, PC: 0x0009}
+	ram := [0x10000]uint8{0x0009: 0xe0, 0x000a: 0x85}
+	mem := Memory{ram: ram[:]}
+
+	opcodes[0xe0](&cpu, &mem)
+
+	if mem.ram[0xff85] != 0xe3 {
+		t.Errorf("Load (n),A did not work correctly. Expected 0xE3 at 0xFF85 but got 0x%X", mem.ram[0xff85])
+	}
+	if mem.ram[0x0085] != 0x00 {
+		t.Errorf("Load (n),A should write to 0xFF00 + n. Expected 0x00 at 0x0085 but got 0x%X", mem.ram[0x0085])
+	}
+}
+
+// Test JR e backwards and JP cc,nn with the cycles of the branch taken and not taken
+func TestJumps(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100}
+	ram := [0x10000]uint8{0x0100: 0x18, 0x0101: 0xfe, 0x0200: 0xca, 0x0201: 0x34, 0x0202: 0x12}
+	mem := Memory{ram: ram[:]}
+
+	cpu.step(&mem)
+	if cpu.PC != 0x0100 {
+		t.Errorf("JR e did not work correctly. Expected PC 0x0100 but got 0x%X", cpu.PC)
+	}
+
+	cpu.PC = 0x0200
+	if cycles := cpu.step(&mem); cpu.PC != 0x0203 || cycles != 3 {
+		t.Errorf("JP Z,nn should not jump without the Z flag. Expected PC 0x0203 after 3 cycles but got 0x%X after %d", cpu.PC, cycles)
+	}
+
+	cpu.PC = 0x0200
+	cpu.setF(0x80)
+	if cycles := cpu.step(&mem); cpu.PC != 0x1234 || cycles != 4 {
+		t.Errorf("JP Z,nn should jump with the Z flag. Expected PC 0x1234 after 4 cycles but got 0x%X after %d", cpu.PC, cycles)
+	}
+}
+
+// Test CALL nn and RET through the stack
+func TestCallRet(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100, SP: 0xfffe}
+	ram := [0x10000]uint8{0x0100: 0xcd, 0x0101: 0x00, 0x0102: 0x02, 0x0200: 0xc9}
+	mem := Memory{ram: ram[:]}
+
+	cpu.step(&mem)
+	if cpu.PC != 0x0200 || cpu.SP != 0xfffc {
+		t.Errorf("CALL nn did not work correctly. Expected PC 0x0200, SP 0xFFFC but got 0x%X, 0x%X", cpu.PC, cpu.SP)
+	}
+	if mem.ram[0xfffc] != 0x03 || mem.ram[0xfffd] != 0x01 {
+		t.Errorf("CALL nn should push 0x0103. Got 0x%02X%02X", mem.ram[0xfffd], mem.ram[0xfffc])
+	}
+
+	cpu.step(&mem)
+	if cpu.PC != 0x0103 || cpu.SP != 0xfffe {
+		t.Errorf("RET did not work correctly. Expected PC 0x0103, SP 0xFFFE but got 0x%X, 0x%X", cpu.PC, cpu.SP)
+	}
+}
+
+// Test that POP AF keeps the lower 4 bits of F at 0
+func TestPushPopAF(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{SP: 0xfffe, BC: 0x12ff}
+	ram := [0x10000]uint8{}
+	mem := Memory{ram: ram[:]}
+
+	opcodes[0xc5](&cpu, &mem)
+	opcodes[0xf1](&cpu, &mem)
+	if cpu.AF != 0x12f0 || cpu.SP != 0xfffe {
+		t.Errorf("PUSH BC, POP AF did not work correctly. Expected AF 0x12F0 but got 0x%X", cpu.AF)
+	}
+}
+
+// Test that RST calls the vector, relative to the load address in GBS files
+func TestRst(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100, SP: 0xfffe}
+	ram := [0x10000]uint8{}
+	mem := Memory{ram: ram[:]}
+
+	opcodes[0xef](&cpu, &mem)
+	if cpu.PC+1 != 0x0028 || mem.ram[0xfffc] != 0x01 {
+		t.Errorf("RST 0x28 did not work correctly. Expected to continue at 0x0028 but got 0x%X", cpu.PC+1)
+	}
+
+	cpu.PC = 0x0100
+	mem.gbs = &GbsRom{load: 0x0400}
+	opcodes[0xef](&cpu, &mem)
+	if cpu.PC+1 != 0x0428 {
+		t.Errorf("RST 0x28 in a GBS file did not work correctly. Expected to continue at 0x0428 but got 0x%X", cpu.PC+1)
+	}
+}
+
+// Test that an opcode which is not implemented stops the CPU with an error
+func TestUnimplementedOpcode(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100}
+	ram := [0x10000]uint8{0x0100: 0xd3}
+	mem := Memory{ram: ram[:]}
+
+	cpu.step(&mem)
+	if cpu.err == nil || cpu.err.Error() != "unimplemented opcode 0xd3 at PC 0x0100" {
+		t.Errorf("Opcode 0xD3 should stop the CPU with an error. Got %v", cpu.err)
+	}
+	if cycles := cpu.step(&mem); cpu.PC != 0x0100 || cycles != 1 {
+		t.Errorf("A stopped CPU should stay at PC 0x0100 for 1 cycle. Got PC 0x%X after %d cycles", cpu.PC, cycles)
+	}
+}
+
+// Test a routine using ALU and 0xcb prefixed opcodes: clear the VRAM like the boot ROM does and do some
+// BCD arithmetic
+func TestAluRoutine(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100}
+	ram := [0x10000]uint8{}
+	copy(ram[0x0100:], []uint8{
+		0x31, 0xfe, 0xff, // LD SP,0xfffe
+		0xaf,             // XOR A
+		0x21, 0xff, 0x9f, // LD HL,0x9fff
+		0x32,       // LD (HLD),A
+		0xcb, 0x7c, // BIT 7,H
+		0x20, 0xfb, // JR NZ,-5
+		0x3e, 0x45, // LD A,0x45
+		0xc6, 0x38, // ADD A,0x38
+		0x27,       // DAA
+		0x06, 0x0f, // LD B,0x0f
+		0x04,       // INC B
+		0x90,       // SUB B
+		0xcb, 0x37, // SWAP A
+		0xfe, 0x37, // CP 0x37
+	})
+	for i := 0x8000; i < 0xa000; i++ {
+		ram[i] = 0xff
+	}
+	mem := Memory{ram: ram[:]}
+
+	for i := 0; i < 0x10000 && cpu.PC != 0x0119; i++ {
+		cpu.step(&mem)
+	}
+	if cpu.err != nil || cpu.PC != 0x0119 {
+		t.Fatalf("The routine did not finish. Stopped at 0x%X with %v", cpu.PC, cpu.err)
+	}
+	for i := 0x8000; i < 0xa000; i++ {
+		if mem.ram[i] != 0 {
+			t.Fatalf("The VRAM should be cleared. Got 0x%X at 0x%X", mem.ram[i], i)
+		}
+	}
+	if cpu.HL != 0x7fff || cpu.BC != 0x1000 {
+		t.Errorf("Expected HL 0x7FFF, BC 0x1000 but got 0x%X, 0x%X", cpu.HL, cpu.BC)
+	}
+	if cpu.AF != 0x37c0 {
+		t.Errorf("Expected A 0x37 with the Z and N flags but got AF 0x%X", cpu.AF)
+	}
+}
+
+// Test the flags of ADD, ADC, SUB and SBC
+func TestAluFlags(t *testing.T) {
+	initOpCodes()
+	cases := []struct {
+		opcode uint8
+		af     uint16
+		b      uint8
+		want   uint16
+	}{
+		{0x80, 0x3a00, 0xc6, 0x00b0}, // ADD A,B: carry and half carry to 0
+		{0x88, 0x0f10, 0x00, 0x1020}, // ADC A,B: half carry from the carry
+		{0x90, 0x3e00, 0x0f, 0x2f60}, // SUB B: half borrow
+		{0x98, 0x0010, 0x00, 0xff70}, // SBC A,B: borrow from the carry
+		{0xb8, 0x4200, 0x42, 0x42c0}, // CP B: equal, A is kept
+	}
+	for _, c := range cases {
+		cpu := Cpu{AF: c.af, BC: uint16(c.b) << 8}
+		mem := Memory{}
+		opcodes[c.opcode](&cpu, &mem)
+		if cpu.AF != c.want {
+			t.Errorf("Opcode 0x%02X with AF 0x%04X, B 0x%02X: expected AF 0x%04X but got 0x%04X", c.opcode, c.af, c.b, c.want, cpu.AF)
+		}
+	}
+}
+
+// Test the 0xcb prefixed opcodes on (HL) and their cycles
+func TestCbOnHL(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100, HL: 0xc000, AF: 0x0010}
+	ram := [0x10000]uint8{0x0100: 0xcb, 0x0101: 0x1e, 0x0102: 0xcb, 0x0103: 0x46, 0xc000: 0x81}
+	mem := Memory{ram: ram[:]}
+
+	if cycles := cpu.step(&mem); mem.ram[0xc000] != 0xc0 || lowByte(cpu.AF) != 0x10 || cycles != 4 {
+		t.Errorf("RR (HL) should rotate the carry in. Expected 0xC0 and F 0x10 after 4 cycles but got 0x%X and F 0x%X after %d", mem.ram[0xc000], lowByte(cpu.AF), cycles)
+	}
+	if cycles := cpu.step(&mem); lowByte(cpu.AF) != 0xb0 || cycles != 3 {
+		t.Errorf("BIT 0,(HL) should set Z and H. Expected F 0xB0 after 3 cycles but got 0x%X after %d", lowByte(cpu.AF), cycles)
+	}
+}
+
+// Test that EI enables the interrupts after the next instruction and the interrupt calls its handler
+func TestInterruptDispatch(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100, SP: 0xfffe}
+	ram := [0x10000]uint8{0x0100: 0xfb, 0x0101: 0x00, 0x0102: 0x00, 0x0050: 0xd9, 0xffff: intTimer | intSerial}
+	mem := Memory{ram: ram[:]}
+	mem.ram[0xff0f] = intTimer | intSerial
+
+	cpu.step(&mem)
+	cpu.step(&mem)
+	if cpu.PC != 0x0102 {
+		t.Errorf("The instruction after EI should run before the interrupt. Expected PC 0x0102 but got 0x%X", cpu.PC)
+	}
+	if cycles := cpu.step(&mem); cpu.PC != 0x0050 || cycles != 5 || cpu.ime {
+		t.Errorf("The timer interrupt should call 0x50 in 5 cycles. Got PC 0x%X after %d cycles", cpu.PC, cycles)
+	}
+	if mem.ram[0xff0f] != intSerial || mem.ram[0xfffc] != 0x02 || mem.ram[0xfffd] != 0x01 {
+		t.Errorf("Expected IF 0x%X and 0x0102 on the stack but got IF 0x%X", intSerial, mem.ram[0xff0f])
+	}
+
+	cpu.step(&mem)
+	if cpu.PC != 0x0102 || !cpu.ime {
+		t.Errorf("RETI should return to 0x0102 with the interrupts enabled. Got PC 0x%X", cpu.PC)
+	}
+	if cpu.step(&mem); cpu.PC != 0x0058 {
+		t.Errorf("The serial interrupt should call 0x58 right after RETI. Got PC 0x%X", cpu.PC)
+	}
+}
+
+// Test that HALT waits for an interrupt and continues without calling it while the interrupts are disabled
+func TestHalt(t *testing.T) {
+	initOpCodes()
+	cpu := Cpu{PC: 0x0100, SP: 0xfffe}
+	ram := [0x10000]uint8{0x0100: 0x76, 0x0101: 0x3c, 0xffff: intVBlank}
+	mem := Memory{ram: ram[:]}
+
+	cpu.step(&mem)
+	if cycles := cpu.step(&mem); cpu.PC != 0x0101 || cycles != 1 {
+		t.Errorf("HALT should wait without an interrupt. Expected PC 0x0101 after 1 cycle but got 0x%X after %d", cpu.PC, cycles)
+	}
+	mem.requestInterrupt(intVBlank)
+	cpu.step(&mem)
+	if cpu.PC != 0x0102 || highByte(cpu.AF) != 0x01 {
+		t.Errorf("The interrupt should wake up the CPU without calling the handler. Got PC 0x%X, A 0x%X", cpu.PC, highByte(cpu.AF))
+	}
+
+	// HALT bug: with an interrupt already pending, INC A runs twice
+	cpu = Cpu{PC: 0x0100, SP: 0xfffe}
+	cpu.step(&mem)
+	cpu.step(&mem)
+	cpu.step(&mem)
+	if cpu.PC != 0x0102 || highByte(cpu.AF) != 0x02 {
+		t.Errorf("The byte after HALT should be read twice. Expected PC 0x0102, A 0x02 but got 0x%X, 0x%X", cpu.PC, highByte(cpu.AF))
+	}
+}
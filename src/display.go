@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// How the emulated screen is fit into the window.
+type ScaleMode int
+
+const (
+	scaleInteger ScaleMode = iota // largest integer multiple that fits, centered
+	scaleAspect                   // as large as fits while keeping the aspect ratio, letterboxed
+	scaleStretch                  // fill the whole window
+)
+
+var scaleModeNames = map[string]ScaleMode{
+	"integer": scaleInteger,
+	"aspect":  scaleAspect,
+	"stretch": scaleStretch,
+}
+
+func parseScaleMode(name string) (ScaleMode, error) {
+	mode, ok := scaleModeNames[strings.ToLower(name)]
+	if !ok {
+		return scaleInteger, fmt.Errorf("unknown display mode %q", name)
+	}
+	return mode, nil
+}
+
+// Return the scale mode following the given one, to cycle through them with a hotkey.
+func (mode ScaleMode) next() ScaleMode {
+	return (mode + 1) % (scaleStretch + 1)
+}
+
+// Display draws the frames of the emulated screen into the Ebiten screen.
+type Display struct {
+	mode  ScaleMode
+	image *ebiten.Image
+}
+
+func newDisplay(mode ScaleMode, width, height int) *Display {
+	return &Display{mode: mode, image: ebiten.NewImage(width, height)}
+}
+
+// Draw the given RGBA pixels scaled into the screen.
+func (d *Display) draw(screen *ebiten.Image, pixels []uint8) {
+	d.image.WritePixels(pixels)
+
+	srcW, srcH := d.image.Size()
+	dstW, dstH := screen.Size()
+	scaleX := float64(dstW) / float64(srcW)
+	scaleY := float64(dstH) / float64(srcH)
+
+	switch d.mode {
+	case scaleInteger:
+		scaleX = math.Max(1, math.Floor(math.Min(scaleX, scaleY)))
+		scaleY = scaleX
+	case scaleAspect:
+		scaleX = math.Min(scaleX, scaleY)
+		scaleY = scaleX
+	}
+
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Scale(scaleX, scaleY)
+	op.GeoM.Translate(math.Floor((float64(dstW)-float64(srcW)*scaleX)/2), math.Floor((float64(dstH)-float64(srcH)*scaleY)/2))
+	op.Filter = ebiten.FilterNearest
+	screen.DrawImage(d.image, op)
+}
@@ -0,0 +1,62 @@
+package main
+
+// OAM DMA copies 160 bytes to the object attribute memory (OAM) at 0xfe00 - 0xfe9f. Writing 0xXX to 0xff46
+// starts a transfer from 0xXX00 - 0xXX9f. After a startup delay of one M-cycle, one byte is copied per
+// M-cycle, so the whole transfer takes 160 M-cycles.
+//
+// While the transfer is running the DMA unit owns the bus: the CPU can only access the I/O registers and
+// high RAM (which is why games run their DMA routine from HRAM). Reads from anywhere else return the byte
+// that is currently being transferred and writes are ignored.
+//
+// Writing 0xff46 while a transfer is running restarts it. The old transfer keeps going (and keeps blocking
+// the bus) during the startup delay of the new one.
+
+const oamSize = 0xa0
+
+type Dma struct {
+	active bool
+	source uint16
+	index  uint16
+
+	// last byte transferred
+	value uint8
+
+	// set for the startup M-cycle of a requested transfer
+	starting       bool
+	startingSource uint16
+}
+
+// Request a transfer from the given source page.
+func (dma *Dma) start(page uint8) {
+	dma.starting = true
+	dma.startingSource = uint16(page) << 8
+
+	// sources above the work RAM echo see the work RAM as well
+	if dma.startingSource >= 0xe000 {
+		dma.startingSource -= 0x2000
+	}
+}
+
+// Check whether a CPU access to the given address conflicts with a running transfer.
+func (dma *Dma) conflicts(addr uint16) bool {
+	return dma.active && addr < 0xff00
+}
+
+// Advance the DMA unit by one M-cycle.
+func (dma *Dma) tick(mem *Memory) {
+	if dma.active {
+		dma.value = mem.read(dma.source + dma.index)
+		mem.writeOAM(dma.index, dma.value)
+		dma.index++
+		if dma.index == oamSize {
+			dma.active = false
+		}
+	}
+
+	if dma.starting {
+		dma.starting = false
+		dma.active = true
+		dma.source = dma.startingSource
+		dma.index = 0
+	}
+}
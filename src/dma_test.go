@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func dmaTestMemory() *Memory {
+	mem := newMemory(nil)
+	for i := uint16(0); i < oamSize; i++ {
+		mem.ram[0xc000+i] = uint8(i)
+		mem.ram[0xd000+i] = uint8(i) + 0x80
+	}
+	return mem
+}
+
+// Test that a transfer copies 160 bytes to OAM in 160 M-cycles after a startup delay of one M-cycle
+func TestDmaTransfer(t *testing.T) {
+	mem := dmaTestMemory()
+	mem.Write(0xff46, 0xc0)
+
+	for i := 0; i < oamSize; i++ {
+		mem.dma.tick(mem)
+	}
+	if mem.ram[0xfe9f] != 0x00 || !mem.dma.active {
+		t.Errorf("Transfer finished too early")
+	}
+
+	mem.dma.tick(mem)
+	for i := uint16(0); i < oamSize; i++ {
+		if mem.ram[0xfe00+i] != uint8(i) {
+			t.Errorf("Byte %d was not transferred correctly. Expected 0x%X but got 0x%X", i, uint8(i), mem.ram[0xfe00+i])
+		}
+	}
+	if mem.dma.active {
+		t.Errorf("Transfer should have finished after 161 M-cycles")
+	}
+}
+
+// Test that the CPU only sees the transferred byte outside of HRAM and the I/O registers
+func TestDmaBusConflict(t *testing.T) {
+	mem := dmaTestMemory()
+	mem.ram[0xff80] = 0x12
+	mem.ram[0xc100] = 0x34
+	mem.Write(0xff46, 0xc0)
+
+	// the bus is not blocked during the startup delay
+	if val := mem.Read(0xc100); val != 0x34 {
+		t.Errorf("Read during startup delay should not conflict. Expected 0x34 but got 0x%X", val)
+	}
+
+	for i := 0; i < 11; i++ {
+		mem.dma.tick(mem)
+	}
+	if val := mem.Read(0xc100); val != 0x09 {
+		t.Errorf("Read during transfer should return the transferred byte. Expected 0x09 but got 0x%X", val)
+	}
+	if val := mem.Read(0x0000); val != 0x09 {
+		t.Errorf("Read during transfer should return the transferred byte. Expected 0x09 but got 0x%X", val)
+	}
+	if val := mem.Read(0xff80); val != 0x12 {
+		t.Errorf("HRAM should be accessible during transfer. Expected 0x12 but got 0x%X", val)
+	}
+
+	mem.Write(0xc100, 0xff)
+	if mem.ram[0xc100] != 0x34 {
+		t.Errorf("Write during transfer should be ignored. Expected 0x34 but got 0x%X", mem.ram[0xc100])
+	}
+	mem.Write(0xff80, 0x56)
+	if mem.ram[0xff80] != 0x56 {
+		t.Errorf("Write to HRAM during transfer should work. Expected 0x56 but got 0x%X", mem.ram[0xff80])
+	}
+}
+
+// Test that writing 0xff46 during a transfer restarts it from the new source
+func TestDmaRestart(t *testing.T) {
+	mem := dmaTestMemory()
+	mem.Write(0xff46, 0xc0)
+	for i := 0; i < 51; i++ {
+		mem.dma.tick(mem)
+	}
+
+	mem.Write(0xff46, 0xd0)
+	if !mem.dma.conflicts(0xc000) {
+		t.Errorf("Old transfer should keep blocking the bus during the startup delay of the new one")
+	}
+	mem.dma.tick(mem)
+	if mem.ram[0xfe32] != 0x32 {
+		t.Errorf("Old transfer should continue during the startup delay. Expected 0x32 but got 0x%X", mem.ram[0xfe32])
+	}
+
+	for i := 0; i < oamSize; i++ {
+		mem.dma.tick(mem)
+	}
+	for i := uint16(0); i < oamSize; i++ {
+		if mem.ram[0xfe00+i] != uint8(i)+0x80 {
+			t.Errorf("Byte %d was not transferred from the new source. Expected 0x%X but got 0x%X", i, uint8(i)+0x80, mem.ram[0xfe00+i])
+		}
+	}
+	if mem.dma.active {
+		t.Errorf("Restarted transfer should have finished")
+	}
+}
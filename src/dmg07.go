@@ -0,0 +1,209 @@
+package main
+
+// The DMG-07 Four Player Adapter connects up to four Game Boys. It is the clock master for all of them, the
+// Game Boys only ever transfer with the external clock, and it clocks the same byte into every port at the
+// same time. It starts in the ping phase, sending 4 byte ping packets over and over:
+//
+//  -----------------------------------------------------------------------
+// | 0xfe           | header                                               |
+// | STAT x 3       | bits 7 - 4: players connected (bit 4 = player 1),    |
+// |                | bits 2 - 0: number of the player receiving the ping  |
+//  -----------------------------------------------------------------------
+//
+// A Game Boy answers with 0x88, 0x88, RATE and SIZE and counts as connected from the next ping on. RATE and
+// SIZE of player 1 set the speed and the bytes every player sends per round later on. Player 1 starts the
+// transmission phase by answering a whole ping with 0xaa, the adapter confirms with four bytes of 0xcc.
+//
+// In the transmission phase a round is 4 * SIZE bytes long. During the first SIZE bytes every Game Boy sends
+// its packet, the rest of what it sends is ignored. At the same time the adapter sends the packets of all
+// players from the last round, player 1 first, with 0xff for the players which aren't connected. So the
+// Game Boys always see the data one round late. Player 1 goes back to the ping phase by sending a packet of
+// 0xff only.
+//
+// The timing is approximated: ping bytes come every adapterPingDots dots, the bytes of the transmission phase
+// every adapterByteDots dots plus adapterRateDots for every step of the lower nibble of RATE.
+
+const (
+	adapterPingDots = 0x4000
+	adapterByteDots = 0x1000
+	adapterRateDots = 0x200
+	adapterPlayers  = 4
+)
+
+// adapterPort is a Game Boy plugged into the adapter.
+type adapterPort interface {
+	// Clock the byte into the Game Boy and return the byte it shifted out.
+	transfer(in uint8) uint8
+}
+
+// A Game Boy running in the same process.
+type localPort struct {
+	mem *Memory
+}
+
+func (p localPort) transfer(in uint8) uint8 {
+	return p.mem.serial.receive(p.mem, in)
+}
+
+const (
+	adapterPing = iota
+	adapterStarting
+	adapterTransmission
+)
+
+type Dmg07 struct {
+	ports [adapterPlayers]adapterPort
+
+	phase     int
+	connected uint8
+	rate      uint8
+	size      int
+
+	// position in the current ping packet or round
+	pos int
+	// answers of the players to the current ping
+	pings [adapterPlayers][4]uint8
+	// packets of the last round sent to the players, packets of the current round received from them
+	sending   []uint8
+	receiving []uint8
+
+	dots int
+}
+
+func newDmg07(ports ...adapterPort) *Dmg07 {
+	a := &Dmg07{size: 1}
+	copy(a.ports[:], ports)
+	return a
+}
+
+// Hang up the links of the players in other processes.
+func (a *Dmg07) close() {
+	for _, port := range a.ports {
+		if link, ok := port.(*Link); ok {
+			link.close()
+		}
+	}
+}
+
+// The adapter drives the clock, a Game Boy starting a transfer with the internal clock gets nothing back.
+func (a *Dmg07) exchange(out uint8) uint8 {
+	return 0xff
+}
+
+// Advance the adapter, clocking the next byte into the ports when it's time.
+func (a *Dmg07) tick(mem *Memory, dots int) {
+	for _, port := range a.ports {
+		if ticker, ok := port.(serialTicker); ok {
+			ticker.tick(mem, dots)
+		}
+	}
+	a.dots += dots
+	interval := adapterPingDots
+	if a.phase != adapterPing {
+		interval = adapterByteDots + int(a.rate&0x0f)*adapterRateDots
+	}
+	if a.dots >= interval {
+		a.dots -= interval
+		a.step()
+	}
+}
+
+// Clock the same byte into every port and return the answers.
+func (a *Dmg07) send(out func(player int) uint8) [adapterPlayers]uint8 {
+	var in [adapterPlayers]uint8
+	for i, port := range a.ports {
+		in[i] = 0xff
+		if port != nil {
+			in[i] = port.transfer(out(i))
+		}
+	}
+	return in
+}
+
+func (a *Dmg07) step() {
+	switch a.phase {
+	case adapterPing:
+		a.stepPing()
+	case adapterStarting:
+		a.send(func(int) uint8 { return 0xcc })
+		a.pos++
+		if a.pos == 4 {
+			a.pos = 0
+			a.phase = adapterTransmission
+			a.sending = make([]uint8, adapterPlayers*a.size)
+			a.receiving = a.emptyRound()
+		}
+	case adapterTransmission:
+		a.stepTransmission()
+	}
+}
+
+func (a *Dmg07) stepPing() {
+	in := a.send(func(player int) uint8 {
+		if a.pos == 0 {
+			return 0xfe
+		}
+		return a.connected<<4 | uint8(player+1)
+	})
+	for i := range in {
+		a.pings[i][a.pos] = in[i]
+	}
+	a.pos++
+	if a.pos < 4 {
+		return
+	}
+	a.pos = 0
+
+	if a.pings[0] == [4]uint8{0xaa, 0xaa, 0xaa, 0xaa} && a.connected&1 != 0 {
+		a.phase = adapterStarting
+		return
+	}
+	a.connected = 0
+	for i, ping := range a.pings {
+		if ping[0] == 0x88 && ping[1] == 0x88 {
+			a.connected |= 1 << i
+		}
+	}
+	if a.connected&1 != 0 {
+		a.rate = a.pings[0][2]
+		a.size = int(a.pings[0][3])
+		if a.size == 0 {
+			a.size = 1
+		}
+	}
+}
+
+func (a *Dmg07) stepTransmission() {
+	in := a.send(func(int) uint8 { return a.sending[a.pos] })
+	if a.pos < a.size {
+		for i := range in {
+			if a.connected&(1<<i) != 0 {
+				a.receiving[i*a.size+a.pos] = in[i]
+			}
+		}
+	}
+	a.pos++
+	if a.pos < len(a.sending) {
+		return
+	}
+	a.pos = 0
+
+	restart := true
+	for _, b := range a.receiving[:a.size] {
+		restart = restart && b == 0xff
+	}
+	if restart {
+		a.phase = adapterPing
+		a.connected = 0
+		return
+	}
+	a.sending, a.receiving = a.receiving, a.emptyRound()
+}
+
+func (a *Dmg07) emptyRound() []uint8 {
+	round := make([]uint8, adapterPlayers*a.size)
+	for i := range round {
+		round[i] = 0xff
+	}
+	return round
+}
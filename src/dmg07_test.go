@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+// A Game Boy answering with canned bytes and keeping what it gets.
+type cannedPort struct {
+	answers  []uint8
+	received []uint8
+}
+
+func (p *cannedPort) transfer(in uint8) uint8 {
+	p.received = append(p.received, in)
+	if len(p.answers) == 0 {
+		return 0x00
+	}
+	out := p.answers[0]
+	p.answers = p.answers[1:]
+	return out
+}
+
+func stepAdapter(a *Dmg07, bytes int) {
+	for i := 0; i < bytes; i++ {
+		a.step()
+	}
+}
+
+func checkBytes(t *testing.T, name string, got []uint8, expected []uint8) {
+	if string(got) != string(expected) {
+		t.Errorf("%s: expected % X but got % X", name, expected, got)
+	}
+}
+
+// Test that the ping packets show the connected players
+func TestDmg07Ping(t *testing.T) {
+	p1 := &cannedPort{answers: []uint8{0x88, 0x88, 0x02, 0x02}}
+	p3 := &cannedPort{answers: []uint8{0x88, 0x88, 0x00, 0x00}}
+	a := newDmg07(p1, nil, p3)
+	stepAdapter(a, 8)
+
+	checkBytes(t, "player 1", p1.received, []uint8{0xfe, 0x01, 0x01, 0x01, 0xfe, 0x51, 0x51, 0x51})
+	checkBytes(t, "player 3", p3.received, []uint8{0xfe, 0x03, 0x03, 0x03, 0xfe, 0x53, 0x53, 0x53})
+	if a.rate != 0x02 || a.size != 2 {
+		t.Errorf("Expected RATE 2 and SIZE 2 from player 1 but got %d and %d", a.rate, a.size)
+	}
+}
+
+// Test the start of the transmission phase, the rounds of packets and the restart
+func TestDmg07Transmission(t *testing.T) {
+	p1 := &cannedPort{answers: []uint8{
+		0x88, 0x88, 0x00, 0x02, // ping
+		0xaa, 0xaa, 0xaa, 0xaa, // start
+		0x00, 0x00, 0x00, 0x00, // confirmation
+		0x11, 0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // round 1
+		0x13, 0x14, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // round 2
+		0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // restart
+	}}
+	p2 := &cannedPort{answers: []uint8{
+		0x88, 0x88, 0x00, 0x00,
+		0x88, 0x88, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x21, 0x22, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x23, 0x24, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}}
+	a := newDmg07(p1, p2)
+	stepAdapter(a, 8)
+	if a.phase != adapterStarting {
+		t.Fatalf("Expected the transmission to start")
+	}
+	stepAdapter(a, 4+3*8)
+	if a.phase != adapterPing {
+		t.Errorf("Expected the ping phase after the restart")
+	}
+
+	checkBytes(t, "player 1 ping", p1.received[:8], []uint8{0xfe, 0x01, 0x01, 0x01, 0xfe, 0x31, 0x31, 0x31})
+	checkBytes(t, "player 2 ping", p2.received[:8], []uint8{0xfe, 0x02, 0x02, 0x02, 0xfe, 0x32, 0x32, 0x32})
+	// the packets of the players come one round late, player 3 and 4 aren't connected
+	expected := []uint8{0xcc, 0xcc, 0xcc, 0xcc,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x11, 0x12, 0x21, 0x22, 0xff, 0xff, 0xff, 0xff,
+		0x13, 0x14, 0x23, 0x24, 0xff, 0xff, 0xff, 0xff}
+	checkBytes(t, "player 1", p1.received[8:], expected)
+	checkBytes(t, "player 2", p2.received[8:], expected)
+}
+
+// Test that the adapter clocks a Game Boy waiting with the external clock
+func TestDmg07LocalPort(t *testing.T) {
+	mem := newMemory(nil)
+	a := newDmg07(localPort{mem})
+	mem.Write(0xff01, 0x88)
+	mem.Write(0xff02, 0x80)
+	for i := 0; i < adapterPingDots/4; i++ {
+		a.tick(mem, 4)
+	}
+	if mem.serial.sb != 0xfe || mem.ram[0xff0f]&intSerial == 0 {
+		t.Errorf("Expected the ping header 0xFE with the interrupt but got 0x%X", mem.serial.sb)
+	}
+	if a.pings[0][0] != 0x88 {
+		t.Errorf("Expected the adapter to get 0x88 but got 0x%X", a.pings[0][0])
+	}
+}
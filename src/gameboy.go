@@ -0,0 +1,124 @@
+package main
+
+// The system clock runs at 4.194304 MHz. A frame takes 70224 clock cycles (dots), which is 17556 M-cycles
+// at normal speed and twice as many in CGB double speed mode.
+const dotsPerFrame = 70224
+
+// Gameboy ties the CPU and the components on the memory bus together and keeps them in step.
+type Gameboy struct {
+	cpu   Cpu
+	mem   *Memory
+	ppu   *Ppu
+	sgb   *Sgb
+	apu   *Apu
+	model Model
+
+	// Set if a CGB model runs a cartridge with CGB functions, otherwise a CGB runs in DMG compatibility mode.
+	cgbMode bool
+
+	// dots executed past the end of the last frame
+	dots int
+}
+
+// Create a Gameboy of the given model. If a boot ROM is given, execution starts at 0x0000 inside the boot
+// ROM, otherwise the state the boot ROM would have left behind is set up and execution starts at 0x0100.
+func newGameboy(model Model, cart *Cartridge, bootROM []uint8) *Gameboy {
+	gb := &Gameboy{
+		mem:     newMemory(cart),
+		model:   model,
+		cgbMode: model.isCGB() && cart != nil && cart.cgbFlag()&0x80 != 0,
+	}
+	gb.ppu = newPpu(gb.mem)
+	gb.ppu.cgb = gb.cgbMode
+	gb.mem.ppu = gb.ppu
+	gb.mem.cgb = gb.cgbMode
+	gb.apu = newApu(defaultSampleRate)
+	gb.apu.cgb = model.isCGB()
+	gb.apu.blep = newBlepSynth()
+	gb.apu.highPass = newHighPass(model.highPassCharge(), defaultSampleRate)
+	gb.mem.apu = gb.apu
+	if model.isSGB() {
+		gb.sgb = newSgb()
+		gb.mem.sgb = gb.sgb
+	}
+	if model.isCGB() && !gb.cgbMode {
+		gb.ppu.compat = true
+		gb.ppu.loadCompatPalettes(titleCombination(cart))
+	}
+
+	if bootROM != nil {
+		gb.mem.bootROM = bootROM
+	} else {
+		gb.cpu = postBootCpu(model, cart, gb.cgbMode)
+		postBootMemory(gb.mem, model)
+	}
+	gb.cpu.bus = gb
+	return gb
+}
+
+// Execute a single instruction and return the number of M-cycles it took. The other components advance along
+// with every M-cycle of the instruction. While the CPU is stopped for a speed switch or halted by the HDMA,
+// only a single M-cycle passes.
+func (gb *Gameboy) step() int {
+	if gb.mem.speed.pause > 0 {
+		gb.mem.speed.pause--
+		gb.tick()
+		return 1
+	}
+	if gb.mem.hdma.stall > 0 {
+		gb.mem.hdma.stall--
+		gb.tick()
+		return 1
+	}
+
+	return gb.cpu.step(gb.mem)
+}
+
+// Advance the components on the memory bus by one M-cycle of the CPU. Components clocked along with the CPU
+// advance by one M-cycle, the PPU by the dots the M-cycle takes at the current speed.
+func (gb *Gameboy) tick() {
+	gb.mem.dma.tick(gb.mem)
+	gb.mem.timer.tick(gb.mem)
+	gb.mem.serial.tick(gb.mem)
+
+	dots := gb.mem.speed.dotsPerCycle()
+	for i := 0; i < dots; i++ {
+		gb.ppu.tick()
+	}
+	gb.apu.tick(dots)
+	if gb.mem.serial.ticker != nil {
+		gb.mem.serial.ticker.tick(gb.mem, dots)
+	}
+	gb.mem.hdma.tick(gb.mem)
+	if gb.sgb != nil {
+		gb.sgb.tick(gb.ppu)
+	}
+	gb.dots += dots
+}
+
+// Run the emulation for the duration of one frame. Returns the error of the CPU once it ran into an opcode it
+// cannot execute.
+func (gb *Gameboy) runFrame() error {
+	for gb.dots < dotsPerFrame {
+		gb.step()
+	}
+	gb.dots -= dotsPerFrame
+	return gb.cpu.err
+}
+
+// Return the RGBA pixels of the last finished frame. On the SGB models this is the whole SGB picture with
+// the border.
+func (gb *Gameboy) frame() []uint8 {
+	if gb.sgb != nil {
+		return gb.sgb.frame[:]
+	}
+	return gb.ppu.frame()
+}
+
+// Return the size of the frames returned by frame.
+func (gb *Gameboy) frameSize() (int, int) {
+	if gb.sgb != nil {
+		return sgbWidth, sgbHeight
+	}
+	return screenWidth, screenHeight
+}
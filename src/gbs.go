@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A GBS (Game Boy Sound System) file holds the sound driver and music data ripped from a game, without the
+// rest of it. The 0x70 byte header is followed by the code, which is loaded at the load address:
+//
+//  ---------------------------------------------
+// | 0x00 - 0x02 | "GBS"                         |
+// | 0x03        | version (1)                   |
+// | 0x04        | number of songs               |
+// | 0x05        | first song (from 1)           |
+// | 0x06 - 0x07 | load address                  |
+// | 0x08 - 0x09 | init address                  |
+// | 0x0a - 0x0b | play address                  |
+// | 0x0c - 0x0d | stack pointer                 |
+// | 0x0e        | timer modulo (TMA)            |
+// | 0x0f        | timer control (TAC)           |
+// | 0x10 - 0x2f | title                         |
+// | 0x30 - 0x4f | author                        |
+// | 0x50 - 0x6f | copyright                     |
+//  ---------------------------------------------
+//
+// To start a song, init is called with the song number (from 0) in A. After that play is called periodically:
+// if bit 2 of TAC is set by the timer interrupt, otherwise at the rate of the VBlank interrupt. Bit 7 of TAC
+// switches the CGB to double speed, which doubles the timer rate as well.
+//
+// The code is mapped like a cartridge ROM with 16KB banks, writes to 0x2000 - 0x3fff select the bank at
+// 0x4000 - 0x7fff. The RST instructions call the vectors relative to the load address. The player runs the
+// CPU and APU without a PPU. Routines are called by pushing gbsReturn and jumping to them; once their RET
+// arrives at gbsReturn the routine has returned and the CPU waits for the next call of play. A call of play
+// which comes while a routine is still running is skipped.
+
+const (
+	gbsHeaderSize = 0x70
+
+	// address routines return to
+	gbsReturn = 0x0000
+
+	// default length of a song and its fade-out in seconds
+	defaultGbsLength = 150
+	defaultGbsFade   = 8
+)
+
+type GbsHeader struct {
+	Magic     [3]byte
+	Version   uint8
+	Songs     uint8
+	FirstSong uint8
+	Load      uint16
+	Init      uint16
+	Play      uint16
+	SP        uint16
+	TMA       uint8
+	TAC       uint8
+	Title     [32]byte
+	Author    [32]byte
+	Copyright [32]byte
+}
+
+// ROM of a GBS file, banked in 16KB banks.
+type GbsRom struct {
+	rom  []uint8
+	bank int
+	// load address of the code, the RST vectors are relative to it
+	load uint16
+}
+
+func (r *GbsRom) read(addr uint16) uint8 {
+	offset := int(addr)
+	if addr >= 0x4000 {
+		offset = r.bank*0x4000 + int(addr-0x4000)
+	}
+	if offset >= len(r.rom) {
+		return 0xff
+	}
+	return r.rom[offset]
+}
+
+func (r *GbsRom) write(addr uint16, val uint8) {
+	if addr >= 0x2000 && addr < 0x4000 {
+		r.bank = int(val)
+		if r.bank == 0 {
+			r.bank = 1
+		}
+	}
+}
+
+type GbsPlayer struct {
+	header GbsHeader
+	rom    *GbsRom
+	mem    *Memory
+	cpu    Cpu
+	apu    *Apu
+
+	// current song from 0, and whether it starts over instead of moving on to the next song when it ends
+	song int
+	loop bool
+
+	// a routine is running on the CPU
+	running bool
+	// dots until the next VBlank
+	vblankTimer int
+	// dots since the song started
+	elapsed int
+
+	// length of a song and its fade-out in dots
+	length int
+	fade   int
+	// gain of the samples at the end of the last frame
+	gain float32
+}
+
+func loadGbs(path string) (*GbsPlayer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newGbsPlayer(data)
+}
+
+func newGbsPlayer(data []uint8) (*GbsPlayer, error) {
+	if len(data) < gbsHeaderSize {
+		return nil, fmt.Errorf("GBS file is too small (%d bytes)", len(data))
+	}
+	p := &GbsPlayer{apu: newApu(defaultSampleRate), length: defaultGbsLength * clockRate, fade: defaultGbsFade * clockRate, gain: 1}
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &p.header)
+
+	h := p.header
+	switch {
+	case string(h.Magic[:]) != "GBS":
+		return nil, fmt.Errorf("not a GBS file")
+	case h.Version != 1:
+		return nil, fmt.Errorf("unsupported GBS version %d", h.Version)
+	case h.Songs == 0:
+		return nil, fmt.Errorf("GBS file has no songs")
+	case h.Load < 0x0400 || h.Load >= 0x8000:
+		return nil, fmt.Errorf("invalid GBS load address 0x%04X", h.Load)
+	}
+
+	code := data[gbsHeaderSize:]
+	size := (int(h.Load) + len(code) + 0x3fff) &^ 0x3fff
+	p.rom = &GbsRom{rom: make([]uint8, size), bank: 1, load: h.Load}
+	copy(p.rom.rom[h.Load:], code)
+
+	first := int(h.FirstSong) - 1
+	if first < 0 || first >= int(h.Songs) {
+		first = 0
+	}
+	p.start(first)
+	return p, nil
+}
+
+func (p *GbsPlayer) title() string {
+	return gbsString(p.header.Title[:])
+}
+
+func (p *GbsPlayer) author() string {
+	return gbsString(p.header.Author[:])
+}
+
+func (p *GbsPlayer) copyright() string {
+	return gbsString(p.header.Copyright[:])
+}
+
+func gbsString(field []byte) string {
+	return strings.TrimRight(string(field), "\x00")
+}
+
+// Reset the hardware and call init for the given song.
+func (p *GbsPlayer) start(song int) {
+	p.song = song
+	p.rom.bank = 1
+	p.mem = newMemory(nil)
+	p.mem.gbs = p.rom
+	p.mem.apu = p.apu
+	// power cycle the APU to clear the registers of the last song
+	p.mem.Write(0xff26, 0x00)
+	p.mem.Write(0xff26, 0x80)
+	p.mem.Write(0xff25, 0xff)
+	p.mem.Write(0xff24, 0x77)
+	p.mem.Write(0xff05, p.header.TMA)
+	p.mem.Write(0xff06, p.header.TMA)
+	p.mem.Write(0xff07, p.header.TAC)
+	p.mem.speed.double = p.header.TAC&0x80 != 0
+
+	p.cpu = Cpu{SP: p.header.SP}
+	p.cpu.setA(uint8(song))
+	p.call(p.header.Init)
+
+	p.vblankTimer = dotsPerFrame
+	p.elapsed = 0
+}
+
+// Select the next or previous song, wrapping around at the ends.
+func (p *GbsPlayer) skip(delta int) {
+	songs := int(p.header.Songs)
+	p.start(((p.song+delta)%songs + songs) % songs)
+}
+
+func (p *GbsPlayer) call(addr uint16) {
+	push(&p.cpu, p.mem, gbsReturn)
+	p.cpu.PC = addr
+	p.running = true
+}
+
+// Run the CPU for a single instruction, or a single M-cycle while waiting for play, and return the dots it
+// took.
+func (p *GbsPlayer) step() int {
+	cycles := 1
+	if p.running {
+		// the player calls play itself instead of an interrupt handler, so the routines run with the interrupts
+		// disabled
+		p.cpu.ime = false
+		cycles = p.cpu.step(p.mem)
+		if p.cpu.PC == gbsReturn {
+			p.running = false
+		}
+	}
+
+	dots := cycles * p.mem.speed.dotsPerCycle()
+	for i := 0; i < cycles; i++ {
+		p.mem.timer.tick(p.mem)
+		p.apu.tick(p.mem.speed.dotsPerCycle())
+	}
+
+	// the timer as the song set it up decides between the timer interrupt and VBlank
+	if p.mem.timer.tac&0x04 != 0 {
+		if p.mem.ram[0xff0f]&intTimer != 0 {
+			p.mem.ram[0xff0f] &^= intTimer
+			p.play()
+		}
+	} else {
+		p.vblankTimer -= dots
+		if p.vblankTimer <= 0 {
+			p.vblankTimer += dotsPerFrame
+			p.play()
+		}
+	}
+	p.elapsed += dots
+	return dots
+}
+
+func (p *GbsPlayer) play() {
+	if !p.running {
+		p.call(p.header.Play)
+	}
+}
+
+// Run the player for the duration of one frame. Once the song has faded out, the frame starts it over or
+// moves on to the next song. Returns the error of the CPU once the song ran into an opcode it cannot execute.
+func (p *GbsPlayer) runFrame() error {
+	if p.elapsed >= p.length+p.fade {
+		if p.loop {
+			p.start(p.song)
+		} else {
+			p.skip(1)
+		}
+	}
+	for dots := 0; dots < dotsPerFrame; {
+		dots += p.step()
+	}
+	return p.cpu.err
+}
+
+// Gain of the output at the current position of the song, fading out linearly after its length.
+func (p *GbsPlayer) fadeGain() float32 {
+	if p.elapsed <= p.length {
+		return 1
+	}
+	if p.fade == 0 || p.elapsed >= p.length+p.fade {
+		return 0
+	}
+	return 1 - float32(p.elapsed-p.length)/float32(p.fade)
+}
+
+// Return the samples of the last frame with the fade-out applied, ramping the gain over the frame. A new song
+// ramps up from the gain the last one ended with.
+func (p *GbsPlayer) takeSamples() []float32 {
+	samples := p.apu.takeSamples()
+	from, to := p.gain, p.fadeGain()
+	frames := len(samples) / 2
+	for i := 0; i < frames; i++ {
+		gain := from + (to-from)*float32(i+1)/float32(frames)
+		samples[2*i] *= gain
+		samples[2*i+1] *= gain
+	}
+	p.gain = to
+	return samples
+}
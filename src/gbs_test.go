@@ -0,0 +1,188 @@
+package main
+
+import "testing"
+
+// Build a GBS file with three songs, the given code at 0x0400 and an init routine at its start. Unless the
+// code goes on to 0x0500, play is a routine returning right away.
+func testGbs(tac uint8, code []uint8) []uint8 {
+	data := make([]uint8, gbsHeaderSize)
+	copy(data, "GBS")
+	data[0x03] = 1
+	data[0x04] = 3
+	data[0x05] = 2
+	data[0x06], data[0x07] = 0x00, 0x04 // load
+	data[0x08], data[0x09] = 0x00, 0x04 // init
+	data[0x0a], data[0x0b] = 0x00, 0x05 // play
+	data[0x0c], data[0x0d] = 0xfe, 0xff // stack pointer
+	data[0x0e] = 0xc0
+	data[0x0f] = tac
+	copy(data[0x10:], "Test Song")
+	if len(code) <= 0x100 {
+		code = append(code, make([]uint8, 0x101-len(code))...)
+		code[0x100] = 0xc9 // RET
+	}
+	return append(data, code...)
+}
+
+// Test that the header is parsed and init is called for the first song with the song number in A
+func TestGbsHeader(t *testing.T) {
+	p, err := newGbsPlayer(testGbs(0x00, []uint8{0x3e, 0xf0, 0xe0, 0x12, 0xc9})) // LD A,0xf0; LDH (0x12),A; RET
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.title() != "Test Song" {
+		t.Errorf("Expected title \"Test Song\" but got %q", p.title())
+	}
+	if p.song != 1 || highByte(p.cpu.AF) != 1 {
+		t.Errorf("Init should be called for song 1. Expected A = 1 but got %d", highByte(p.cpu.AF))
+	}
+	if p.cpu.PC != 0x0400 || p.mem.Read(0xfffc) != lowByte(gbsReturn) {
+		t.Errorf("Init should be called with the return address on the stack")
+	}
+
+	p.step()
+	p.step()
+	if val := p.apu.regs[0x02]; val != 0xf0 {
+		t.Errorf("Init should have written NR12. Expected 0xF0 but got 0x%X", val)
+	}
+
+	if _, err := newGbsPlayer(append([]uint8("GBX"), make([]uint8, gbsHeaderSize)...)); err == nil {
+		t.Errorf("A file without the GBS magic should be rejected")
+	}
+}
+
+// Test that the code is mapped in 16KB banks selected by writes to 0x2000 - 0x3fff
+func TestGbsBanks(t *testing.T) {
+	code := make([]uint8, 0xc000)
+	code[0x4000-0x0400] = 0x11
+	code[0x8000-0x0400] = 0x22
+	p, err := newGbsPlayer(testGbs(0x00, code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := p.mem.Read(0x4000); val != 0x11 {
+		t.Errorf("Bank 1 should be mapped. Expected 0x11 but got 0x%X", val)
+	}
+	p.mem.Write(0x2000, 2)
+	if val := p.mem.Read(0x4000); val != 0x22 {
+		t.Errorf("Bank 2 should be mapped. Expected 0x22 but got 0x%X", val)
+	}
+	if val := p.mem.Read(0x0400); val != 0x00 {
+		t.Errorf("Bank 0 should stay mapped. Expected 0x00 but got 0x%X", val)
+	}
+}
+
+// Run the player until play is called and return the dots it took.
+func dotsUntilPlay(p *GbsPlayer) int {
+	dots := p.step()
+	for p.cpu.PC != p.header.Play && dots < 2*dotsPerFrame {
+		dots += p.step()
+	}
+	return dots
+}
+
+// Test that init returns through its RET and play is called afterwards, returning as well
+func TestGbsCallReturn(t *testing.T) {
+	code := []uint8{
+		0xcd, 0x04, 0x04, // CALL 0x0404
+		0xc9,       // RET
+		0x3e, 0xf0, // LD A,0xf0
+		0xe0, 0x12, // LDH (0x12),A
+		0xc9, // RET
+	}
+	code = append(code, make([]uint8, 0x100-len(code))...)
+	code = append(code,
+		0x3e, 0x77, // LD A,0x77
+		0xe0, 0x24, // LDH (0x24),A
+		0xc9, // RET
+	)
+	p, err := newGbsPlayer(testGbs(0x00, code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mem.Write(0xff24, 0x00)
+
+	for i := 0; i < 5; i++ {
+		p.step()
+	}
+	if p.running || p.cpu.PC != gbsReturn || p.cpu.SP != p.header.SP {
+		t.Fatalf("Init should have returned. PC = 0x%04X, SP = 0x%04X", p.cpu.PC, p.cpu.SP)
+	}
+	if val := p.apu.regs[0x02]; val != 0xf0 {
+		t.Errorf("Init should have written NR12. Expected 0xF0 but got 0x%X", val)
+	}
+
+	dotsUntilPlay(p)
+	if p.cpu.PC != p.header.Play {
+		t.Fatalf("Play should have been called")
+	}
+	for i := 0; i < 3; i++ {
+		p.step()
+	}
+	if p.running || p.cpu.SP != p.header.SP {
+		t.Errorf("Play should have returned. PC = 0x%04X, SP = 0x%04X", p.cpu.PC, p.cpu.SP)
+	}
+	if val := p.apu.regs[0x14]; val != 0x77 {
+		t.Errorf("Play should have written NR50. Expected 0x77 but got 0x%X", val)
+	}
+}
+
+// Test that play is called at the rate of the timer, or of the VBlank without the timer
+func TestGbsPlayRate(t *testing.T) {
+	p, _ := newGbsPlayer(testGbs(0x04, []uint8{0xc9}))
+	expected := 64 * 1024
+	// the interrupt comes one M-cycle after the overflow
+	if dots := dotsUntilPlay(p); dots != expected+4 {
+		t.Errorf("Play should be called by the timer. Expected %d dots but got %d", expected+4, dots)
+	}
+	if dots := dotsUntilPlay(p); dots != expected {
+		t.Errorf("Expected %d dots to the next call but got %d", expected, dots)
+	}
+
+	p, _ = newGbsPlayer(testGbs(0x84, []uint8{0xc9}))
+	if dots := dotsUntilPlay(p); dots != expected/2+2 {
+		t.Errorf("The timer should run twice as fast in double speed. Expected %d dots but got %d", expected/2+2, dots)
+	}
+
+	p, _ = newGbsPlayer(testGbs(0x00, []uint8{0xc9}))
+	if dots := dotsUntilPlay(p); dots != dotsPerFrame {
+		t.Errorf("Play should be called at VBlank. Expected %d dots but got %d", dotsPerFrame, dots)
+	}
+}
+
+// Test that a song fades out after its length and the player moves on to the next song, wrapping around
+func TestGbsFadeOut(t *testing.T) {
+	p, _ := newGbsPlayer(testGbs(0x00, []uint8{0xc9}))
+	p.length = dotsPerFrame
+	p.fade = 2 * dotsPerFrame
+
+	p.runFrame()
+	p.takeSamples()
+	p.runFrame()
+	p.takeSamples()
+	if p.gain != 0.5 {
+		t.Errorf("Expected gain 0.5 half way through the fade-out but got %f", p.gain)
+	}
+
+	p.runFrame()
+	p.takeSamples()
+	if p.gain != 0 {
+		t.Errorf("The song should have faded out but the gain is %f", p.gain)
+	}
+	p.runFrame()
+	if p.song != 2 {
+		t.Errorf("The player should move on to song 2 but plays %d", p.song)
+	}
+	p.elapsed = p.length + p.fade
+	p.runFrame()
+	if p.song != 0 {
+		t.Errorf("The player should wrap around to song 0 but plays %d", p.song)
+	}
+
+	p.loop = true
+	p.elapsed = p.length + p.fade
+	p.runFrame()
+	if p.song != 0 {
+		t.Errorf("The player should start the song over but plays %d", p.song)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+)
+
+// Size of the text screen of the GBS player.
+const (
+	gbsScreenWidth  = 320
+	gbsScreenHeight = 144
+)
+
+// GbsGame plays a GBS file, showing the song information instead of a screen.
+type GbsGame struct {
+	player *GbsPlayer
+	audio  *Audio
+	input  *Input
+	config *configWatch
+}
+
+func runGbs(player *GbsPlayer, audio *Audio, input *Input, config *configWatch, scale int) error {
+	ebiten.SetWindowSize(scale*gbsScreenWidth, scale*gbsScreenHeight)
+	ebiten.SetWindowTitle("gbemu - " + player.title())
+	return ebiten.RunGame(&GbsGame{player: player, audio: audio, input: input, config: config})
+}
+
+func (g *GbsGame) Update() error {
+	if g.input.justPressed(hotkeyGbsNext) {
+		g.player.skip(1)
+	}
+	if g.input.justPressed(hotkeyGbsPrev) {
+		g.player.skip(-1)
+	}
+	if g.input.justPressed(hotkeyGbsLoop) {
+		g.player.loop = !g.player.loop
+	}
+	updateVolume(g.input, g.audio)
+	if config, input := g.config.update(g.input, nil); config != nil {
+		g.input = input
+	}
+
+	if err := g.player.runFrame(); err != nil {
+		return err
+	}
+	g.audio.push(g.player.takeSamples())
+	return nil
+}
+
+func (g *GbsGame) Draw(screen *ebiten.Image) {
+	p := g.player
+	loop := "off"
+	if p.loop {
+		loop = "on"
+	}
+	lines := []string{
+		p.title(),
+		p.author(),
+		p.copyright(),
+		"",
+		fmt.Sprintf("song %d / %d", p.song+1, p.header.Songs),
+		fmt.Sprintf("%s / %s", formatDots(p.elapsed), formatDots(p.length)),
+		"loop " + loop,
+		"",
+		fmt.Sprintf("%s/%s: song, %s: loop", g.input.keyName(hotkeyGbsPrev), g.input.keyName(hotkeyGbsNext),
+			g.input.keyName(hotkeyGbsLoop)),
+	}
+	for i, line := range lines {
+		ebitenutil.DebugPrintAt(screen, line, 8, 4+i*15)
+	}
+}
+
+func (g *GbsGame) Layout(outsideWidth, outsideHeight int) (int, int) {
+	return gbsScreenWidth, gbsScreenHeight
+}
+
+// Format a duration in dots as minutes and seconds.
+func formatDots(dots int) string {
+	seconds := dots / clockRate
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
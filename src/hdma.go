@@ -0,0 +1,113 @@
+package main
+
+// In CGB mode a second DMA unit copies data into video RAM in blocks of 16 bytes, either all at once
+// (general purpose DMA) or one block at the start of every HBlank (HBlank DMA).
+//
+//  --------------------------------------------------------------------
+// | 0xff51 | HDMA1 | source, high byte                                 |
+// | 0xff52 | HDMA2 | source, low byte (lower 4 bits ignored)           |
+// | 0xff53 | HDMA3 | destination, high byte (upper 3 bits ignored)     |
+// | 0xff54 | HDMA4 | destination, low byte (lower 4 bits ignored)      |
+// | 0xff55 | HDMA5 | bit 7: 0 = general purpose, 1 = HBlank DMA       |
+// |        |       | bit 6 - 0: number of blocks - 1                  |
+//  --------------------------------------------------------------------
+//
+// The destination is always in the video RAM bank selected by VBK. The CPU is halted while a block is
+// copied, which takes 8 M-cycles at normal speed and 16 M-cycles at double speed.
+//
+// Reading HDMA5 returns the number of blocks left - 1, with bit 7 cleared while an HBlank DMA is active.
+// Writing HDMA5 with bit 7 cleared during an HBlank DMA cancels it.
+
+const (
+	hdmaBlockSize   = 16
+	hdmaBlockCycles = 8
+	hdmaHBlank      = 1 << 7
+)
+
+type Hdma struct {
+	source uint16
+	dest   uint16
+
+	// HBlank DMA in progress and the blocks left
+	active bool
+	blocks int
+
+	// M-cycles left the CPU is halted for
+	stall int
+
+	// PPU mode at the last tick, to find the start of HBlank
+	lastMode uint8
+}
+
+func (h *Hdma) read(addr uint16) uint8 {
+	if addr != 0xff55 {
+		// the source and destination registers are write-only
+		return 0xff
+	}
+	val := uint8(h.blocks-1) & 0x7f
+	if !h.active {
+		val |= hdmaHBlank
+	}
+	return val
+}
+
+func (h *Hdma) write(mem *Memory, addr uint16, val uint8) {
+	switch addr {
+	case 0xff51:
+		h.source = uint16(val)<<8 | h.source&0x00ff
+	case 0xff52:
+		h.source = h.source&0xff00 | uint16(val&0xf0)
+	case 0xff53:
+		h.dest = uint16(val&0x1f)<<8 | h.dest&0x00ff
+	case 0xff54:
+		h.dest = h.dest&0xff00 | uint16(val&0xf0)
+	case 0xff55:
+		if h.active && val&hdmaHBlank == 0 {
+			h.active = false
+			return
+		}
+		h.blocks = int(val&0x7f) + 1
+		if val&hdmaHBlank == 0 {
+			for h.blocks > 0 {
+				h.copyBlock(mem)
+			}
+			return
+		}
+		h.active = true
+		if mem.ppu != nil && !mem.ppu.enabled() {
+			// with the LCD turned off there is no HBlank to wait for, the first block is copied right away
+			h.copyBlock(mem)
+		}
+	}
+}
+
+// Copy the next block and halt the CPU for the time it takes.
+func (h *Hdma) copyBlock(mem *Memory) {
+	for i := 0; i < hdmaBlockSize; i++ {
+		mem.writeVRAM(h.dest, mem.read(h.source))
+		h.source++
+		h.dest = (h.dest + 1) & 0x1fff
+	}
+	h.blocks--
+	if h.blocks == 0 {
+		h.active = false
+	}
+
+	cycles := hdmaBlockCycles
+	if mem.speed != nil && mem.speed.double {
+		cycles *= 2
+	}
+	h.stall += cycles
+}
+
+// Advance by one M-cycle, copying a block whenever the PPU enters HBlank on a visible line.
+func (h *Hdma) tick(mem *Memory) {
+	if mem.ppu == nil {
+		return
+	}
+	mode := mem.ppu.mode
+	if h.active && mode == modeHBlank && h.lastMode == modeDrawing {
+		h.copyBlock(mem)
+	}
+	h.lastMode = mode
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func hdmaTestMemory() (*Memory, *Ppu) {
+	mem, ppu := cgbTestMemory()
+	mem.cgb = true
+	for i := uint16(0); i < 0x100; i++ {
+		mem.ram[0xc000+i] = uint8(i)
+	}
+	mem.Write(0xff51, 0xc0)
+	mem.Write(0xff52, 0x00)
+	mem.Write(0xff53, 0x01)
+	mem.Write(0xff54, 0x00)
+	return mem, ppu
+}
+
+// Test that a general purpose DMA copies everything at once and halts the CPU
+func TestHdmaGeneralPurpose(t *testing.T) {
+	mem, ppu := hdmaTestMemory()
+	mem.Write(0xff4f, 1)
+	mem.Write(0xff55, 0x02)
+
+	for i := 0; i < 3*hdmaBlockSize; i++ {
+		if ppu.vram[1][0x100+i] != uint8(i) {
+			t.Errorf("Byte %d was not copied to bank 1. Expected 0x%X but got 0x%X", i, uint8(i), ppu.vram[1][0x100+i])
+		}
+	}
+	if ppu.vram[1][0x130] != 0x00 {
+		t.Errorf("Too many bytes were copied")
+	}
+	if mem.hdma.stall != 3*hdmaBlockCycles {
+		t.Errorf("Wrong number of M-cycles the CPU is halted. Expected %d but got %d", 3*hdmaBlockCycles, mem.hdma.stall)
+	}
+	if val := mem.Read(0xff55); val != 0xff {
+		t.Errorf("HDMA5 should read 0xFF after the transfer. Expected 0xFF but got 0x%X", val)
+	}
+
+	mem.hdma.stall = 0
+	mem.speed.double = true
+	mem.Write(0xff55, 0x00)
+	if mem.hdma.stall != 2*hdmaBlockCycles {
+		t.Errorf("Wrong number of M-cycles the CPU is halted in double speed. Expected %d but got %d", 2*hdmaBlockCycles, mem.hdma.stall)
+	}
+}
+
+// Test that an HBlank DMA copies one block per HBlank and can be cancelled
+func TestHdmaHBlank(t *testing.T) {
+	mem, ppu := hdmaTestMemory()
+	mem.Write(0xff40, lcdcEnable)
+	mem.Write(0xff55, hdmaHBlank|0x03)
+	if val := mem.Read(0xff55); val != 0x03 {
+		t.Errorf("HDMA5 should show the active transfer. Expected 0x03 but got 0x%X", val)
+	}
+
+	// run the PPU into the HBlank of line 0
+	for ppu.mode != modeDrawing {
+		ppu.tick()
+		mem.hdma.tick(mem)
+	}
+	for ppu.mode != modeHBlank {
+		ppu.tick()
+		mem.hdma.tick(mem)
+	}
+	if ppu.vram[0][0x10f] != 0x0f || ppu.vram[0][0x110] != 0x00 {
+		t.Errorf("Exactly one block should have been copied in the first HBlank")
+	}
+	if val := mem.Read(0xff55); val != 0x02 {
+		t.Errorf("Wrong number of blocks left. Expected 0x02 but got 0x%X", val)
+	}
+	if mem.hdma.stall != hdmaBlockCycles {
+		t.Errorf("Wrong number of M-cycles the CPU is halted. Expected %d but got %d", hdmaBlockCycles, mem.hdma.stall)
+	}
+
+	for ppu.ly < 2 {
+		ppu.tick()
+		mem.hdma.tick(mem)
+	}
+	mem.Write(0xff55, 0x00)
+	if val := mem.Read(0xff55); val != 0x81 {
+		t.Errorf("HDMA5 should show the blocks left of the cancelled transfer. Expected 0x81 but got 0x%X", val)
+	}
+
+	for ppu.ly < 4 {
+		ppu.tick()
+		mem.hdma.tick(mem)
+	}
+	if ppu.vram[0][0x11f] != 0x1f || ppu.vram[0][0x120] != 0x00 {
+		t.Errorf("No more blocks should have been copied after cancelling")
+	}
+}
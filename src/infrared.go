@@ -0,0 +1,50 @@
+package main
+
+// In CGB mode the infrared port lets two Game Boys facing each other talk through light.
+//
+// == RP register (0xff56) ==
+//
+//  -------------------------------------------------------
+// | bit 7 - 6 | 11 = enable reading the receiver          |
+// | bit 1     | read only: 0 = light received             |
+// | bit 0     | 1 = LED on                                |
+//  -------------------------------------------------------
+//
+// Games measure the time between the changes of the light, so both sides have to agree closely on when the
+// LED was switched. The other Game Boy is always another instance connected with the link cable, which sends
+// the changes along with the time they happened. Without a connection no light is ever received.
+
+// infraredPeer is what the LED of the Game Boy shines at.
+type infraredPeer interface {
+	// The LED was switched on or off.
+	light(on bool)
+}
+
+type Infrared struct {
+	rp uint8
+	// light falls on the receiver
+	received bool
+
+	peer infraredPeer
+}
+
+func (ir *Infrared) read() uint8 {
+	val := 0x3e | ir.rp
+	if ir.reading() && ir.received {
+		val &^= 0x02
+	}
+	return val
+}
+
+func (ir *Infrared) write(val uint8) {
+	led := val&0x01 != ir.rp&0x01
+	ir.rp = val & 0xc1
+	if led && ir.peer != nil {
+		ir.peer.light(val&0x01 != 0)
+	}
+}
+
+// Report whether the game is reading the receiver.
+func (ir *Infrared) reading() bool {
+	return ir.rp&0xc0 == 0xc0
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func infraredTestMemory() *Memory {
+	mem := newMemory(nil)
+	mem.cgb = true
+	return mem
+}
+
+// Test that RP only works in CGB mode and the receiver is only read when enabled
+func TestInfraredRegister(t *testing.T) {
+	mem := newMemory(nil)
+	mem.Write(0xff56, 0xc1)
+	if val := mem.Read(0xff56); val != 0xff {
+		t.Errorf("Expected 0xFF outside of CGB mode but got 0x%X", val)
+	}
+
+	mem = infraredTestMemory()
+	mem.Write(0xff56, 0xff)
+	if val := mem.Read(0xff56); val != 0xff {
+		t.Errorf("Expected 0xFF without light but got 0x%X", val)
+	}
+	mem.infrared.received = true
+	if val := mem.Read(0xff56); val != 0xfd {
+		t.Errorf("Expected the light received 0xFD but got 0x%X", val)
+	}
+	mem.Write(0xff56, 0x00)
+	if val := mem.Read(0xff56); val != 0x3e {
+		t.Errorf("The receiver shouldn't be read while disabled. Expected 0x3E but got 0x%X", val)
+	}
+}
+
+// Records the LED switches of the Game Boy.
+type testInfraredPeer struct {
+	lights []bool
+}
+
+func (p *testInfraredPeer) light(on bool) {
+	p.lights = append(p.lights, on)
+}
+
+// Test that only switching the LED reaches the other side
+func TestInfraredLed(t *testing.T) {
+	mem := infraredTestMemory()
+	peer := &testInfraredPeer{}
+	mem.infrared.peer = peer
+
+	mem.Write(0xff56, 0x01)
+	mem.Write(0xff56, 0xc1)
+	mem.Write(0xff56, 0x00)
+	if len(peer.lights) != 2 || !peer.lights[0] || peer.lights[1] {
+		t.Errorf("Expected the LED to be switched on and off but got %v", peer.lights)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// Names of the buttons of the standard gamepad layout, as used in the config file.
+var gamepadButtonNames = map[string]ebiten.StandardGamepadButton{
+	"RightBottom":      ebiten.StandardGamepadButtonRightBottom,
+	"RightRight":       ebiten.StandardGamepadButtonRightRight,
+	"RightLeft":        ebiten.StandardGamepadButtonRightLeft,
+	"RightTop":         ebiten.StandardGamepadButtonRightTop,
+	"FrontTopLeft":     ebiten.StandardGamepadButtonFrontTopLeft,
+	"FrontTopRight":    ebiten.StandardGamepadButtonFrontTopRight,
+	"FrontBottomLeft":  ebiten.StandardGamepadButtonFrontBottomLeft,
+	"FrontBottomRight": ebiten.StandardGamepadButtonFrontBottomRight,
+	"CenterLeft":       ebiten.StandardGamepadButtonCenterLeft,
+	"CenterRight":      ebiten.StandardGamepadButtonCenterRight,
+	"LeftStick":        ebiten.StandardGamepadButtonLeftStick,
+	"RightStick":       ebiten.StandardGamepadButtonRightStick,
+	"LeftTop":          ebiten.StandardGamepadButtonLeftTop,
+	"LeftBottom":       ebiten.StandardGamepadButtonLeftBottom,
+	"LeftLeft":         ebiten.StandardGamepadButtonLeftLeft,
+	"LeftRight":        ebiten.StandardGamepadButtonLeftRight,
+	"CenterCenter":     ebiten.StandardGamepadButtonCenterCenter,
+}
+
+// Joypad buttons and turbo buttons bound to one key or gamepad button.
+type binding struct {
+	buttons uint8
+	turbo   uint8
+}
+
+func (b binding) add(name string) binding {
+	b.buttons |= buttonNames[name]
+	b.turbo |= turboNames[name]
+	return b
+}
+
+// Input maps the keys and gamepad buttons held on the host to the joypad buttons, and the hotkeys to the
+// functions of the emulator.
+type Input struct {
+	keys     map[ebiten.Key]binding
+	gamepad  map[ebiten.StandardGamepadButton]binding
+	hotkeys  map[string]ebiten.Key
+	pressed  []ebiten.Key
+	gamepads []ebiten.GamepadID
+}
+
+// Resolve the names of the keys and buttons in the config.
+func newInput(bindings Bindings, hotkeys map[string]string) (*Input, error) {
+	in := &Input{
+		keys:    map[ebiten.Key]binding{},
+		gamepad: map[ebiten.StandardGamepadButton]binding{},
+		hotkeys: map[string]ebiten.Key{},
+	}
+	for name, keys := range bindings.Keys {
+		for _, keyName := range keys {
+			key, err := parseKey(keyName)
+			if err != nil {
+				return nil, err
+			}
+			in.keys[key] = in.keys[key].add(name)
+		}
+	}
+	for name, buttons := range bindings.Gamepad {
+		for _, buttonName := range buttons {
+			button, ok := gamepadButtonNames[buttonName]
+			if !ok {
+				return nil, fmt.Errorf("unknown gamepad button %q", buttonName)
+			}
+			in.gamepad[button] = in.gamepad[button].add(name)
+		}
+	}
+	for action, keyName := range hotkeys {
+		key, err := parseKey(keyName)
+		if err != nil {
+			return nil, err
+		}
+		in.hotkeys[action] = key
+	}
+	return in, nil
+}
+
+func parseKey(name string) (ebiten.Key, error) {
+	var key ebiten.Key
+	if err := key.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown key %q", name)
+	}
+	return key, nil
+}
+
+// Return the joypad buttons and the turbo buttons held at the moment, on the keyboard or any gamepad with the
+// standard layout.
+func (in *Input) buttons() (buttons uint8, turbo uint8) {
+	in.pressed = inpututil.AppendPressedKeys(in.pressed[:0])
+	for _, key := range in.pressed {
+		buttons |= in.keys[key].buttons
+		turbo |= in.keys[key].turbo
+	}
+	in.gamepads = ebiten.AppendGamepadIDs(in.gamepads[:0])
+	for _, id := range in.gamepads {
+		if !ebiten.IsStandardGamepadLayoutAvailable(id) {
+			continue
+		}
+		for button, b := range in.gamepad {
+			if ebiten.IsStandardGamepadButtonPressed(id, button) {
+				buttons |= b.buttons
+				turbo |= b.turbo
+			}
+		}
+	}
+	return buttons, turbo
+}
+
+// Report whether the key of the hotkey was pressed in this frame.
+func (in *Input) justPressed(hotkey string) bool {
+	key, ok := in.hotkeys[hotkey]
+	return ok && inpututil.IsKeyJustPressed(key)
+}
+
+// Return the name of the key of the hotkey, to show it.
+func (in *Input) keyName(hotkey string) string {
+	key, ok := in.hotkeys[hotkey]
+	if !ok {
+		return "-"
+	}
+	return key.String()
+}
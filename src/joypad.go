@@ -0,0 +1,92 @@
+package main
+
+// The eight buttons are wired as a 2x4 matrix, read through P1 (0xff00). The game selects a row by pulling
+// bit 4 or 5 low and reads the buttons of that row in bits 3 - 0, where a pressed button reads as 0:
+//
+//  -------------------------------------------------------
+// | bit 5 | select action buttons                         |
+// | bit 4 | select direction buttons                      |
+// | bit 3 | down  / start                                 |
+// | bit 2 | up    / select                                |
+// | bit 1 | left  / B                                     |
+// | bit 0 | right / A                                     |
+//  -------------------------------------------------------
+//
+// With both rows selected the lines read the buttons of both ANDed together. Whenever one of the lines
+// goes from high to low, through pressing a button or selecting a row with a pressed button, the joypad
+// interrupt is requested.
+//
+// Pressing left and right or up and down at the same time isn't possible on the real direction pad, and
+// some games misbehave when they see it. Unless allowOpposite is set such combinations are filtered out by
+// releasing both directions.
+
+// Buttons as the bits of Joypad.buttons, a set bit means pressed. The directions match the lines of P1 when
+// selecting the direction buttons, the action buttons when shifted right by 4.
+const (
+	buttonRight = 1 << iota
+	buttonLeft
+	buttonUp
+	buttonDown
+	buttonA
+	buttonB
+	buttonSelect
+	buttonStart
+)
+
+type Joypad struct {
+	// bits 5 - 4 of P1 as written by the game
+	selected uint8
+	buttons  uint8
+	// lines at the last check for the interrupt
+	lines uint8
+
+	allowOpposite bool
+}
+
+func newJoypad() *Joypad {
+	return &Joypad{selected: 0x30, lines: 0x0f}
+}
+
+func (j *Joypad) read() uint8 {
+	return 0xc0 | j.selected | j.currentLines()
+}
+
+func (j *Joypad) write(mem *Memory, val uint8) {
+	j.selected = val & 0x30
+	j.update(mem)
+}
+
+// Set the pressed buttons.
+func (j *Joypad) press(mem *Memory, buttons uint8) {
+	if !j.allowOpposite {
+		if buttons&(buttonLeft|buttonRight) == buttonLeft|buttonRight {
+			buttons &^= buttonLeft | buttonRight
+		}
+		if buttons&(buttonUp|buttonDown) == buttonUp|buttonDown {
+			buttons &^= buttonUp | buttonDown
+		}
+	}
+	j.buttons = buttons
+	j.update(mem)
+}
+
+// Return the lines in bits 3 - 0 of P1 for the selected rows.
+func (j *Joypad) currentLines() uint8 {
+	lines := uint8(0x0f)
+	if j.selected&0x10 == 0 {
+		lines &^= j.buttons & 0x0f
+	}
+	if j.selected&0x20 == 0 {
+		lines &^= j.buttons >> 4
+	}
+	return lines
+}
+
+// Request the interrupt if a line went low.
+func (j *Joypad) update(mem *Memory) {
+	lines := j.currentLines()
+	if j.lines&^lines != 0 {
+		mem.requestInterrupt(intJoypad)
+	}
+	j.lines = lines
+}
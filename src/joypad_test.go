@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+// Test that P1 shows the buttons of the selected rows
+func TestJoypadRows(t *testing.T) {
+	mem := newMemory(nil)
+	mem.joypad.press(mem, buttonUp|buttonA|buttonStart)
+
+	mem.Write(0xff00, 0x20) // directions
+	if val := mem.Read(0xff00); val != 0xeb {
+		t.Errorf("Expected up pressed 0xEB but got 0x%X", val)
+	}
+	mem.Write(0xff00, 0x10) // actions
+	if val := mem.Read(0xff00); val != 0xd6 {
+		t.Errorf("Expected A and start pressed 0xD6 but got 0x%X", val)
+	}
+	mem.Write(0xff00, 0x00)
+	if val := mem.Read(0xff00); val != 0xc2 {
+		t.Errorf("Expected both rows ANDed 0xC2 but got 0x%X", val)
+	}
+	mem.Write(0xff00, 0x30)
+	if val := mem.Read(0xff00); val != 0xff {
+		t.Errorf("Expected no row selected 0xFF but got 0x%X", val)
+	}
+}
+
+// Test that the interrupt is requested when a line goes low
+func TestJoypadInterrupt(t *testing.T) {
+	mem := newMemory(nil)
+	mem.Write(0xff00, 0x20)
+	mem.joypad.press(mem, buttonA)
+	if mem.ram[0xff0f]&intJoypad != 0 {
+		t.Errorf("A button of the unselected row shouldn't request the interrupt")
+	}
+	mem.joypad.press(mem, buttonA|buttonDown)
+	if mem.ram[0xff0f]&intJoypad == 0 {
+		t.Errorf("Pressing a button of the selected row should request the interrupt")
+	}
+
+	mem.ram[0xff0f] = 0
+	mem.joypad.press(mem, buttonA)
+	if mem.ram[0xff0f]&intJoypad != 0 {
+		t.Errorf("Releasing a button shouldn't request the interrupt")
+	}
+	mem.Write(0xff00, 0x10)
+	if mem.ram[0xff0f]&intJoypad == 0 {
+		t.Errorf("Selecting a row with a pressed button should request the interrupt")
+	}
+}
+
+// Test that opposite directions are filtered unless allowed
+func TestJoypadOpposite(t *testing.T) {
+	mem := newMemory(nil)
+	mem.Write(0xff00, 0x20)
+	mem.joypad.press(mem, buttonLeft|buttonRight|buttonUp)
+	if val := mem.Read(0xff00); val != 0xeb {
+		t.Errorf("Left and right should be dropped. Expected 0xEB but got 0x%X", val)
+	}
+
+	mem.joypad.allowOpposite = true
+	mem.joypad.press(mem, buttonLeft|buttonRight|buttonUp)
+	if val := mem.Read(0xff00); val != 0xe8 {
+		t.Errorf("Left and right should be allowed. Expected 0xE8 but got 0x%X", val)
+	}
+}
+
+// Test that pressing a button wakes up a halted CPU and calls the joypad interrupt handler
+func TestJoypadInterruptHandler(t *testing.T) {
+	initOpCodes()
+	cart := testCartridge()
+	copy(cart.rom[0x0100:], []uint8{0xfb, 0x76, 0x18, 0xfd}) // EI, HALT, JR -3
+	gb := newGameboy(DMG, cart, nil)
+	gb.mem.Write(0xff00, 0x10)
+	gb.mem.Write(0xffff, intJoypad)
+
+	for i := 0; i < 10; i++ {
+		gb.step()
+	}
+	if gb.cpu.PC != 0x0102 || !gb.cpu.halted {
+		t.Fatalf("The CPU should be halted. Got PC 0x%X", gb.cpu.PC)
+	}
+	gb.mem.joypad.press(gb.mem, buttonStart)
+	gb.step()
+	if gb.cpu.PC != 0x0060 || gb.mem.ram[0xff0f]&intJoypad != 0 {
+		t.Errorf("The joypad interrupt should call 0x60. Got PC 0x%X, IF 0x%X", gb.cpu.PC, gb.mem.ram[0xff0f])
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+)
+
+// The link cable connects the serial ports of two gbemu processes over TCP. Both sides count the dots they
+// have run since the connection was made and keep each other up to date with sync messages. Neither side
+// may run more than linkWindow dots ahead of the last time it heard of, it stalls until the other side has
+// caught up. Every message is 10 bytes:
+//
+//  ---------------------------------------------------------------------
+// | byte 0     | kind: 'S' sync, 'T' transfer, 'R' reply to a transfer, |
+// |            | 'I' infrared LED switched                              |
+// | byte 1 - 8 | dots of the sender, big endian                         |
+// | byte 9     | the byte shifted out, or 1 if the LED was switched on  |
+//  ---------------------------------------------------------------------
+//
+// The side starting a transfer with the internal clock sends its byte along with the time, and waits for
+// the reply. The other side shifts the byte in once it has reached the same time, and replies with the byte
+// it shifted out, or 0xff if it wasn't waiting for a transfer. So latency only ever stalls the emulation and
+// never changes what is transferred. When the connection is lost both sides go on without a cable.
+//
+// The infrared port of the CGB uses the same connection. The light of the other side changes on the receiver
+// at the time the LED was switched. While a game reads the receiver its side sends a sync every irQuantum
+// dots and doesn't run ahead of the other side at all, so the changes are never more than irQuantum dots
+// late.
+
+const (
+	// dots between two sync messages
+	linkQuantum = 2048
+	// dots a side may run ahead of the other
+	linkWindow = 4 * linkQuantum
+
+	linkMessageSize = 10
+
+	// dots between two sync messages while the infrared receiver is read
+	irQuantum = 64
+)
+
+type linkMessage struct {
+	kind uint8
+	time uint64
+	data uint8
+}
+
+type Link struct {
+	conn     net.Conn
+	incoming chan linkMessage
+	// nil for the links of the four player adapter, which only clocks the other side
+	mem      *Memory
+	infrared *Infrared
+
+	// dots run since the connection was made
+	now      uint64
+	peerTime uint64
+	nextSync uint64
+	// transfers of the other side which are not due yet
+	pending []linkMessage
+}
+
+// Connect the Game Boy to the other side of the connection.
+func newLink(conn net.Conn, mem *Memory) *Link {
+	l := &Link{conn: conn, incoming: make(chan linkMessage, 64), mem: mem}
+	if mem != nil {
+		l.infrared = mem.infrared
+	}
+	go l.readMessages(conn)
+	return l
+}
+
+// Wait for the other side to connect on the address.
+func listenLink(addr string, mem *Memory) (*Link, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	log.Printf("waiting for the link cable partner on %s", listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newLink(conn, mem), nil
+}
+
+// Wait for the other players of the four player adapter to connect on the address.
+func listenAdapter(addr string, players int) ([]adapterPort, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	var ports []adapterPort
+	for len(ports) < players-1 {
+		log.Printf("waiting for player %d on %s", len(ports)+2, listener.Addr())
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, newLink(conn, nil))
+	}
+	return ports, nil
+}
+
+func dialLink(addr string, mem *Memory) (*Link, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newLink(conn, mem), nil
+}
+
+// Read the messages on a goroutine of its own, which only shares the channel with the rest.
+func (l *Link) readMessages(conn net.Conn) {
+	defer close(l.incoming)
+	var buf [linkMessageSize]uint8
+	for {
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return
+		}
+		l.incoming <- linkMessage{kind: buf[0], time: binary.BigEndian.Uint64(buf[1:9]), data: buf[9]}
+	}
+}
+
+func (l *Link) send(kind uint8, data uint8) {
+	if l.conn == nil {
+		return
+	}
+	var buf [linkMessageSize]uint8
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], l.now)
+	buf[9] = data
+	if _, err := l.conn.Write(buf[:]); err != nil {
+		l.disconnect(err)
+	}
+}
+
+func (l *Link) disconnect(err error) {
+	if l.conn == nil {
+		return
+	}
+	if err != nil {
+		log.Printf("link cable: %v", err)
+	} else {
+		log.Print("link cable: connection closed")
+	}
+	l.conn.Close()
+	l.conn = nil
+	l.pending = nil
+	if l.infrared != nil {
+		l.infrared.received = false
+	}
+}
+
+func (l *Link) close() {
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// Advance the time of the link, stalling while the other side is too far behind. The transfers are shifted
+// into l.mem, which is the memory given here.
+func (l *Link) tick(mem *Memory, dots int) {
+	l.now += uint64(dots)
+	if l.now >= l.nextSync {
+		quantum, window := uint64(linkQuantum), uint64(linkWindow)
+		if l.infrared != nil && l.infrared.reading() {
+			quantum, window = irQuantum, 0
+		}
+		l.nextSync = l.now + quantum
+		l.send('S', 0)
+		l.poll()
+		for l.conn != nil && l.now > l.peerTime+window {
+			l.wait()
+		}
+	}
+	if len(l.pending) > 0 {
+		l.applyPending()
+	}
+}
+
+// Handle the messages which have arrived, without waiting.
+func (l *Link) poll() {
+	for l.conn != nil {
+		select {
+		case msg, ok := <-l.incoming:
+			if !ok {
+				l.disconnect(nil)
+				return
+			}
+			l.handle(msg)
+		default:
+			return
+		}
+	}
+}
+
+// Wait for the next message and handle it. Returns the data of a reply.
+func (l *Link) wait() (reply uint8, ok bool) {
+	msg, open := <-l.incoming
+	if !open {
+		l.disconnect(nil)
+		return 0xff, false
+	}
+	if msg.kind == 'R' {
+		return msg.data, true
+	}
+	l.handle(msg)
+	return 0, false
+}
+
+func (l *Link) handle(msg linkMessage) {
+	if msg.time > l.peerTime {
+		l.peerTime = msg.time
+	}
+	if msg.kind == 'T' || msg.kind == 'I' {
+		l.pending = append(l.pending, msg)
+		l.applyPending()
+	}
+}
+
+// Shift in the transfers and switch the light of the other side which are due.
+func (l *Link) applyPending() {
+	for len(l.pending) > 0 && l.pending[0].time <= l.now {
+		msg := l.pending[0]
+		l.pending = l.pending[1:]
+		if msg.kind == 'I' {
+			if l.infrared != nil {
+				l.infrared.received = msg.data != 0
+			}
+			continue
+		}
+		out := uint8(0xff)
+		if l.mem != nil {
+			out = l.mem.serial.receive(l.mem, msg.data)
+		}
+		l.send('R', out)
+	}
+}
+
+// The LED of the Game Boy was switched.
+func (l *Link) light(on bool) {
+	var data uint8
+	if on {
+		data = 1
+	}
+	l.send('I', data)
+}
+
+// The Game Boy starts a transfer with the internal clock. Stall until the other side replied.
+func (l *Link) exchange(out uint8) uint8 {
+	l.send('T', out)
+	for l.conn != nil {
+		l.flushPending()
+		if reply, ok := l.wait(); ok {
+			return reply
+		}
+	}
+	return 0xff
+}
+
+// A link plugged into the four player adapter is clocked by it, like a Game Boy starting a transfer.
+func (l *Link) transfer(in uint8) uint8 {
+	return l.exchange(in)
+}
+
+// Shift in all transfers of the other side right away. Both sides would wait for each other otherwise, when
+// the other side started a transfer ahead of the own one.
+func (l *Link) flushPending() {
+	for i := range l.pending {
+		if l.pending[i].time > l.now {
+			l.pending[i].time = l.now
+		}
+	}
+	l.applyPending()
+}
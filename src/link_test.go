@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start a transfer, run the Game Boy side of a link for the given M-cycles, then hang up.
+func runLink(mem *Memory, link *Link, sb, sc uint8, cycles int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	mem.Write(0xff01, sb)
+	mem.Write(0xff02, sc)
+	for i := 0; i < cycles; i++ {
+		mem.serial.tick(mem)
+		link.tick(mem, 4)
+	}
+	link.close()
+}
+
+// Test a transfer between two linked Game Boys, where the side with the external clock starts late
+func TestLinkTransfer(t *testing.T) {
+	connA, connB := net.Pipe()
+	memA, memB := newMemory(nil), newMemory(nil)
+	linkA, linkB := newLink(connA, memA), newLink(connB, memB)
+	memA.serial.connect(linkA)
+	memB.serial.connect(linkB)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go runLink(memA, linkA, 0x12, 0x81, 20000, &wg)
+	time.Sleep(20 * time.Millisecond)
+	go runLink(memB, linkB, 0x34, 0x80, 20000, &wg)
+	wg.Wait()
+
+	if memA.serial.sb != 0x34 || memB.serial.sb != 0x12 {
+		t.Errorf("Expected 0x34 and 0x12 exchanged but got 0x%X and 0x%X", memA.serial.sb, memB.serial.sb)
+	}
+	for i, mem := range []*Memory{memA, memB} {
+		if mem.serial.sc&0x80 != 0 || mem.ram[0xff0f]&intSerial == 0 {
+			t.Errorf("Side %d: the transfer should be finished with the interrupt", i)
+		}
+	}
+}
+
+// Test that the LED switched on one side changes the light on the other side at the same time
+func TestLinkInfrared(t *testing.T) {
+	connA, connB := net.Pipe()
+	memA, memB := infraredTestMemory(), infraredTestMemory()
+	linkA, linkB := newLink(connA, memA), newLink(connB, memB)
+	memA.infrared.peer = linkA
+	memB.infrared.peer = linkB
+
+	const cycles = 20000
+	var switched, received uint64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < cycles; i++ {
+			if i == 5000 {
+				switched = linkA.now
+				memA.Write(0xff56, 0x01)
+			}
+			linkA.tick(memA, 4)
+		}
+		linkA.close()
+	}()
+	go func() {
+		defer wg.Done()
+		memB.Write(0xff56, 0xc0)
+		for i := 0; i < cycles; i++ {
+			if received == 0 && memB.Read(0xff56)&0x02 == 0 {
+				received = linkB.now
+			}
+			linkB.tick(memB, 4)
+		}
+		linkB.close()
+	}()
+	wg.Wait()
+
+	if received < switched || received > switched+irQuantum {
+		t.Errorf("Expected the light at dot %d but got it at dot %d", switched, received)
+	}
+}
@@ -1,53 +1,445 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 )
 
+// Frames between the checks whether the config file changed.
+const configCheckFrames = 60
+
 type Game struct {
-	cpu Cpu
+	gb       *Gameboy
+	display  *Display
+	audio    *Audio
+	input    *Input
+	controls *Controls
+
+	// show the register overlay on top of the screen
+	debug bool
+	// start of the file names of sound recordings made with the hotkey
+	recordingName string
+
+	config *configWatch
 }
 
 func (g *Game) Update() error {
+	if g.input.justPressed(hotkeyFullscreen) {
+		ebiten.SetFullscreen(!ebiten.IsFullscreen())
+	}
+	if g.input.justPressed(hotkeyDisplay) {
+		g.display.mode = g.display.mode.next()
+	}
+	if g.input.justPressed(hotkeyOverlay) {
+		g.debug = !g.debug
+	}
+	updateVolume(g.input, g.audio)
+	if g.input.justPressed(hotkeyRecord) {
+		g.toggleRecording()
+	}
+	if g.input.justPressed(hotkeyVgm) {
+		g.toggleVgm()
+	}
+	if config, input := g.config.update(g.input, g.gb.mem.cart); config != nil {
+		g.input = input
+		g.controls.turboRate = config.TurboRate
+	}
+
+	if g.input.justPressed(hotkeyMacroRec) {
+		g.controls.toggleRecording()
+	}
+	if g.input.justPressed(hotkeyMacroPlay) {
+		g.controls.replay()
+	}
+
+	g.gb.mem.joypad.press(g.gb.mem, g.controls.next(g.input.buttons()))
+	if err := g.gb.runFrame(); err != nil {
+		return err
+	}
+	g.audio.push(g.gb.apu.takeSamples())
 	return nil
 }
 
 func (g *Game) Draw(screen *ebiten.Image) {
-	printDebug(g, screen)
+	g.display.draw(screen, g.gb.frame())
+	if g.debug {
+		printDebug(g, screen)
+	}
+}
+
+// Handle the hotkeys for mute and volume.
+func updateVolume(input *Input, audio *Audio) {
+	if input.justPressed(hotkeyMute) {
+		audio.buffer.toggleMute()
+	}
+	if input.justPressed(hotkeyVolumeDown) {
+		audio.buffer.changeVolume(-0.1)
+	}
+	if input.justPressed(hotkeyVolumeUp) {
+		audio.buffer.changeVolume(0.1)
+	}
+}
+
+// Return the modification time of the config file, zero if it doesn't exist.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// configWatch reloads the config file with the reload hotkey and whenever it changes.
+type configWatch struct {
+	path string
+	// modification time of the config file when it was loaded
+	time   time.Time
+	frames int
+}
 
+func newConfigWatch(path string) *configWatch {
+	return &configWatch{path: path, time: modTime(path)}
+}
+
+// Called once per frame, loads the config file again when it's due and resolves the bindings for the
+// cartridge. Returns nil unless it was loaded, on errors the old bindings are kept.
+func (w *configWatch) update(input *Input, cart *Cartridge) (*Config, *Input) {
+	w.frames++
+	if !input.justPressed(hotkeyReload) && (w.frames%configCheckFrames != 0 || modTime(w.path).Equal(w.time)) {
+		return nil, nil
+	}
+	w.time = modTime(w.path)
+	config, err := loadConfig(w.path)
+	if err != nil {
+		log.Print(err)
+		return nil, nil
+	}
+	input, err = newInput(config.bindings(cart), config.Hotkeys)
+	if err != nil {
+		log.Printf("%s: %v", w.path, err)
+		return nil, nil
+	}
+	log.Printf("loaded %s", w.path)
+	return config, input
+}
+
+// Load the config file and resolve the bindings for the cartridge.
+func loadInput(path string, cart *Cartridge) (*Input, *Controls, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	input, err := newInput(config.bindings(cart), config.Hotkeys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return input, newControls(config.TurboRate), nil
 }
 
 func printDebug(g *Game, screen *ebiten.Image) {
-	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("AF: %.4x %.16b", g.cpu.AF, g.cpu.AF), 0, 0)
-	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("BC: %.4x %.16b", g.cpu.BC, g.cpu.BC), 0, 15)
-	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("DE: %.4x %.16b", g.cpu.DE, g.cpu.DE), 0, 30)
-	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("HL: %.4x %.16b", g.cpu.HL, g.cpu.HL), 0, 45)
-	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("PC: %.4x %.16b", g.cpu.PC, g.cpu.PC), 0, 70)
-	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("SP: %.4x %.16b", g.cpu.SP, g.cpu.SP), 0, 85)
+	cpu := g.gb.cpu
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("AF: %.4x %.16b", cpu.AF, cpu.AF), 0, 0)
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("BC: %.4x %.16b", cpu.BC, cpu.BC), 0, 15)
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("DE: %.4x %.16b", cpu.DE, cpu.DE), 0, 30)
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("HL: %.4x %.16b", cpu.HL, cpu.HL), 0, 45)
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("PC: %.4x %.16b", cpu.PC, cpu.PC), 0, 70)
+	ebitenutil.DebugPrintAt(screen, fmt.Sprintf("SP: %.4x %.16b", cpu.SP, cpu.SP), 0, 85)
+}
+
+// Start or stop recording the sound. Every recording gets files of its own, named after the ROM and the time.
+func (g *Game) toggleRecording() {
+	if g.gb.apu.recorder != nil {
+		g.stopRecording()
+		return
+	}
+	path := fmt.Sprintf("%s-%s.wav", g.recordingName, time.Now().Format("20060102-150405"))
+	if err := g.startRecording(path); err != nil {
+		log.Print(err)
+	}
+}
+
+func (g *Game) startRecording(path string) error {
+	recorder, err := newWavRecorder(path, defaultSampleRate)
+	if err != nil {
+		return err
+	}
+	g.gb.apu.recorder = recorder
+	log.Printf("recording sound to %s", path)
+	return nil
+}
+
+func (g *Game) stopRecording() {
+	if g.gb.apu.recorder == nil {
+		return
+	}
+	if err := g.gb.apu.recorder.close(); err != nil {
+		log.Print(err)
+	}
+	g.gb.apu.recorder = nil
+}
+
+// Start or stop logging the sound registers, into files named like the sound recordings.
+func (g *Game) toggleVgm() {
+	if g.gb.apu.vgm != nil {
+		g.stopVgm()
+		return
+	}
+	path := fmt.Sprintf("%s-%s.vgm", g.recordingName, time.Now().Format("20060102-150405"))
+	if err := g.startVgm(path); err != nil {
+		log.Print(err)
+	}
+}
+
+func (g *Game) startVgm(path string) error {
+	logger, err := createVgm(path)
+	if err != nil {
+		return err
+	}
+	logger.writeState(g.gb.apu)
+	g.gb.apu.vgm = logger
+	log.Printf("logging sound registers to %s", path)
+	return nil
+}
+
+func (g *Game) stopVgm() {
+	if g.gb.apu.vgm == nil {
+		return
+	}
+	if err := g.gb.apu.vgm.close(); err != nil {
+		log.Print(err)
+	}
+	g.gb.apu.vgm = nil
 }
 
+// Set up the synthesis and the high-pass filter of the APU from the command line.
+func setupSound(apu *Apu, synth string, highPassName string, model Model) error {
+	apu.blep = nil
+	if synth == "blep" {
+		apu.blep = newBlepSynth()
+	}
+	var err error
+	apu.highPass, err = parseHighPass(highPassName, model, apu.sampleRate)
+	return err
+}
+
+// Use the full resolution of the window, so the scaling of the emulated screen is up to the display.
 func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
-	return 320, 240
+	scale := ebiten.DeviceScaleFactor()
+	return int(float64(outsideWidth) * scale), int(float64(outsideHeight) * scale)
 }
 
 func main() {
-	ebiten.SetWindowSize(640, 480)
+	romPath := flag.String("rom", "", "path to the cartridge ROM")
+	bootROMPath := flag.String("bootrom", "", "path to a boot ROM of the selected model (optional)")
+	modelName := flag.String("model", "dmg", "hardware model: dmg, mgb, sgb, sgb2, cgb or agb")
+	combo := flag.String("palette", "", "colors of DMG games on the CGB, chosen like the button combination held during boot, e.g. up+a (default: by title)")
+	renderer := flag.String("ppu", "scanline", "PPU renderer: scanline (fast) or fifo (accurate mid-line effects)")
+	displayMode := flag.String("display", "integer", "scaling of the screen: integer, aspect or stretch")
+	windowScale := flag.Int("scale", 3, "initial window size as a multiple of the screen size")
+	fullscreen := flag.Bool("fullscreen", false, "start in fullscreen mode")
+	debug := flag.Bool("debug", false, "show the CPU registers on top of the screen")
+	volume := flag.Int("volume", 100, "master volume in percent")
+	mute := flag.Bool("mute", false, "start with the sound muted")
+	synth := flag.String("synth", "blep", "sound synthesis: blep (band-limited) or sample (plain sampling, aliases)")
+	highPassName := flag.String("highpass", "model", "high-pass filter on the sound output: model, dmg, cgb or off")
+	wavPath := flag.String("wav", "", "record the sound from the start into this WAV file and one file per channel")
+	vgmPath := flag.String("vgm", "", "log the sound register writes from the start into this VGM file")
+	track := flag.Int("track", 0, "GBS files: song to start with (default: the first song of the file)")
+	gbsLength := flag.Int("length", defaultGbsLength, "GBS files: seconds a song plays before it fades out")
+	gbsFade := flag.Int("fade", defaultGbsFade, "GBS files: seconds of the fade-out at the end of a song")
+	loop := flag.Bool("loop", false, "GBS files: start the song over instead of moving on to the next one")
+	defaultConfigPath, err := configPath()
+	if err != nil {
+		defaultConfigPath = "config.json"
+	}
+	configFile := flag.String("config", defaultConfigPath, "path to the config file with the key, gamepad and hotkey bindings")
+	serialOutput := flag.Bool("serial-output", false, "write the bytes sent over the serial port to standard output, e.g. the results of test ROMs")
+	linkListen := flag.String("link-listen", "", "wait for another gbemu to connect its link cable on this address, e.g. :5000")
+	linkConnect := flag.String("link-connect", "", "connect the link cable to another gbemu at this address, e.g. localhost:5000")
+	printer := flag.Bool("printer", false, "connect a Game Boy Printer, which saves the prints as PNG files named after the ROM")
+	dmg07 := flag.Int("dmg07", 0, "host a four player adapter for this many players (2 - 4) on the address of -link-listen, the others connect with -link-connect")
+	allowOpposite := flag.Bool("allow-opposite", false, "allow pressing left and right or up and down at the same time")
+	flag.Parse()
+
+	if *renderer != "scanline" && *renderer != "fifo" {
+		log.Fatalf("unknown PPU renderer %q", *renderer)
+	}
+	if *volume < 0 || *volume > 100 {
+		log.Fatalf("volume %d is not between 0 and 100", *volume)
+	}
+	if *printer && (*linkListen != "" || *linkConnect != "") {
+		log.Fatal("the printer and the link cable can't be connected at the same time")
+	}
+	if *synth != "blep" && *synth != "sample" {
+		log.Fatalf("unknown sound synthesis %q", *synth)
+	}
+
+	model, err := parseModel(*modelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scaleMode, err := parseScaleMode(*displayMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	combination := -1
+	if *combo != "" {
+		if combination, err = parseButtonCombo(*combo); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sound, err := newAudio(defaultSampleRate, float64(*volume)/100, *mute)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if strings.EqualFold(filepath.Ext(*romPath), ".gbs") {
+		player, err := loadGbs(*romPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *track < 0 || *track > int(player.header.Songs) {
+			log.Fatalf("song %d is not between 1 and %d, or 0 for the first song of the file", *track, player.header.Songs)
+		}
+		if err := setupSound(player.apu, *synth, *highPassName, model); err != nil {
+			log.Fatal(err)
+		}
+		player.length = *gbsLength * clockRate
+		player.fade = *gbsFade * clockRate
+		player.loop = *loop
+		if *track > 0 {
+			player.start(*track - 1)
+		}
+		input, _, err := loadInput(*configFile, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runGbs(player, sound, input, newConfigWatch(*configFile), *windowScale); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var cart *Cartridge
+	if *romPath != "" {
+		if cart, err = loadCartridge(*romPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var bootROM []uint8
+	if *bootROMPath != "" {
+		if bootROM, err = loadBootROM(*bootROMPath, model); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	input, controls, err := loadInput(*configFile, cart)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gb := newGameboy(model, cart, bootROM)
+	if gb.ppu.compat && combination >= 0 {
+		gb.ppu.loadCompatPalettes(combination)
+	}
+	if *renderer == "fifo" {
+		gb.ppu.fifo = newPixelFifo(gb.ppu)
+	}
+	if err := setupSound(gb.apu, *synth, *highPassName, model); err != nil {
+		log.Fatal(err)
+	}
+	gb.mem.joypad.allowOpposite = *allowOpposite
+	if *serialOutput {
+		gb.mem.serial.output = func(b uint8) {
+			os.Stdout.Write([]uint8{b})
+		}
+	}
+	var link *Link
+	var adapter *Dmg07
+	switch {
+	case *dmg07 != 0:
+		if *dmg07 < 2 || *dmg07 > adapterPlayers || *linkListen == "" {
+			log.Fatal("-dmg07 needs 2 to 4 players and -link-listen")
+		}
+		var ports []adapterPort
+		if ports, err = listenAdapter(*linkListen, *dmg07); err == nil {
+			adapter = newDmg07(append([]adapterPort{localPort{gb.mem}}, ports...)...)
+			gb.mem.serial.connect(adapter)
+		}
+	case *linkListen != "":
+		link, err = listenLink(*linkListen, gb.mem)
+	case *linkConnect != "":
+		link, err = dialLink(*linkConnect, gb.mem)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if link != nil {
+		gb.mem.serial.connect(link)
+		gb.mem.infrared.peer = link
+	}
+	width, height := gb.frameSize()
+
+	ebiten.SetWindowSize(*windowScale*width, *windowScale*height)
+	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
 	ebiten.SetWindowTitle("gbemu")
+	ebiten.SetFullscreen(*fullscreen)
 
-	cpu := Cpu{
-		AF: 0x1c1f,
-		BC: 0x0001,
-		DE: 0xcfcf,
-		HL: 0x1234,
-		PC: 0xff01,
-		SP: 0xcc12,
+	recordingName := "gbemu"
+	if *romPath != "" {
+		recordingName = strings.TrimSuffix(*romPath, filepath.Ext(*romPath))
+	}
+	var gbPrinter *Printer
+	if *printer {
+		gbPrinter = newPrinter(fmt.Sprintf("%s-print-%s", recordingName, time.Now().Format("20060102-150405")))
+		gb.mem.serial.connect(gbPrinter)
 	}
 
-	if err := ebiten.RunGame(&Game{cpu: cpu}); err != nil {
+	game := &Game{
+		gb:            gb,
+		display:       newDisplay(scaleMode, width, height),
+		audio:         sound,
+		input:         input,
+		controls:      controls,
+		debug:         *debug,
+		recordingName: recordingName,
+		config:        newConfigWatch(*configFile),
+	}
+	if *wavPath != "" {
+		if err := game.startRecording(*wavPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *vgmPath != "" {
+		if err := game.startVgm(*vgmPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = ebiten.RunGame(game)
+	game.stopRecording()
+	game.stopVgm()
+	if link != nil {
+		link.close()
+	}
+	if adapter != nil {
+		adapter.close()
+	}
+	if gbPrinter != nil {
+		if err := gbPrinter.close(); err != nil {
+			log.Print(err)
+		}
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
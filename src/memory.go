@@ -1,9 +1,241 @@
 package main
 
+// The Gameboy has a 16-bit address bus which is mapped as follows:
+//
+//  ---------------------------------------------
+// | 0x0000 - 0x7fff | cartridge ROM              |
+// | 0x8000 - 0x9fff | video RAM                  |
+// | 0xa000 - 0xbfff | cartridge RAM              |
+// | 0xc000 - 0xcfff | work RAM bank 0            |
+// | 0xd000 - 0xdfff | work RAM bank 1 - 7 (*)    |
+// | 0xe000 - 0xfdff | echo of work RAM           |
+// | 0xfe00 - 0xfe9f | object attribute memory    |
+// | 0xff00 - 0xff7f | I/O registers              |
+// | 0xff80 - 0xfffe | high RAM                   |
+// | 0xffff          | interrupt enable register  |
+//  ---------------------------------------------
+//
+// (*) The DMG only has bank 1. In CGB mode SVBK (0xff70) selects the bank, selecting bank 0 gives bank 1.
+//
+// Until the boot ROM unmaps itself by writing to 0xff50, it is mapped over the start of the cartridge ROM.
+// Everything without a component attached to it is backed by ram.
+//
+// Read and Write are the accesses of the CPU, which have to go through the bus arbitration of the DMA unit
+// and are locked out of video RAM and OAM while the PPU is using them.
+
+// Interrupt flags in the IF (0xff0f) and IE (0xffff) registers
+const (
+	intVBlank = 1 << 0
+	intStat   = 1 << 1
+	intTimer  = 1 << 2
+	intSerial = 1 << 3
+	intJoypad = 1 << 4
+)
+
 type Memory struct {
 	ram []uint8
+
+	cart     *Cartridge
+	bootROM  []uint8
+	dma      *Dma
+	timer    *Timer
+	serial   *Serial
+	joypad   *Joypad
+	ppu      *Ppu
+	speed    *Speed
+	hdma     *Hdma
+	infrared *Infrared
+	sgb      *Sgb
+	apu      *Apu
+	gbs      *GbsRom
+
+	// CGB mode registers and work RAM banks 2 - 7, bank 1 is backed by ram
+	cgb  bool
+	svbk uint8
+	wram [6][0x1000]uint8
+}
+
+func newMemory(cart *Cartridge) *Memory {
+	return &Memory{ram: make([]uint8, 0x10000), cart: cart, dma: &Dma{}, timer: &Timer{}, serial: &Serial{}, joypad: newJoypad(), speed: &Speed{}, hdma: &Hdma{}, infrared: &Infrared{}}
 }
 
 func (mem *Memory) Read(addr uint16) uint8 {
+	if mem.dma != nil && mem.dma.conflicts(addr) {
+		return mem.dma.value
+	}
+	if mem.ppu != nil && mem.ppu.blocks(addr) {
+		return 0xff
+	}
+	return mem.read(addr)
+}
+
+// Read from the bus without any bus conflicts.
+func (mem *Memory) read(addr uint16) uint8 {
+	switch {
+	case mem.bootROMMapped(addr):
+		return mem.bootROM[addr]
+	case addr < 0x8000 && mem.cart != nil:
+		return mem.cart.read(addr)
+	case addr < 0x8000 && mem.gbs != nil:
+		return mem.gbs.read(addr)
+	case mem.ppu != nil && ppuAddr(addr):
+		return mem.ppu.read(addr)
+	case addr >= 0xd000 && addr < 0xe000 && mem.wramBank() > 1:
+		return mem.wram[mem.wramBank()-2][addr-0xd000]
+	case addr == 0xff00:
+		return mem.readP1()
+	case mem.apu != nil && apuAddr(addr):
+		return mem.apu.read(addr)
+	case (addr == 0xff01 || addr == 0xff02) && mem.serial != nil:
+		return mem.serial.read(addr, mem.cgb)
+	case addr >= 0xff04 && addr <= 0xff07 && mem.timer != nil:
+		return mem.timer.read(addr)
+	case addr == 0xff0f:
+		return mem.ram[addr] | 0xe0
+	case addr == 0xff4d && mem.speed != nil:
+		if !mem.cgb {
+			return 0xff
+		}
+		return mem.speed.read()
+	case addr >= 0xff51 && addr <= 0xff55 && mem.hdma != nil:
+		if !mem.cgb {
+			return 0xff
+		}
+		return mem.hdma.read(addr)
+	case addr == 0xff56 && mem.infrared != nil:
+		if !mem.cgb {
+			return 0xff
+		}
+		return mem.infrared.read()
+	case addr == 0xff70:
+		if !mem.cgb {
+			return 0xff
+		}
+		return 0xf8 | mem.svbk
+	}
 	return mem.ram[addr]
 }
+
+func (mem *Memory) Write(addr uint16, val uint8) {
+	if mem.dma != nil && mem.dma.conflicts(addr) {
+		return
+	}
+	if mem.ppu != nil && mem.ppu.blocks(addr) {
+		return
+	}
+
+	switch {
+	case addr < 0x8000 && mem.cart != nil:
+		// no memory bank controller, the cartridge ROM is read-only
+		return
+	case addr < 0x8000 && mem.gbs != nil:
+		mem.gbs.write(addr, val)
+		return
+	case mem.ppu != nil && ppuAddr(addr):
+		mem.ppu.write(addr, val)
+		return
+	case addr == 0xff00:
+		if mem.sgb != nil {
+			mem.sgb.writeP1(val)
+		}
+		if mem.joypad != nil {
+			mem.joypad.write(mem, val)
+		}
+	case mem.apu != nil && apuAddr(addr):
+		mem.apu.write(addr, val)
+		return
+	case (addr == 0xff01 || addr == 0xff02) && mem.serial != nil:
+		mem.serial.write(addr, val, mem.cgb)
+		return
+	case addr >= 0xff04 && addr <= 0xff07 && mem.timer != nil:
+		mem.timer.write(addr, val)
+		return
+	case addr == 0xff46 && mem.dma != nil:
+		mem.dma.start(val)
+	case addr == 0xff50 && val != 0:
+		mem.bootROM = nil
+	case addr >= 0xd000 && addr < 0xe000 && mem.wramBank() > 1:
+		mem.wram[mem.wramBank()-2][addr-0xd000] = val
+		return
+	case addr == 0xff4d && mem.speed != nil:
+		if mem.cgb {
+			mem.speed.write(val)
+		}
+		return
+	case addr >= 0xff51 && addr <= 0xff55 && mem.hdma != nil:
+		if mem.cgb {
+			mem.hdma.write(mem, addr, val)
+		}
+		return
+	case addr == 0xff56 && mem.infrared != nil:
+		if mem.cgb {
+			mem.infrared.write(val)
+		}
+		return
+	case addr == 0xff70:
+		if mem.cgb {
+			mem.svbk = val & 0x07
+		}
+		return
+	}
+	mem.ram[addr] = val
+}
+
+// Check whether the given address is currently served by the boot ROM. The DMG, MGB and SGB boot ROMs are
+// 256 bytes long. The CGB and AGB boot ROM is 2304 bytes long but leaves a gap at 0x0100 - 0x01ff to be able
+// to read the cartridge header.
+func (mem *Memory) bootROMMapped(addr uint16) bool {
+	if int(addr) >= len(mem.bootROM) {
+		return false
+	}
+	return addr < 0x0100 || addr >= 0x0200
+}
+
+// P1 shows the joypad, on the SGB replaced by the number of the current joypad while none of the button rows
+// is selected.
+func (mem *Memory) readP1() uint8 {
+	val := mem.ram[0xff00]
+	if mem.joypad != nil {
+		val = mem.joypad.read()
+	}
+	if mem.sgb != nil {
+		val = mem.sgb.readP1(val)
+	}
+	return val
+}
+
+// Return the work RAM bank mapped at 0xd000 - 0xdfff.
+func (mem *Memory) wramBank() uint8 {
+	if !mem.cgb || mem.svbk == 0 {
+		return 1
+	}
+	return mem.svbk
+}
+
+// Write a byte transferred by the OAM DMA.
+func (mem *Memory) writeOAM(index uint16, val uint8) {
+	if mem.ppu != nil {
+		mem.ppu.oam[index] = val
+		return
+	}
+	mem.ram[0xfe00+index] = val
+}
+
+// Write a byte transferred by the HDMA into the selected video RAM bank, regardless of the PPU mode.
+func (mem *Memory) writeVRAM(addr uint16, val uint8) {
+	if mem.ppu != nil {
+		mem.ppu.vram[mem.ppu.vbk][addr&0x1fff] = val
+		return
+	}
+	mem.ram[0x8000+(addr&0x1fff)] = val
+}
+
+// Set the given flag in the IF register.
+func (mem *Memory) requestInterrupt(flag uint8) {
+	mem.ram[0xff0f] |= flag
+}
+
+// Return the interrupts which are both requested in IF and enabled in IE.
+func (mem *Memory) pendingInterrupts() uint8 {
+	return mem.ram[0xff0f] & mem.ram[0xffff] & 0x1f
+}
@@ -0,0 +1,631 @@
+package main
+
+// The picture processing unit (PPU) draws the 160x144 pixel screen line by line. Every line takes 456 dots
+// (one dot per clock cycle) and goes through these modes:
+//
+//  -------------------------------------------------------------------
+// | mode 2 | OAM scan  |  80 dots | find the objects on the line        |
+// | mode 3 | drawing   | 172 dots | push the pixels to the LCD (*)      |
+// | mode 0 | HBlank    | 204 dots | rest of the line                    |
+// | mode 1 | VBlank    | 10 lines | lines 144 - 153, no drawing at all  |
+//  -------------------------------------------------------------------
+//
+// (*) 172 dots is the minimum, see ppu_fifo.go for what makes mode 3 longer.
+//
+// While in mode 3 the CPU cannot access video RAM, while in mode 2 and 3 it cannot access OAM.
+//
+// The screen is made of three layers: the scrollable 256x256 background, the window drawn on top of it
+// from (WX-7, WY) onwards and up to 40 objects (sprites), of which only 10 can be shown on a line.
+//
+// == LCDC register (0xff40) ==
+//
+//  ---------------------------------------------------------------
+// | bit 7 | LCD enable                                             |
+// | bit 6 | window tile map: 0 = 0x9800, 1 = 0x9c00               |
+// | bit 5 | window enable                                          |
+// | bit 4 | tile data: 0 = 0x8800 (signed), 1 = 0x8000 (unsigned) |
+// | bit 3 | background tile map: 0 = 0x9800, 1 = 0x9c00           |
+// | bit 2 | object size: 0 = 8x8, 1 = 8x16                         |
+// | bit 1 | object enable                                          |
+// | bit 0 | background and window enable                           |
+//  ---------------------------------------------------------------
+//
+// == STAT register (0xff41) ==
+//
+//  ---------------------------------------------------
+// | bit 6 | LYC=LY interrupt source                    |
+// | bit 5 | mode 2 interrupt source                    |
+// | bit 4 | mode 1 interrupt source                    |
+// | bit 3 | mode 0 interrupt source                    |
+// | bit 2 | LYC=LY flag (read-only)                    |
+// | 1 - 0 | current mode (read-only)                   |
+//  ---------------------------------------------------
+//
+// The interrupt sources are or'ed together into a single line, the STAT interrupt is only requested when
+// the line goes from low to high.
+//
+// The PPU owns the video RAM, OAM and the LCD registers 0xff40 - 0xff45 and 0xff47 - 0xff4b, plus the CGB
+// registers described in ppu_cgb.go.
+
+const (
+	screenWidth   = 160
+	screenHeight  = 144
+	dotsPerLine   = 456
+	linesPerFrame = 154
+
+	oamScanDots = 80
+	drawingDots = 172
+)
+
+// LCDC bits
+const (
+	lcdcBgEnable     = 1 << 0
+	lcdcObjEnable    = 1 << 1
+	lcdcObjSize      = 1 << 2
+	lcdcBgMap        = 1 << 3
+	lcdcTileData     = 1 << 4
+	lcdcWindowEnable = 1 << 5
+	lcdcWindowMap    = 1 << 6
+	lcdcEnable       = 1 << 7
+)
+
+// PPU modes
+const (
+	modeHBlank  = 0
+	modeVBlank  = 1
+	modeOAMScan = 2
+	modeDrawing = 3
+)
+
+// STAT bits
+const (
+	statLycFlag   = 1 << 2
+	statHBlankInt = 1 << 3
+	statVBlankInt = 1 << 4
+	statOAMInt    = 1 << 5
+	statLycInt    = 1 << 6
+)
+
+// Attribute bits of objects and, in CGB mode, of background tiles
+const (
+	attrCgbPalette = 0x07
+	attrBank       = 1 << 3
+	attrDmgPalette = 1 << 4
+	attrFlipX      = 1 << 5
+	attrFlipY      = 1 << 6
+	attrPriority   = 1 << 7
+)
+
+// Grey shades of the DMG LCD as RGB values, from white to black.
+var dmgShades = [4][3]uint8{
+	{0xff, 0xff, 0xff},
+	{0xaa, 0xaa, 0xaa},
+	{0x55, 0x55, 0x55},
+	{0x00, 0x00, 0x00},
+}
+
+// An entry of the object attribute memory.
+type object struct {
+	y     int
+	x     int
+	tile  uint8
+	attr  uint8
+	index int
+}
+
+type Ppu struct {
+	// The CGB has two banks of video RAM, the DMG only uses the first one.
+	vram [2][0x2000]uint8
+	oam  [oamSize]uint8
+
+	// registers
+	lcdc uint8
+	stat uint8
+	scy  uint8
+	scx  uint8
+	ly   uint8
+	lyc  uint8
+	bgp  uint8
+	obp0 uint8
+	obp1 uint8
+	wy   uint8
+	wx   uint8
+
+	// CGB mode, or DMG compatibility mode of a CGB mapping the DMG shades to colors in palette RAM
+	cgb         bool
+	compat      bool
+	vbk         uint8
+	bcps        uint8
+	ocps        uint8
+	bgPalettes  [64]uint8
+	objPalettes [64]uint8
+
+	mode uint8
+	dot  int
+
+	// The window has its own line counter, which only advances on lines the window was drawn on.
+	windowLine int
+	// set once WY matched LY during the frame
+	windowY bool
+
+	// objects on the current line, found during the OAM scan
+	objects []object
+
+	// state of the STAT interrupt line
+	statLine bool
+
+	// Pixel FIFO drawing the line dot by dot. Without it, the whole line is drawn at once at the end of
+	// mode 3, which is faster but misses register changes in the middle of the line.
+	fifo *pixelFifo
+
+	// shade (0-3) of every pixel on the screen, as picked by the palettes
+	shades [screenWidth * screenHeight]uint8
+	// RGBA pixels of the frame being drawn and of the last finished frame
+	back  [screenWidth * screenHeight * 4]uint8
+	front [screenWidth * screenHeight * 4]uint8
+
+	mem *Memory
+}
+
+func newPpu(mem *Memory) *Ppu {
+	return &Ppu{mem: mem, objects: make([]object, 0, 10)}
+}
+
+// Return the last finished frame as RGBA pixels.
+func (ppu *Ppu) frame() []uint8 {
+	return ppu.front[:]
+}
+
+// Check whether the given address belongs to the PPU.
+func ppuAddr(addr uint16) bool {
+	return (addr >= 0x8000 && addr < 0xa000) ||
+		(addr >= 0xfe00 && addr < 0xfea0) ||
+		(addr >= 0xff40 && addr <= 0xff4b && addr != 0xff46) ||
+		addr == 0xff4f || (addr >= 0xff68 && addr <= 0xff6b)
+}
+
+func (ppu *Ppu) enabled() bool {
+	return ppu.lcdc&lcdcEnable != 0
+}
+
+// Check whether the CPU is locked out of the given address by the current mode.
+func (ppu *Ppu) blocks(addr uint16) bool {
+	if !ppu.enabled() {
+		return false
+	}
+	switch {
+	case addr >= 0x8000 && addr < 0xa000:
+		return ppu.mode == modeDrawing
+	case addr >= 0xfe00 && addr < 0xfea0:
+		return ppu.mode == modeDrawing || ppu.mode == modeOAMScan
+	case addr == 0xff69 || addr == 0xff6b:
+		return ppu.mode == modeDrawing
+	}
+	return false
+}
+
+func (ppu *Ppu) read(addr uint16) uint8 {
+	switch {
+	case addr >= 0x8000 && addr < 0xa000:
+		return ppu.vram[ppu.vbk][addr-0x8000]
+	case addr >= 0xfe00 && addr < 0xfea0:
+		return ppu.oam[addr-0xfe00]
+	case addr == 0xff4f || addr >= 0xff68:
+		return ppu.readCgb(addr)
+	}
+
+	switch addr {
+	case 0xff40:
+		return ppu.lcdc
+	case 0xff41:
+		stat := 0x80 | ppu.stat&0x78
+		if ppu.ly == ppu.lyc {
+			stat |= statLycFlag
+		}
+		if ppu.enabled() {
+			stat |= ppu.mode
+		}
+		return stat
+	case 0xff42:
+		return ppu.scy
+	case 0xff43:
+		return ppu.scx
+	case 0xff44:
+		return ppu.ly
+	case 0xff45:
+		return ppu.lyc
+	case 0xff47:
+		return ppu.bgp
+	case 0xff48:
+		return ppu.obp0
+	case 0xff49:
+		return ppu.obp1
+	case 0xff4a:
+		return ppu.wy
+	case 0xff4b:
+		return ppu.wx
+	}
+	return 0xff
+}
+
+func (ppu *Ppu) write(addr uint16, val uint8) {
+	switch {
+	case addr >= 0x8000 && addr < 0xa000:
+		ppu.vram[ppu.vbk][addr-0x8000] = val
+		return
+	case addr >= 0xfe00 && addr < 0xfea0:
+		ppu.oam[addr-0xfe00] = val
+		return
+	case addr == 0xff4f || addr >= 0xff68:
+		ppu.writeCgb(addr, val)
+		return
+	}
+
+	switch addr {
+	case 0xff40:
+		wasEnabled := ppu.enabled()
+		ppu.lcdc = val
+		if wasEnabled && !ppu.enabled() {
+			ppu.turnOff()
+		}
+	case 0xff41:
+		ppu.stat = val & 0x78
+	case 0xff42:
+		ppu.scy = val
+	case 0xff43:
+		ppu.scx = val
+	case 0xff45:
+		ppu.lyc = val
+	case 0xff47:
+		ppu.bgp = val
+	case 0xff48:
+		ppu.obp0 = val
+	case 0xff49:
+		ppu.obp1 = val
+	case 0xff4a:
+		ppu.wy = val
+	case 0xff4b:
+		ppu.wx = val
+	}
+	ppu.updateStatLine()
+}
+
+// Turning off the LCD resets LY and leaves a blank screen. The next frame starts at line 0 once it is turned
+// back on.
+func (ppu *Ppu) turnOff() {
+	ppu.ly = 0
+	ppu.dot = 0
+	ppu.mode = modeHBlank
+	ppu.windowLine = 0
+	ppu.windowY = false
+	for i := range ppu.front {
+		ppu.front[i] = 0xff
+	}
+}
+
+// Advance the PPU by one dot.
+func (ppu *Ppu) tick() {
+	if !ppu.enabled() {
+		return
+	}
+
+	if ppu.ly < screenHeight {
+		switch ppu.dot {
+		case 0:
+			if ppu.wy == ppu.ly {
+				ppu.windowY = true
+			}
+			ppu.setMode(modeOAMScan)
+		case oamScanDots:
+			ppu.scanOAM()
+			ppu.setMode(modeDrawing)
+			if ppu.fifo != nil {
+				ppu.fifo.startLine()
+			}
+		case oamScanDots + drawingDots:
+			if ppu.fifo == nil {
+				ppu.renderLine()
+				ppu.setMode(modeHBlank)
+			}
+		}
+
+		if ppu.fifo != nil && ppu.mode == modeDrawing && ppu.fifo.tick() {
+			ppu.setMode(modeHBlank)
+		}
+	}
+
+	ppu.dot++
+	if ppu.dot < dotsPerLine {
+		return
+	}
+
+	ppu.dot = 0
+	ppu.ly++
+	switch ppu.ly {
+	case screenHeight:
+		ppu.setMode(modeVBlank)
+		ppu.mem.requestInterrupt(intVBlank)
+		ppu.front = ppu.back
+	case linesPerFrame:
+		ppu.ly = 0
+		ppu.windowLine = 0
+		ppu.windowY = false
+	}
+	ppu.updateStatLine()
+}
+
+func (ppu *Ppu) setMode(mode uint8) {
+	ppu.mode = mode
+	ppu.updateStatLine()
+}
+
+// Recompute the STAT interrupt line and request the interrupt on its rising edge.
+func (ppu *Ppu) updateStatLine() {
+	line := false
+	if ppu.enabled() {
+		line = (ppu.stat&statLycInt != 0 && ppu.ly == ppu.lyc) ||
+			(ppu.stat&statHBlankInt != 0 && ppu.mode == modeHBlank) ||
+			(ppu.stat&statVBlankInt != 0 && ppu.mode == modeVBlank) ||
+			(ppu.stat&statOAMInt != 0 && ppu.mode == modeOAMScan)
+	}
+	if line && !ppu.statLine {
+		ppu.mem.requestInterrupt(intStat)
+	}
+	ppu.statLine = line
+}
+
+// Find the first 10 objects in OAM which are on the current line.
+func (ppu *Ppu) scanOAM() {
+	height := ppu.objHeight()
+
+	ppu.objects = ppu.objects[:0]
+	for i := 0; i < 40 && len(ppu.objects) < 10; i++ {
+		obj := object{
+			y:     int(ppu.oam[i*4]) - 16,
+			x:     int(ppu.oam[i*4+1]) - 8,
+			tile:  ppu.oam[i*4+2],
+			attr:  ppu.oam[i*4+3],
+			index: i,
+		}
+		if int(ppu.ly) >= obj.y && int(ppu.ly) < obj.y+height {
+			ppu.objects = append(ppu.objects, obj)
+		}
+	}
+}
+
+// Return the tile number and, in CGB mode, the attributes of an entry in a tile map.
+func (ppu *Ppu) mapEntry(tileMap int, x int, y int) (uint8, uint8) {
+	addr := tileMap + y*32 + x
+	if ppu.cgb {
+		return ppu.vram[0][addr], ppu.vram[1][addr]
+	}
+	return ppu.vram[0][addr], 0
+}
+
+// Return the two bitplanes of the given row of a tile addressed through the background or window tile map.
+func (ppu *Ppu) bgTileRow(tile uint8, attr uint8, row int) (uint8, uint8) {
+	var addr int
+	if ppu.lcdc&lcdcTileData != 0 {
+		addr = int(tile) * 16
+	} else {
+		addr = 0x1000 + int(int8(tile))*16
+	}
+	if attr&attrFlipY != 0 {
+		row = 7 - row
+	}
+	addr += row * 2
+	bank := (attr & attrBank) >> 3
+	return ppu.vram[bank][addr], ppu.vram[bank][addr+1]
+}
+
+// Return the color index (0-3) of the given pixel from the two bitplanes of a tile row. Pixel 0 is the
+// leftmost one, stored in bit 7.
+func colorIndex(lo, hi uint8, pixel int) uint8 {
+	bit := 7 - uint(pixel)
+	return (lo>>bit)&1 | ((hi>>bit)&1)<<1
+}
+
+// Map a color index through a DMG palette register to a shade.
+func shade(palette uint8, color uint8) uint8 {
+	return (palette >> (color * 2)) & 0x03
+}
+
+// Draw the current line into the back buffer.
+func (ppu *Ppu) renderLine() {
+	var bg, obj [screenWidth]fifoPixel
+	ppu.renderBackground(bg[:])
+	if ppu.lcdc&lcdcObjEnable != 0 {
+		ppu.renderObjects(obj[:])
+	}
+	for x := 0; x < screenWidth; x++ {
+		ppu.mixPixel(x, bg[x], obj[x])
+	}
+}
+
+// Fetch the background and window pixels of the current line. On the DMG, LCDC bit 0 turns off both.
+func (ppu *Ppu) renderBackground(pixels []fifoPixel) {
+	if !ppu.cgb && ppu.lcdc&lcdcBgEnable == 0 {
+		return
+	}
+
+	window := ppu.lcdc&lcdcWindowEnable != 0 && ppu.windowY && ppu.wx <= 166
+
+	bgMap := 0x1800
+	if ppu.lcdc&lcdcBgMap != 0 {
+		bgMap = 0x1c00
+	}
+	windowMap := 0x1800
+	if ppu.lcdc&lcdcWindowMap != 0 {
+		windowMap = 0x1c00
+	}
+
+	for x := range pixels {
+		var mapX, mapY, tileMap int
+		if window && x+7 >= int(ppu.wx) {
+			mapX = x + 7 - int(ppu.wx)
+			mapY = ppu.windowLine
+			tileMap = windowMap
+		} else {
+			mapX = (x + int(ppu.scx)) & 0xff
+			mapY = (int(ppu.ly) + int(ppu.scy)) & 0xff
+			tileMap = bgMap
+		}
+
+		tile, attr := ppu.mapEntry(tileMap, mapX/8, mapY/8)
+		lo, hi := ppu.bgTileRow(tile, attr, mapY%8)
+		pixels[x] = bgPixel(lo, hi, attr, mapX%8)
+	}
+
+	if window {
+		ppu.windowLine++
+	}
+}
+
+// Return the given pixel of a background tile row.
+func bgPixel(lo, hi uint8, attr uint8, pixel int) fifoPixel {
+	if attr&attrFlipX != 0 {
+		pixel = 7 - pixel
+	}
+	return fifoPixel{
+		color:    colorIndex(lo, hi, pixel),
+		palette:  attr & attrCgbPalette,
+		priority: attr&attrPriority != 0,
+	}
+}
+
+// Fetch the object pixels of the current line, the object with the highest priority wins.
+func (ppu *Ppu) renderObjects(pixels []fifoPixel) {
+	for {
+		obj, ok := ppu.takeObject(screenWidth)
+		if !ok {
+			return
+		}
+		lo, hi := ppu.objTileRow(obj)
+
+		for px := 0; px < 8; px++ {
+			x := obj.x + px
+			if x < 0 || x >= screenWidth || pixels[x].color != 0 {
+				continue
+			}
+			pixels[x] = ppu.objPixel(obj, lo, hi, px)
+		}
+	}
+}
+
+// Return the given pixel of an object's tile row.
+func (ppu *Ppu) objPixel(obj object, lo, hi uint8, pixel int) fifoPixel {
+	if obj.attr&attrFlipX != 0 {
+		pixel = 7 - pixel
+	}
+	palette := (obj.attr & attrDmgPalette) >> 4
+	if ppu.cgb {
+		palette = obj.attr & attrCgbPalette
+	}
+	return fifoPixel{
+		color:    colorIndex(lo, hi, pixel),
+		palette:  palette,
+		priority: obj.attr&attrPriority != 0,
+		index:    obj.index,
+	}
+}
+
+// Decide between the background and the object pixel at the given X coordinate and draw it.
+func (ppu *Ppu) mixPixel(x int, bg, obj fifoPixel) {
+	if obj.color != 0 && ppu.lcdc&lcdcObjEnable != 0 && ppu.objectOnTop(bg, obj) {
+		if ppu.cgb {
+			ppu.setColor(x, paletteColor(ppu.objPalettes[:], obj.palette, obj.color))
+			return
+		}
+		palette := ppu.obp0
+		if obj.palette != 0 {
+			palette = ppu.obp1
+		}
+		ppu.setPixel(x, ppu.objPalettes[:], obj.palette, shade(palette, obj.color))
+		return
+	}
+
+	switch {
+	case ppu.cgb:
+		ppu.setColor(x, paletteColor(ppu.bgPalettes[:], bg.palette, bg.color))
+	case ppu.lcdc&lcdcBgEnable == 0:
+		ppu.setPixel(x, ppu.bgPalettes[:], 0, 0)
+	default:
+		ppu.setPixel(x, ppu.bgPalettes[:], 0, shade(ppu.bgp, bg.color))
+	}
+}
+
+// Check whether an object pixel is drawn on top of the background pixel. Background color 0 is always
+// behind objects. Otherwise the object's priority bit puts it behind the background. In CGB mode the
+// priority bit of the background tile does the same and LCDC bit 0 overrides both.
+func (ppu *Ppu) objectOnTop(bg, obj fifoPixel) bool {
+	if bg.color == 0 || ppu.lcdc&lcdcBgEnable == 0 {
+		return true
+	}
+	if ppu.cgb && bg.priority {
+		return false
+	}
+	return !obj.priority
+}
+
+// Remove the object with the highest priority from those left on the current line, considering only
+// objects starting at or left of the given X coordinate. Objects with a smaller X coordinate have priority,
+// if they are equal the one coming first in OAM wins. In CGB mode only the position in OAM counts.
+func (ppu *Ppu) takeObject(maxX int) (object, bool) {
+	best := -1
+	for i, obj := range ppu.objects {
+		if obj.x > maxX {
+			continue
+		}
+		if best < 0 || (!ppu.cgb && obj.x < ppu.objects[best].x) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return object{}, false
+	}
+	obj := ppu.objects[best]
+	ppu.objects = append(ppu.objects[:best], ppu.objects[best+1:]...)
+	return obj, true
+}
+
+func (ppu *Ppu) objHeight() int {
+	if ppu.lcdc&lcdcObjSize != 0 {
+		return 16
+	}
+	return 8
+}
+
+// Return the two bitplanes of the row of the given object on the current line.
+func (ppu *Ppu) objTileRow(obj object) (uint8, uint8) {
+	height := ppu.objHeight()
+	row := int(ppu.ly) - obj.y
+	if obj.attr&attrFlipY != 0 {
+		row = height - 1 - row
+	}
+	tile := obj.tile
+	if height == 16 {
+		tile &= 0xfe
+	}
+	addr := int(tile)*16 + row*2
+	var bank uint8
+	if ppu.cgb {
+		bank = (obj.attr & attrBank) >> 3
+	}
+	return ppu.vram[bank][addr], ppu.vram[bank][addr+1]
+}
+
+// Draw a pixel of the current line in the given DMG shade. In DMG compatibility mode the shade is mapped to
+// a color of the given palette.
+func (ppu *Ppu) setPixel(x int, palettes []uint8, palette uint8, shade uint8) {
+	i := int(ppu.ly)*screenWidth + x
+	ppu.shades[i] = shade
+	if ppu.compat {
+		ppu.setColor(x, paletteColor(palettes, palette, shade))
+		return
+	}
+	rgb := dmgShades[shade]
+	ppu.back[i*4] = rgb[0]
+	ppu.back[i*4+1] = rgb[1]
+	ppu.back[i*4+2] = rgb[2]
+	ppu.back[i*4+3] = 0xff
+}
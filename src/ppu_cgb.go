@@ -0,0 +1,124 @@
+package main
+
+// In CGB mode the PPU has a second bank of video RAM and colors are taken from palette RAM instead of the
+// DMG palette registers.
+//
+// == Video RAM banks ==
+//
+// VBK (0xff4f) selects the bank the CPU sees at 0x8000 - 0x9fff. Bank 1 holds more tile data and, at the
+// addresses of the tile maps, the attributes of the background tiles:
+//
+//  ---------------------------------------------------------------
+// | bit 7 | priority: background colors 1 - 3 are drawn on top of |
+// |       | objects                                                |
+// | bit 6 | flip vertically                                        |
+// | bit 5 | flip horizontally                                      |
+// | bit 3 | video RAM bank of the tile data                        |
+// | 2 - 0 | background palette                                     |
+//  ---------------------------------------------------------------
+//
+// Objects use bit 3 for the tile bank and bits 2 - 0 for one of the object palettes in the same way.
+//
+// == Palettes ==
+//
+// There are 8 background and 8 object palettes of 4 colors each, 64 bytes per kind. A color is stored as
+// little-endian RGB555 (bits 0 - 4 red, 5 - 9 green, 10 - 14 blue). The palette RAM is accessed through an
+// index register and a data register:
+//
+//  ---------------------------------------------------------
+// | 0xff68 | BCPS | background palette index                 |
+// | 0xff69 | BCPD | background palette data                  |
+// | 0xff6a | OCPS | object palette index                     |
+// | 0xff6b | OCPD | object palette data                      |
+//  ---------------------------------------------------------
+//
+// Bits 5 - 0 of the index select the byte, bit 7 increments the index after every write to the data
+// register. The palette RAM cannot be accessed during mode 3.
+//
+// == Priority ==
+//
+// Objects are ordered by their position in OAM only. LCDC bit 0 no longer turns off the background, instead
+// it puts all objects on top of it regardless of the priority bits.
+
+const (
+	paletteIndex         = 0x3f
+	paletteAutoIncrement = 1 << 7
+)
+
+// Read a CGB register. Outside of CGB mode they are not mapped.
+func (ppu *Ppu) readCgb(addr uint16) uint8 {
+	if !ppu.cgb {
+		return 0xff
+	}
+
+	switch addr {
+	case 0xff4f:
+		return 0xfe | ppu.vbk
+	case 0xff68:
+		return 0x40 | ppu.bcps
+	case 0xff69:
+		return ppu.bgPalettes[ppu.bcps&paletteIndex]
+	case 0xff6a:
+		return 0x40 | ppu.ocps
+	case 0xff6b:
+		return ppu.objPalettes[ppu.ocps&paletteIndex]
+	}
+	return 0xff
+}
+
+// Write a CGB register. Outside of CGB mode writes are ignored.
+func (ppu *Ppu) writeCgb(addr uint16, val uint8) {
+	if !ppu.cgb {
+		return
+	}
+
+	switch addr {
+	case 0xff4f:
+		ppu.vbk = val & 0x01
+	case 0xff68:
+		ppu.bcps = val & (paletteAutoIncrement | paletteIndex)
+	case 0xff69:
+		ppu.bgPalettes[ppu.bcps&paletteIndex] = val
+		ppu.bcps = incrementPaletteIndex(ppu.bcps)
+	case 0xff6a:
+		ppu.ocps = val & (paletteAutoIncrement | paletteIndex)
+	case 0xff6b:
+		ppu.objPalettes[ppu.ocps&paletteIndex] = val
+		ppu.ocps = incrementPaletteIndex(ppu.ocps)
+	}
+}
+
+// Return the palette index register after a write to the data register.
+func incrementPaletteIndex(index uint8) uint8 {
+	if index&paletteAutoIncrement == 0 {
+		return index
+	}
+	return paletteAutoIncrement | (index+1)&paletteIndex
+}
+
+// Return the RGB555 value of a color in palette RAM.
+func paletteColor(palettes []uint8, palette uint8, color uint8) uint16 {
+	i := int(palette)*8 + int(color)*2
+	return uint16(palettes[i]) | uint16(palettes[i+1])<<8
+}
+
+// Set a color in palette RAM to the given RGB555 value.
+func setPaletteColor(palettes []uint8, palette uint8, color uint8, rgb uint16) {
+	i := int(palette)*8 + int(color)*2
+	palettes[i] = uint8(rgb)
+	palettes[i+1] = uint8(rgb >> 8)
+}
+
+// Draw a pixel of the current line in the given RGB555 color.
+func (ppu *Ppu) setColor(x int, rgb uint16) {
+	i := int(ppu.ly)*screenWidth + x
+	ppu.back[i*4] = expandColor(uint8(rgb & 0x1f))
+	ppu.back[i*4+1] = expandColor(uint8(rgb>>5) & 0x1f)
+	ppu.back[i*4+2] = expandColor(uint8(rgb>>10) & 0x1f)
+	ppu.back[i*4+3] = 0xff
+}
+
+// Scale a 5 bit color channel to 8 bits.
+func expandColor(c uint8) uint8 {
+	return c<<3 | c>>2
+}
@@ -0,0 +1,258 @@
+package main
+
+// The real PPU does not draw a line at once, it pushes one pixel per dot to the LCD during mode 3. The pixels
+// come out of two FIFOs, one for the background and window and one for the objects, which are filled by
+// the fetcher. Drawing this way is what lets games change the scroll and palette registers in the middle
+// of a line for raster effects.
+//
+// == Background fetcher ==
+//
+// The fetcher reads one tile row at a time in four steps, the first three taking two dots each:
+//
+//  -----------------------------------------------------------
+// | step 0 | read the tile number from the tile map            |
+// | step 1 | read the low bitplane of the tile row             |
+// | step 2 | read the high bitplane of the tile row            |
+// | step 3 | push the 8 pixels, once the background FIFO is   |
+// |        | empty (tried every dot)                           |
+//  -----------------------------------------------------------
+//
+// == Mode 3 length ==
+//
+// Mode 3 takes at least 172 dots: the first tile of a line is fetched twice, 12 dots, before 160 pixels
+// are pushed at one pixel per dot. It gets longer by:
+//
+//  - SCX % 8 dots, as the pixels scrolled off to the left are fetched and thrown away
+//  - 6 dots when the window starts, as the FIFO is cleared and the fetcher starts over with the window
+//  - 6 dots for every object, during which the background fetcher and the output are paused. The object
+//    fetch only starts once the background fetcher has a tile row ready, which adds another
+//    5 - min(5, (X + SCX) % 8) dots.
+
+// A pixel in one of the FIFOs. On the DMG background pixels only use the color index, in CGB mode they
+// also carry the palette and priority from the tile attributes. The OAM index decides between overlapping
+// objects in CGB mode.
+type fifoPixel struct {
+	color    uint8
+	palette  uint8
+	priority bool
+	index    int
+}
+
+type pixelFifo struct {
+	ppu *Ppu
+
+	bg  []fifoPixel
+	obj []fifoPixel
+
+	// background fetcher
+	step   int
+	dots   int
+	tileX  int
+	tile   uint8
+	attr   uint8
+	lo, hi uint8
+
+	// dots left in the throwaway fetch at the start of the line
+	delay int
+	// background pixels left to throw away for the fine scroll
+	discard int
+	// set once the window started on the current line
+	window bool
+
+	// object being fetched and the dots left until it is merged into the object FIFO
+	fetching    bool
+	fetchObject object
+	fetchDots   int
+
+	// X coordinate of the next pixel pushed to the LCD
+	x int
+}
+
+func newPixelFifo(ppu *Ppu) *pixelFifo {
+	return &pixelFifo{
+		ppu: ppu,
+		bg:  make([]fifoPixel, 0, 16),
+		obj: make([]fifoPixel, 0, 8),
+	}
+}
+
+// Reset the FIFOs and the fetcher at the start of mode 3.
+func (f *pixelFifo) startLine() {
+	f.bg = f.bg[:0]
+	f.obj = f.obj[:0]
+	f.step = 0
+	f.dots = 0
+	f.tileX = 0
+	f.delay = 6
+	f.discard = int(f.ppu.scx % 8)
+	f.window = false
+	f.fetching = false
+	f.x = 0
+}
+
+// Advance by one dot. Returns true once all 160 pixels of the line have been pushed.
+func (f *pixelFifo) tick() bool {
+	ppu := f.ppu
+
+	if f.delay > 0 {
+		f.delay--
+		return false
+	}
+
+	if f.fetching {
+		f.fetchDots--
+		if f.fetchDots == 0 {
+			f.mergeObject(f.fetchObject)
+			f.fetching = false
+		}
+		return false
+	}
+
+	if f.discard == 0 && !f.window && ppu.lcdc&lcdcWindowEnable != 0 && ppu.windowY && f.x+7 >= int(ppu.wx) {
+		// clear the FIFO and start over fetching the window
+		f.window = true
+		f.bg = f.bg[:0]
+		f.step = 0
+		f.dots = 0
+		f.tileX = 0
+		if ppu.wx < 7 {
+			f.discard = 7 - int(ppu.wx)
+		}
+	}
+
+	if ppu.lcdc&lcdcObjEnable != 0 && f.discard == 0 {
+		if f.objectWaiting() {
+			// the background fetcher finishes its tile row before the object fetch starts
+			if f.step < 3 || len(f.bg) == 0 {
+				f.fetch()
+			}
+			if f.step == 3 && len(f.bg) > 0 {
+				f.fetchObject, _ = ppu.takeObject(f.x)
+				f.fetching = true
+				f.fetchDots = 5
+			}
+			return false
+		}
+	}
+
+	f.fetch()
+
+	if len(f.bg) == 0 {
+		return false
+	}
+	bg := f.bg[0]
+	f.bg = f.bg[1:]
+	if f.discard > 0 {
+		f.discard--
+		return false
+	}
+
+	var obj fifoPixel
+	if len(f.obj) > 0 {
+		obj = f.obj[0]
+		f.obj = f.obj[1:]
+	}
+	f.push(bg, obj)
+
+	f.x++
+	if f.x == screenWidth {
+		if f.window {
+			ppu.windowLine++
+		}
+		return true
+	}
+	return false
+}
+
+// Check whether an object starts at the current X coordinate.
+func (f *pixelFifo) objectWaiting() bool {
+	for _, obj := range f.ppu.objects {
+		if obj.x <= f.x {
+			return true
+		}
+	}
+	return false
+}
+
+// Advance the background fetcher by one dot.
+func (f *pixelFifo) fetch() {
+	ppu := f.ppu
+
+	if f.step == 3 {
+		if len(f.bg) > 0 {
+			return
+		}
+		for pixel := 0; pixel < 8; pixel++ {
+			f.bg = append(f.bg, bgPixel(f.lo, f.hi, f.attr, pixel))
+		}
+		f.tileX++
+		f.step = 0
+		f.dots = 0
+		// the push shares its dot with the first dot of the next fetch
+	}
+
+	f.dots++
+	if f.dots < 2 {
+		return
+	}
+	f.dots = 0
+
+	var mapY int
+	if f.window {
+		mapY = ppu.windowLine
+	} else {
+		mapY = (int(ppu.ly) + int(ppu.scy)) & 0xff
+	}
+
+	switch f.step {
+	case 0:
+		tileMap, mapX := 0x1800, 0
+		if f.window {
+			if ppu.lcdc&lcdcWindowMap != 0 {
+				tileMap = 0x1c00
+			}
+			mapX = f.tileX & 31
+		} else {
+			if ppu.lcdc&lcdcBgMap != 0 {
+				tileMap = 0x1c00
+			}
+			mapX = (int(ppu.scx)/8 + f.tileX) & 31
+		}
+		f.tile, f.attr = ppu.mapEntry(tileMap, mapX, mapY/8)
+	case 1:
+		f.lo, _ = ppu.bgTileRow(f.tile, f.attr, mapY%8)
+	case 2:
+		_, f.hi = ppu.bgTileRow(f.tile, f.attr, mapY%8)
+	}
+	f.step++
+}
+
+// Merge the pixels of an object into the object FIFO. On the DMG pixels already in the FIFO belong to
+// objects with a higher priority, so only transparent ones are replaced. In CGB mode the object coming
+// first in OAM wins.
+func (f *pixelFifo) mergeObject(obj object) {
+	ppu := f.ppu
+	lo, hi := ppu.objTileRow(obj)
+
+	for px := 0; px < 8; px++ {
+		slot := obj.x + px - f.x
+		if slot < 0 {
+			// left of the screen
+			continue
+		}
+		for len(f.obj) <= slot {
+			f.obj = append(f.obj, fifoPixel{})
+		}
+		pixel := ppu.objPixel(obj, lo, hi, px)
+		old := f.obj[slot]
+		if old.color == 0 || (ppu.cgb && pixel.color != 0 && pixel.index < old.index) {
+			f.obj[slot] = pixel
+		}
+	}
+}
+
+// Mix a background and an object pixel and push the result to the LCD. The palettes are applied at this
+// point, so a palette change takes effect with the next pixel.
+func (f *pixelFifo) push(bg, obj fifoPixel) {
+	f.ppu.mixPixel(f.x, bg, obj)
+}
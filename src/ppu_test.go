@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func ppuTestMemory() (*Memory, *Ppu) {
+	mem := newMemory(nil)
+	ppu := newPpu(mem)
+	mem.ppu = ppu
+	mem.Write(0xff47, 0xe4) // BGP: color index n is shade n
+	mem.Write(0xff48, 0xe4)
+	mem.Write(0xff49, 0x1b) // OBP1: reversed
+	return mem, ppu
+}
+
+// Run the PPU until it reaches the given line and dot.
+func runPpuTo(ppu *Ppu, ly uint8, dot int) {
+	for ppu.ly != ly || ppu.dot != dot {
+		ppu.tick()
+	}
+}
+
+// Test the mode sequence of a visible line and the start of VBlank
+func TestPpuModes(t *testing.T) {
+	mem, ppu := ppuTestMemory()
+	mem.Write(0xff40, 0x91)
+
+	tests := []struct {
+		ly   uint8
+		dot  int
+		mode uint8
+	}{
+		{0, 1, modeOAMScan},
+		{0, 81, modeDrawing},
+		{0, 253, modeHBlank},
+		{1, 1, modeOAMScan},
+		{144, 1, modeVBlank},
+		{153, 455, modeVBlank},
+		{0, 1, modeOAMScan},
+	}
+	for _, test := range tests {
+		runPpuTo(ppu, test.ly, test.dot)
+		if mode := mem.Read(0xff41) & 0x03; mode != test.mode {
+			t.Errorf("Wrong mode at line %d, dot %d. Expected %d but got %d", test.ly, test.dot, test.mode, mode)
+		}
+	}
+}
+
+// Test that the VBlank interrupt is requested when line 144 starts
+func TestPpuVBlankInterrupt(t *testing.T) {
+	mem, ppu := ppuTestMemory()
+	mem.Write(0xff40, 0x91)
+
+	runPpuTo(ppu, 143, 455)
+	if mem.Read(0xff0f)&intVBlank != 0 {
+		t.Errorf("VBlank interrupt requested too early")
+	}
+	ppu.tick()
+	if mem.Read(0xff0f)&intVBlank == 0 {
+		t.Errorf("VBlank interrupt was not requested")
+	}
+}
+
+// Test the LYC=LY STAT interrupt
+func TestPpuLycInterrupt(t *testing.T) {
+	mem, ppu := ppuTestMemory()
+	mem.Write(0xff45, 10)
+	mem.Write(0xff41, statLycInt)
+	mem.Write(0xff40, 0x91)
+
+	runPpuTo(ppu, 9, 455)
+	if mem.Read(0xff0f)&intStat != 0 {
+		t.Errorf("STAT interrupt requested too early")
+	}
+	ppu.tick()
+	if mem.Read(0xff0f)&intStat == 0 {
+		t.Errorf("STAT interrupt was not requested when LY reached LYC")
+	}
+	if mem.Read(0xff41)&statLycFlag == 0 {
+		t.Errorf("LYC=LY flag is not set")
+	}
+}
+
+// Test that the CPU is locked out of video RAM during mode 3
+func TestPpuVramBlocked(t *testing.T) {
+	mem, ppu := ppuTestMemory()
+	mem.Write(0x8000, 0x12)
+	mem.Write(0xff40, 0x91)
+
+	runPpuTo(ppu, 0, 100)
+	if val := mem.Read(0x8000); val != 0xff {
+		t.Errorf("Video RAM should not be readable in mode 3. Expected 0xFF but got 0x%X", val)
+	}
+	runPpuTo(ppu, 0, 300)
+	if val := mem.Read(0x8000); val != 0x12 {
+		t.Errorf("Video RAM should be readable in mode 0. Expected 0x12 but got 0x%X", val)
+	}
+}
+
+// Return the shade of a pixel of the last drawn frame.
+func pixelShade(ppu *Ppu, x, y int) uint8 {
+	return ppu.shades[y*screenWidth+x]
+}
+
+// Test background scrolling and the window
+func TestPpuBackgroundAndWindow(t *testing.T) {
+	mem, ppu := ppuTestMemory()
+	// tile 1 is solid color 1, tile 2 is solid color 2
+	for row := uint16(0); row < 8; row++ {
+		mem.Write(0x8010+row*2, 0xff)
+		mem.Write(0x8020+row*2+1, 0xff)
+	}
+	mem.Write(0x9800+1, 0x01) // background tile (1, 0)
+	for i := uint16(0); i < 32*32; i++ {
+		mem.Write(0x9c00+i, 0x02) // window map is all tile 2
+	}
+	mem.Write(0xff43, 4)  // SCX
+	mem.Write(0xff4a, 2)  // WY
+	mem.Write(0xff4b, 87) // WX, window starts at x = 80
+	mem.Write(0xff40, lcdcEnable|lcdcWindowMap|lcdcWindowEnable|lcdcTileData|lcdcBgEnable)
+
+	runPpuTo(ppu, 3, 0)
+
+	if pixelShade(ppu, 3, 0) != 0 || pixelShade(ppu, 4, 0) != 1 || pixelShade(ppu, 11, 0) != 1 || pixelShade(ppu, 12, 0) != 0 {
+		t.Errorf("Background is not scrolled correctly")
+	}
+	if pixelShade(ppu, 80, 1) != 0 {
+		t.Errorf("Window should not be drawn above WY")
+	}
+	if pixelShade(ppu, 79, 2) != 0 || pixelShade(ppu, 80, 2) != 2 || pixelShade(ppu, 159, 2) != 2 {
+		t.Errorf("Window is not drawn from WX-7 onwards")
+	}
+	if ppu.windowLine != 1 {
+		t.Errorf("Window line counter should have advanced once. Expected 1 but got %d", ppu.windowLine)
+	}
+}
+
+// Test object flipping, priority between objects and priority behind the background
+func TestPpuObjects(t *testing.T) {
+	mem, ppu := ppuTestMemory()
+	// tile 1: leftmost pixel color 3, the rest color 1
+	for row := uint16(0); row < 8; row++ {
+		mem.Write(0x8010+row*2, 0xff)
+		mem.Write(0x8010+row*2+1, 0x80)
+	}
+	// object 0 at x = 10, object 1 at x = 6 overlapping it with palette OBP1 and flipped
+	for i, val := range []uint8{16, 18, 0x01, 0x00, 16, 14, 0x01, attrDmgPalette | attrFlipX} {
+		mem.Write(0xfe00+uint16(i), val)
+	}
+	// object 2 at x = 30 behind the background
+	for i, val := range []uint8{16, 38, 0x01, attrPriority} {
+		mem.Write(0xfe08+uint16(i), val)
+	}
+	mem.Write(0x9803, 0x01) // background tile at x = 24 - 31
+	mem.Write(0xff40, lcdcEnable|lcdcTileData|lcdcObjEnable|lcdcBgEnable)
+
+	runPpuTo(ppu, 1, 0)
+
+	// object 1 covers x = 6 - 13, flipped so its color 3 pixel is at x = 13 with OBP1 giving shade 0
+	if pixelShade(ppu, 6, 0) != 2 || pixelShade(ppu, 13, 0) != 0 {
+		t.Errorf("Flipped object is not drawn correctly")
+	}
+	// object 1 has the smaller x and wins over object 0
+	if pixelShade(ppu, 10, 0) != 2 {
+		t.Errorf("Object with smaller X should have priority. Expected shade 2 but got %d", pixelShade(ppu, 10, 0))
+	}
+	if pixelShade(ppu, 14, 0) != 1 {
+		t.Errorf("Object 0 should be visible right of object 1. Expected shade 1 but got %d", pixelShade(ppu, 14, 0))
+	}
+	// object 2 is hidden behind background color 1
+	if pixelShade(ppu, 30, 0) != 1 {
+		t.Errorf("Object should be hidden behind the background. Expected shade 1 but got %d", pixelShade(ppu, 30, 0))
+	}
+}
+
+func fifoTestMemory() (*Memory, *Ppu) {
+	mem, ppu := ppuTestMemory()
+	ppu.fifo = newPixelFifo(ppu)
+	return mem, ppu
+}
+
+// Return the number of dots mode 3 took on the current line.
+func mode3Length(ppu *Ppu) int {
+	for ppu.mode != modeDrawing {
+		ppu.tick()
+	}
+	// the dot switching to mode 3 is already the first one of it
+	dots := 1
+	for ppu.mode == modeDrawing {
+		ppu.tick()
+		dots++
+	}
+	return dots
+}
+
+// Test that the pixel FIFO draws the same picture as the scanline renderer
+func TestPpuFifoMatchesScanline(t *testing.T) {
+	setup := func(mem *Memory) {
+		for i := uint16(0); i < 0x1800; i++ {
+			mem.Write(0x8000+i, uint8(i*7))
+		}
+		for i := uint16(0); i < 0x800; i++ {
+			mem.Write(0x9800+i, uint8(i*13))
+		}
+		for i, val := range []uint8{40, 20, 0x05, 0x00, 44, 24, 0x06, attrFlipX | attrDmgPalette, 50, 100, 0x07, attrPriority} {
+			mem.Write(0xfe00+uint16(i), val)
+		}
+		mem.Write(0xff42, 5)  // SCY
+		mem.Write(0xff43, 11) // SCX
+		mem.Write(0xff4a, 60) // WY
+		mem.Write(0xff4b, 50) // WX
+		mem.Write(0xff40, lcdcEnable|lcdcWindowMap|lcdcWindowEnable|lcdcTileData|lcdcObjEnable|lcdcBgEnable)
+	}
+
+	_, scanline := ppuTestMemory()
+	setup(scanline.mem)
+	runPpuTo(scanline, 144, 0)
+	_, fifo := fifoTestMemory()
+	setup(fifo.mem)
+	runPpuTo(fifo, 144, 0)
+
+	for i := range scanline.shades {
+		if scanline.shades[i] != fifo.shades[i] {
+			t.Fatalf("Pixel FIFO shade differs from scanline renderer at x = %d, y = %d. Expected %d but got %d",
+				i%screenWidth, i/screenWidth, scanline.shades[i], fifo.shades[i])
+		}
+	}
+	for i := 0; i < len(scanline.front); i += 4 {
+		want, got := scanline.front[i:i+4], fifo.front[i:i+4]
+		if !bytes.Equal(want, got) {
+			t.Fatalf("Pixel FIFO color differs from scanline renderer at x = %d, y = %d. Expected %v but got %v",
+				i/4%screenWidth, i/4/screenWidth, want, got)
+		}
+	}
+}
+
+// Test the variable length of mode 3
+func TestPpuFifoMode3Length(t *testing.T) {
+	mem, ppu := fifoTestMemory()
+	mem.Write(0xff40, lcdcEnable|lcdcTileData|lcdcObjEnable|lcdcBgEnable)
+	if dots := mode3Length(ppu); dots != 172 {
+		t.Errorf("Wrong mode 3 length without scrolling. Expected 172 but got %d", dots)
+	}
+
+	mem.Write(0xff43, 3)
+	if dots := mode3Length(ppu); dots != 175 {
+		t.Errorf("Wrong mode 3 length with SCX = 3. Expected 175 but got %d", dots)
+	}
+
+	mem.Write(0xff43, 0)
+	mem.Write(0xfe00, 18) // object on lines 2 - 9 at x = 0
+	mem.Write(0xfe01, 8)
+	if dots := mode3Length(ppu); dots != 183 {
+		t.Errorf("Wrong mode 3 length with an object at x = 0. Expected 183 but got %d", dots)
+	}
+}
+
+// Test that a palette change in the middle of mode 3 only affects the rest of the line
+func TestPpuFifoMidLinePaletteChange(t *testing.T) {
+	mem, ppu := fifoTestMemory()
+	for row := uint16(0); row < 8; row++ {
+		mem.Write(0x8000+row*2, 0xff) // tile 0 is solid color 1
+	}
+	mem.Write(0xff40, lcdcEnable|lcdcTileData|lcdcBgEnable)
+
+	// pixel x is pushed on dot 80 + 12 + x
+	runPpuTo(ppu, 0, 80+12+100)
+	mem.Write(0xff47, 0xe8) // color 1 is shade 2 from now on
+	runPpuTo(ppu, 1, 0)
+
+	if pixelShade(ppu, 99, 0) != 1 || pixelShade(ppu, 100, 0) != 2 {
+		t.Errorf("Palette change should take effect from x = 100. Got shades %d and %d", pixelShade(ppu, 99, 0), pixelShade(ppu, 100, 0))
+	}
+}
+
+func cgbTestMemory() (*Memory, *Ppu) {
+	mem, ppu := ppuTestMemory()
+	ppu.cgb = true
+	return mem, ppu
+}
+
+// Write the given RGB555 colors to palette RAM through an auto-incrementing index register.
+func writePalettes(mem *Memory, index uint16, start uint8, colors ...uint16) {
+	mem.Write(index, paletteAutoIncrement|start)
+	for _, color := range colors {
+		mem.Write(index+1, uint8(color))
+		mem.Write(index+1, uint8(color>>8))
+	}
+}
+
+// Return the RGB555 color of a pixel of the frame being drawn.
+func pixelColor(ppu *Ppu, x, y int) uint16 {
+	i := (y*screenWidth + x) * 4
+	return uint16(ppu.back[i]>>3) | uint16(ppu.back[i+1]>>3)<<5 | uint16(ppu.back[i+2]>>3)<<10
+}
+
+// Test the palette index registers with and without auto-increment
+func TestCgbPaletteRegisters(t *testing.T) {
+	mem, ppu := cgbTestMemory()
+
+	writePalettes(mem, 0xff68, 0x3e, 0x1234)
+	if ppu.bgPalettes[0x3e] != 0x34 || ppu.bgPalettes[0x3f] != 0x12 {
+		t.Errorf("Palette data was not written correctly")
+	}
+	if val := mem.Read(0xff68); val != 0xc0 {
+		t.Errorf("Palette index should wrap around. Expected 0xC0 but got 0x%X", val)
+	}
+
+	mem.Write(0xff6a, 0x05)
+	mem.Write(0xff6b, 0x11)
+	mem.Write(0xff6b, 0x22)
+	if val := mem.Read(0xff6a); val != 0x45 {
+		t.Errorf("Palette index should not increment. Expected 0x45 but got 0x%X", val)
+	}
+	if val := mem.Read(0xff6b); val != 0x22 {
+		t.Errorf("Palette data was not read correctly. Expected 0x22 but got 0x%X", val)
+	}
+
+	mem.Write(0xff40, lcdcEnable)
+	runPpuTo(ppu, 0, 100)
+	if val := mem.Read(0xff6b); val != 0xff {
+		t.Errorf("Palette data should not be readable in mode 3. Expected 0xFF but got 0x%X", val)
+	}
+
+	ppu.cgb = false
+	if val := mem.Read(0xff4f); val != 0xff {
+		t.Errorf("VBK should not be mapped outside of CGB mode. Expected 0xFF but got 0x%X", val)
+	}
+}
+
+// Test video RAM banking and the background attributes
+func TestCgbBackgroundAttributes(t *testing.T) {
+	mem, ppu := cgbTestMemory()
+	writePalettes(mem, 0xff68, 0, 0x0000, 0x001f, 0x03e0, 0x7c00)
+	writePalettes(mem, 0xff68, 0x08, 0x7fff, 0x7fff, 0x7fff, 0x7fff)
+
+	// tile 1 in bank 0: leftmost pixel color 1, tile 1 in bank 1: leftmost pixel color 2
+	mem.Write(0x8010, 0x80)
+	mem.Write(0xff4f, 1)
+	mem.Write(0x8011, 0x80)
+	if val := mem.Read(0xff4f); val != 0xff {
+		t.Errorf("VBK was not set. Expected 0xFF but got 0x%X", val)
+	}
+
+	// tile (1, 0) from bank 1 flipped, tile (2, 0) with palette 1
+	mem.Write(0x9801, attrBank|attrFlipX)
+	mem.Write(0x9802, 0x01)
+	mem.Write(0xff4f, 0)
+	if val := mem.Read(0x8010); val != 0x80 {
+		t.Errorf("Bank 0 was overwritten. Expected 0x80 but got 0x%X", val)
+	}
+	mem.Write(0x9800, 0x01)
+	mem.Write(0x9801, 0x01)
+	mem.Write(0x9802, 0x01)
+	mem.Write(0xff40, lcdcEnable|lcdcTileData)
+
+	runPpuTo(ppu, 1, 0)
+
+	if color := pixelColor(ppu, 0, 0); color != 0x001f {
+		t.Errorf("Tile from bank 0 is not drawn correctly. Expected 0x001F but got 0x%X", color)
+	}
+	if color := pixelColor(ppu, 8, 0); color != 0x0000 || pixelColor(ppu, 15, 0) != 0x03e0 {
+		t.Errorf("Flipped tile from bank 1 is not drawn correctly")
+	}
+	if color := pixelColor(ppu, 17, 0); color != 0x7fff {
+		t.Errorf("Tile should use palette 1. Expected 0x7FFF but got 0x%X", color)
+	}
+}
+
+// Test the priority between objects and between objects and the background in CGB mode
+func TestCgbObjectPriority(t *testing.T) {
+	for _, fifo := range []bool{false, true} {
+		mem, ppu := cgbTestMemory()
+		if fifo {
+			ppu.fifo = newPixelFifo(ppu)
+		}
+		writePalettes(mem, 0xff68, 0, 0x0000, 0x001f, 0x001f, 0x001f)
+		writePalettes(mem, 0xff6a, 0, 0x0000, 0x03e0, 0x03e0, 0x03e0, 0x0000, 0x7c00, 0x7c00, 0x7c00)
+
+		// tile 1 is solid color 1
+		for row := uint16(0); row < 8; row++ {
+			mem.Write(0x8010+row*2, 0xff)
+		}
+		// object 0 at x = 10 with palette 0, object 1 at x = 6 with palette 1 overlapping it
+		for i, val := range []uint8{16, 18, 0x01, 0x00, 16, 14, 0x01, 0x01} {
+			mem.Write(0xfe00+uint16(i), val)
+		}
+		// object 2 at x = 30 on top of a background tile with the priority attribute
+		for i, val := range []uint8{16, 38, 0x01, 0x00} {
+			mem.Write(0xfe08+uint16(i), val)
+		}
+		mem.Write(0x9803, 0x01)
+		mem.Write(0xff4f, 1)
+		mem.Write(0x9803, attrPriority)
+		mem.Write(0xff4f, 0)
+		mem.Write(0xff40, lcdcEnable|lcdcTileData|lcdcObjEnable|lcdcBgEnable)
+
+		runPpuTo(ppu, 1, 0)
+
+		if color := pixelColor(ppu, 10, 0); color != 0x03e0 {
+			t.Errorf("Object coming first in OAM should have priority (fifo: %t). Expected 0x03E0 but got 0x%X", fifo, color)
+		}
+		if color := pixelColor(ppu, 6, 0); color != 0x7c00 {
+			t.Errorf("Object 1 should be visible left of object 0 (fifo: %t). Expected 0x7C00 but got 0x%X", fifo, color)
+		}
+		if color := pixelColor(ppu, 30, 0); color != 0x001f {
+			t.Errorf("Object should be hidden behind a background tile with priority (fifo: %t). Expected 0x001F but got 0x%X", fifo, color)
+		}
+
+		// LCDC bit 0 puts all objects on top
+		mem.Write(0xff40, lcdcEnable|lcdcTileData|lcdcObjEnable)
+		runPpuTo(ppu, 2, 0)
+		if color := pixelColor(ppu, 30, 1); color != 0x03e0 {
+			t.Errorf("Object should be drawn on top with LCDC bit 0 cleared (fifo: %t). Expected 0x03E0 but got 0x%X", fifo, color)
+		}
+	}
+}
+
+// Test that a DMG cartridge on the CGB model gets colorized by its title
+func TestCgbCompatPalettes(t *testing.T) {
+	cart := testCartridge()
+	copy(cart.rom[0x0134:], "ZELDA\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	cart.rom[0x014b] = 0x01
+
+	gb := newGameboy(CGB, cart, nil)
+	if !gb.ppu.compat {
+		t.Fatalf("CGB should run a DMG cartridge in compatibility mode")
+	}
+	// ZELDA uses a red background, green object palette 0 and blue object palette 1
+	if color := paletteColor(gb.ppu.bgPalettes[:], 0, 1); color != 0x421f {
+		t.Errorf("Wrong background color. Expected 0x421F but got 0x%X", color)
+	}
+	if color := paletteColor(gb.ppu.objPalettes[:], 0, 1); color != 0x03e0 {
+		t.Errorf("Wrong color of object palette 0. Expected 0x3E0 but got 0x%X", color)
+	}
+	if color := paletteColor(gb.ppu.objPalettes[:], 1, 2); color != 0x7c00 {
+		t.Errorf("Wrong color of object palette 1. Expected 0x7C00 but got 0x%X", color)
+	}
+
+	gb.mem.Write(0xff40, lcdcEnable|lcdcBgEnable)
+	gb.mem.Write(0xff47, 0x01)
+	runPpuTo(gb.ppu, 1, 0)
+	if color := pixelColor(gb.ppu, 0, 0); color != 0x421f {
+		t.Errorf("Shade 1 should be drawn in the background color. Expected 0x421F but got 0x%X", color)
+	}
+}
+
+// Test the fourth letter check for shared title checksums and the default for other publishers
+func TestCgbCompatTitleLetter(t *testing.T) {
+	cart := testCartridge()
+	copy(cart.rom[0x0134:], "POKEMON BLUE\x00\x00\x00\x00")
+	cart.rom[0x014b] = 0x33
+	copy(cart.rom[0x0144:], "01")
+	if combination := titleCombination(cart); combination != 11 {
+		t.Errorf("Wrong combination for POKEMON BLUE. Expected 11 but got %d", combination)
+	}
+
+	// same checksum, different fourth letter
+	copy(cart.rom[0x0134:], "POKDMON BLUF\x00\x00\x00\x00")
+	if combination := titleCombination(cart); combination != 0 {
+		t.Errorf("Fourth letter should not match. Expected 0 but got %d", combination)
+	}
+
+	copy(cart.rom[0x0134:], "POKEMON BLUE\x00\x00\x00\x00")
+	copy(cart.rom[0x0144:], "08")
+	if combination := titleCombination(cart); combination != 0 {
+		t.Errorf("Cartridges not published by Nintendo should get the default. Expected 0 but got %d", combination)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+)
+
+// The Game Boy Printer sits on the serial port and is always clocked by the Game Boy. It talks in packets:
+//
+//  ---------------------------------------------------------------------
+// | 0x88 0x33       | magic bytes                                       |
+// | command         | 0x01 init, 0x02 print, 0x04 data, 0x08 break,     |
+// |                 | 0x0f status                                       |
+// | compression     | 1 if the data is compressed                       |
+// | length          | 16 bits, little endian                            |
+// | data            | length bytes                                      |
+// | checksum        | 16 bit sum of command to data, little endian      |
+// | 0x00 0x00       | the printer answers 0x81 and its status           |
+//  ---------------------------------------------------------------------
+//
+// Data packets carry up to 0x280 bytes of tile data, two rows of 20 tiles, 160 x 16 pixels. Compressed data
+// is a run length encoding: a byte n with bit 7 set is followed by one byte repeated (n & 0x7f) + 2 times,
+// otherwise by n + 1 literal bytes. An empty data packet marks the end of the image data.
+//
+// The print command prints all data received since the last print. Its 4 bytes of data are the number of
+// sheets, the margins before (upper nibble) and after (lower nibble) the image, the palette like BGP and the
+// exposure. Games print long images in several parts with no margins between them, so all parts up to a
+// margin after the image are collected into one PNG file. The margins are drawn as white lines.
+//
+// == Status ==
+//
+//  ------------------------------------------------
+// | bit 7 | battery low                            |
+// | bit 6 | other error                            |
+// | bit 5 | paper jam                              |
+// | bit 4 | packet error                           |
+// | bit 3 | unprocessed image data                 |
+// | bit 2 | image data full                        |
+// | bit 1 | printing                               |
+// | bit 0 | checksum error                         |
+//  ------------------------------------------------
+
+const (
+	printerWidth = 160
+	// bytes of tile data the printer can hold
+	printerMemory = 0x2000
+	// status requests the printer stays busy for after a print
+	printerBusyPolls = 16
+	// white lines drawn for every unit of the margins
+	printerMarginLines = 8
+)
+
+const (
+	printerChecksumError = 1 << 0
+	printerPrinting      = 1 << 1
+	printerFull          = 1 << 2
+	printerUnprocessed   = 1 << 3
+)
+
+var printerShades = [4]uint8{0xff, 0xaa, 0x55, 0x00}
+
+type Printer struct {
+	// bytes of the current packet so far
+	packet []uint8
+	status uint8
+	busy   int
+
+	// tile data waiting for the print command
+	data []uint8
+	// lines printed since the last margin after an image, one shade per pixel
+	sheet []uint8
+
+	// the files are named prefix-1.png, prefix-2.png, ...
+	prefix string
+	prints int
+}
+
+func newPrinter(prefix string) *Printer {
+	return &Printer{prefix: prefix}
+}
+
+// The Game Boy shifts out a byte of a packet, the printer answers with the one the packet asks for.
+func (p *Printer) exchange(out uint8) uint8 {
+	n := len(p.packet)
+	if n == 0 && out != 0x88 || n == 1 && out != 0x33 {
+		p.packet = p.packet[:0]
+		return 0x00
+	}
+	p.packet = append(p.packet, out)
+	if n < 6 {
+		return 0x00
+	}
+
+	length := int(p.packet[4]) | int(p.packet[5])<<8
+	switch n - 6 - length {
+	case 1:
+		p.handle(length)
+	case 2:
+		return 0x81
+	case 3:
+		status := p.status
+		p.update()
+		p.packet = p.packet[:0]
+		return status
+	}
+	return 0x00
+}
+
+// Check and execute the complete packet.
+func (p *Printer) handle(length int) {
+	data := p.packet[6 : 6+length]
+	var sum uint16
+	for _, b := range p.packet[2 : 6+length] {
+		sum += uint16(b)
+	}
+	if sum != uint16(p.packet[6+length])|uint16(p.packet[7+length])<<8 {
+		p.status |= printerChecksumError
+		return
+	}
+	p.status &^= printerChecksumError
+
+	switch p.packet[2] {
+	case 0x01:
+		p.data = p.data[:0]
+		p.status = 0
+		p.busy = 0
+	case 0x02:
+		if length == 4 {
+			p.print(data[1], data[2])
+		}
+	case 0x04:
+		if p.packet[3]&0x01 != 0 {
+			data = decompress(data)
+		}
+		p.data = append(p.data, data...)
+		if len(p.data) > printerMemory {
+			p.data = p.data[:printerMemory]
+		}
+		if len(p.data) > 0 {
+			p.status |= printerUnprocessed
+		}
+		if len(p.data) == printerMemory {
+			p.status |= printerFull
+		}
+	case 0x08:
+		p.data = p.data[:0]
+		p.status &^= printerUnprocessed | printerFull | printerPrinting
+		p.busy = 0
+	}
+}
+
+// Let a print finish after some status requests.
+func (p *Printer) update() {
+	if p.packet[2] != 0x0f || p.busy == 0 {
+		return
+	}
+	p.busy--
+	if p.busy == 0 {
+		p.status &^= printerPrinting
+	}
+}
+
+func decompress(data []uint8) []uint8 {
+	var out []uint8
+	for i := 0; i < len(data); {
+		n := data[i]
+		i++
+		if n&0x80 != 0 {
+			if i < len(data) {
+				for j := 0; j < int(n&0x7f)+2; j++ {
+					out = append(out, data[i])
+				}
+			}
+			i++
+			continue
+		}
+		for j := 0; j <= int(n) && i < len(data); j++ {
+			out = append(out, data[i])
+			i++
+		}
+	}
+	return out
+}
+
+// Print the image data with the palette, and save the sheet if there is a margin after the image.
+func (p *Printer) print(margins uint8, palette uint8) {
+	p.addMargin(int(margins >> 4))
+	// tile rows of 20 tiles with 16 bytes each
+	for row := 0; row+320 <= len(p.data); row += 320 {
+		for y := 0; y < 8; y++ {
+			for x := 0; x < printerWidth; x++ {
+				tile := p.data[row+x/8*16+y*2:]
+				bit := 7 - uint(x%8)
+				color := tile[0]>>bit&1 | tile[1]>>bit&1<<1
+				p.sheet = append(p.sheet, printerShades[palette>>(color*2)&3])
+			}
+		}
+	}
+	p.data = p.data[:0]
+	p.status = p.status&^(printerUnprocessed|printerFull) | printerPrinting
+	p.busy = printerBusyPolls
+
+	if margins&0x0f != 0 {
+		p.addMargin(int(margins & 0x0f))
+		if err := p.save(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (p *Printer) addMargin(units int) {
+	for i := 0; i < units*printerMarginLines*printerWidth; i++ {
+		p.sheet = append(p.sheet, 0xff)
+	}
+}
+
+// Write the sheet printed so far into a PNG file.
+func (p *Printer) save() error {
+	if len(p.sheet) == 0 {
+		return nil
+	}
+	img := image.NewGray(image.Rect(0, 0, printerWidth, len(p.sheet)/printerWidth))
+	copy(img.Pix, p.sheet)
+	p.sheet = p.sheet[:0]
+	p.prints++
+	path := fmt.Sprintf("%s-%d.png", p.prefix, p.prints)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	log.Printf("printed %s", path)
+	return f.Close()
+}
+
+// Save what is left of the sheet.
+func (p *Printer) close() error {
+	return p.save()
+}
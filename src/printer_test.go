@@ -0,0 +1,105 @@
+package main
+
+import (
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Send a packet to the printer and return the status it answers with.
+func sendPacket(t *testing.T, p *Printer, command uint8, compressed bool, data []uint8) uint8 {
+	packet := []uint8{0x88, 0x33, command, 0, uint8(len(data)), uint8(len(data) >> 8)}
+	if compressed {
+		packet[3] = 1
+	}
+	packet = append(packet, data...)
+	var sum uint16
+	for _, b := range packet[2:] {
+		sum += uint16(b)
+	}
+	packet = append(packet, uint8(sum), uint8(sum>>8), 0, 0)
+
+	var replies []uint8
+	for _, b := range packet {
+		replies = append(replies, p.exchange(b))
+	}
+	if alive := replies[len(replies)-2]; alive != 0x81 {
+		t.Errorf("Expected the printer to answer 0x81 but got 0x%X", alive)
+	}
+	return replies[len(replies)-1]
+}
+
+// Test the run length encoding of the data packets
+func TestPrinterDecompress(t *testing.T) {
+	out := decompress([]uint8{0x81, 0xaa, 0x01, 0x12, 0x34})
+	expected := []uint8{0xaa, 0xaa, 0xaa, 0x12, 0x34}
+	if string(out) != string(expected) {
+		t.Errorf("Expected %v but got %v", expected, out)
+	}
+}
+
+// Test printing an image strip into a PNG with the palette and the margins
+func TestPrinterPrint(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "print")
+	p := newPrinter(prefix)
+	if status := sendPacket(t, p, 0x01, false, nil); status != 0 {
+		t.Errorf("Expected status 0 after init but got 0x%X", status)
+	}
+
+	// two tile rows of 320 bytes, the upper one color 3, the lower one color 0, compressed
+	data := []uint8{0xff, 0xff, 0xff, 0xff, 0xbc, 0xff, 0xff, 0x00, 0xff, 0x00, 0xbc, 0x00}
+	sendPacket(t, p, 0x04, true, data)
+	if status := sendPacket(t, p, 0x04, false, nil); status != printerUnprocessed {
+		t.Errorf("Expected unprocessed data 0x%X but got 0x%X", printerUnprocessed, status)
+	}
+
+	// the palette maps color 3 to white and color 0 to black, 1 margin after the image
+	status := sendPacket(t, p, 0x02, false, []uint8{1, 0x01, 0x1b, 0x40})
+	if status != printerPrinting {
+		t.Errorf("Expected printing 0x%X but got 0x%X", printerPrinting, status)
+	}
+	for i := 0; i < printerBusyPolls; i++ {
+		status = sendPacket(t, p, 0x0f, false, nil)
+	}
+	if status != printerPrinting {
+		t.Errorf("Expected the printer to be still printing but got 0x%X", status)
+	}
+	if status := sendPacket(t, p, 0x0f, false, nil); status != 0 {
+		t.Errorf("Expected the print to be finished but got 0x%X", status)
+	}
+
+	f, err := os.Open(prefix + "-1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 160 || size.Y != 16+printerMarginLines {
+		t.Fatalf("Expected 160x%d but got %dx%d", 16+printerMarginLines, size.X, size.Y)
+	}
+	for _, c := range []struct{ y, gray int }{{0, 0xff}, {8, 0x00}, {16, 0xff}} {
+		r, _, _, _ := img.At(5, c.y).RGBA()
+		if int(r>>8) != c.gray {
+			t.Errorf("Line %d: expected 0x%X but got 0x%X", c.y, c.gray, r>>8)
+		}
+	}
+}
+
+// Test that a wrong checksum is reported and the packet ignored
+func TestPrinterChecksum(t *testing.T) {
+	p := newPrinter(filepath.Join(t.TempDir(), "print"))
+	for _, b := range []uint8{0x88, 0x33, 0x04, 0x00, 0x01, 0x00, 0x55, 0x00, 0x00} {
+		p.exchange(b)
+	}
+	p.exchange(0x00)
+	if status := p.exchange(0x00); status != printerChecksumError {
+		t.Errorf("Expected a checksum error 0x%X but got 0x%X", printerChecksumError, status)
+	}
+	if len(p.data) != 0 {
+		t.Errorf("The data of the packet should be ignored")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+// The serial port shifts SB (0xff01) out bit by bit, most significant bit first, while the bits of the other
+// side are shifted in from the right. A transfer of 8 bits is started by setting bit 7 of SC:
+//
+// == SC register (0xff02) ==
+//
+//  -----------------------------------------------------------------
+// | bit 7 | transfer in progress, cleared at the end                |
+// | bit 1 | CGB mode only: fast clock, 262144 Hz instead of 8192 Hz |
+// | bit 0 | 1 = internal clock (master), 0 = external clock         |
+//  -----------------------------------------------------------------
+//
+// With the internal clock the Game Boy drives the clock of the cable, one bit every 512 clock cycles (16 with
+// the fast clock). The clock comes from a counter running along with the CPU, so it's twice as fast in CGB
+// double speed mode and the first bit of a transfer can come early. With the external clock the Game Boy
+// waits for the other side to drive the clock, for as long as it takes. At the end of a transfer bit 7 of SC
+// is cleared and the serial interrupt is requested.
+//
+// Nothing on the other side of the cable reads as a line pulled high, so 0xff is shifted in.
+
+// Counter bits whose falling edge shifts a bit with the internal clock, normal and fast.
+var serialBits = [2]uint{8, 3}
+
+// SerialPeer is the device at the other end of the link cable.
+type SerialPeer interface {
+	// Exchange the byte the Game Boy shifts out as the clock master for the byte of the peer.
+	exchange(out uint8) uint8
+}
+
+// Peers which follow the emulated time, e.g. to drive the clock, are advanced along with the Game Boy.
+type serialTicker interface {
+	tick(mem *Memory, dots int)
+}
+
+type Serial struct {
+	sb uint8
+	sc uint8
+
+	// runs along with the CPU, 4 clocks every M-cycle
+	counter uint16
+	// bits left to shift in the current transfer with the internal clock
+	bits int
+	// the byte of the peer, shifted into sb bit by bit
+	in uint8
+
+	peer   SerialPeer
+	ticker serialTicker
+	// called with every byte shifted out, e.g. to show the results of test ROMs
+	output func(uint8)
+}
+
+// Plug the peer into the serial port.
+func (s *Serial) connect(peer SerialPeer) {
+	s.peer = peer
+	s.ticker, _ = peer.(serialTicker)
+}
+
+func (s *Serial) read(addr uint16, cgb bool) uint8 {
+	if addr == 0xff01 {
+		return s.sb
+	}
+	if cgb {
+		return 0x7c | s.sc
+	}
+	return 0x7e | s.sc
+}
+
+func (s *Serial) write(addr uint16, val uint8, cgb bool) {
+	if addr == 0xff01 {
+		s.sb = val
+		return
+	}
+	s.sc = val & 0x81
+	if cgb {
+		s.sc |= val & 0x02
+	}
+	s.bits = 0
+	if s.sc&0x81 == 0x81 {
+		s.start()
+	}
+}
+
+// Start a transfer with the internal clock.
+func (s *Serial) start() {
+	s.bits = 8
+	s.in = 0xff
+	if s.peer != nil {
+		s.in = s.peer.exchange(s.sb)
+	}
+	if s.output != nil {
+		s.output(s.sb)
+	}
+}
+
+// Advance the serial port by one M-cycle.
+func (s *Serial) tick(mem *Memory) {
+	bit := serialBits[s.sc>>1&1]
+	before := s.counter&(1<<bit) != 0
+	s.counter += 4
+	if s.bits == 0 || !before || s.counter&(1<<bit) != 0 {
+		return
+	}
+
+	s.sb = s.sb<<1 | s.in>>7
+	s.in <<= 1
+	s.bits--
+	if s.bits == 0 {
+		s.finish(mem)
+	}
+}
+
+func (s *Serial) finish(mem *Memory) {
+	s.sc &^= 0x80
+	mem.requestInterrupt(intSerial)
+}
+
+// A peer driving the clock shifts a whole byte in and gets the byte of SB in return. Unless the Game Boy is
+// waiting for a transfer with the external clock nothing is shifted, and the peer reads 0xff.
+func (s *Serial) receive(mem *Memory, in uint8) uint8 {
+	if s.sc&0x81 != 0x80 {
+		return 0xff
+	}
+	out := s.sb
+	s.sb = in
+	if s.output != nil {
+		s.output(out)
+	}
+	s.finish(mem)
+	return out
+}
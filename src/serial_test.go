@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+type echoPeer struct {
+	received []uint8
+	reply    uint8
+}
+
+func (p *echoPeer) exchange(out uint8) uint8 {
+	p.received = append(p.received, out)
+	return p.reply
+}
+
+func tickSerial(mem *Memory, cycles int) {
+	for i := 0; i < cycles; i++ {
+		mem.serial.tick(mem)
+	}
+}
+
+// Test a transfer with the internal clock and no cable: 0xFF is shifted in within 8 * 128 M-cycles
+func TestSerialInternalClock(t *testing.T) {
+	mem := newMemory(nil)
+	var output []uint8
+	mem.serial.output = func(b uint8) { output = append(output, b) }
+	mem.Write(0xff01, 0x5a)
+	mem.Write(0xff02, 0x81)
+
+	tickSerial(mem, 128)
+	if val := mem.Read(0xff01); val != 0xb5 {
+		t.Errorf("Expected one bit shifted 0xB5 but got 0x%X", val)
+	}
+	tickSerial(mem, 7*128-1)
+	if mem.Read(0xff02)&0x80 == 0 || mem.ram[0xff0f]&intSerial != 0 {
+		t.Errorf("The transfer shouldn't be finished yet")
+	}
+	tickSerial(mem, 1)
+	if val := mem.Read(0xff01); val != 0xff {
+		t.Errorf("Expected 0xFF shifted in but got 0x%X", val)
+	}
+	if val := mem.Read(0xff02); val != 0x7f {
+		t.Errorf("Expected SC 0x7F after the transfer but got 0x%X", val)
+	}
+	if mem.ram[0xff0f]&intSerial == 0 {
+		t.Errorf("The serial interrupt should be requested")
+	}
+	if len(output) != 1 || output[0] != 0x5a {
+		t.Errorf("Expected the output 0x5A but got %v", output)
+	}
+}
+
+// Test that the fast clock only works in CGB mode
+func TestSerialFastClock(t *testing.T) {
+	mem := newMemory(nil)
+	mem.cgb = true
+	mem.Write(0xff02, 0x83)
+	if val := mem.Read(0xff02); val != 0xff {
+		t.Errorf("Expected SC 0xFF but got 0x%X", val)
+	}
+	tickSerial(mem, 8*4)
+	if mem.ram[0xff0f]&intSerial == 0 {
+		t.Errorf("The transfer should be finished after 32 M-cycles")
+	}
+
+	mem = newMemory(nil)
+	mem.Write(0xff02, 0x83)
+	if val := mem.Read(0xff02); val != 0xff {
+		t.Errorf("Expected SC 0xFF but got 0x%X", val)
+	}
+	tickSerial(mem, 8*4)
+	if mem.ram[0xff0f]&intSerial != 0 {
+		t.Errorf("The fast clock shouldn't work outside of CGB mode")
+	}
+}
+
+// Test that the peer gets the byte shifted out and its byte is shifted in
+func TestSerialPeer(t *testing.T) {
+	mem := newMemory(nil)
+	peer := &echoPeer{reply: 0x3c}
+	mem.serial.peer = peer
+	mem.Write(0xff01, 0x12)
+	mem.Write(0xff02, 0x81)
+	tickSerial(mem, 8*128)
+	if val := mem.Read(0xff01); val != 0x3c {
+		t.Errorf("Expected 0x3C from the peer but got 0x%X", val)
+	}
+	if len(peer.received) != 1 || peer.received[0] != 0x12 {
+		t.Errorf("Expected the peer to receive 0x12 but got %v", peer.received)
+	}
+}
+
+// Test that a transfer with the external clock waits for the peer
+func TestSerialExternalClock(t *testing.T) {
+	mem := newMemory(nil)
+	if out := mem.serial.receive(mem, 0x99); out != 0xff {
+		t.Errorf("Expected 0xFF without a transfer but got 0x%X", out)
+	}
+
+	mem.Write(0xff01, 0x42)
+	mem.Write(0xff02, 0x80)
+	tickSerial(mem, 10000)
+	if mem.Read(0xff02)&0x80 == 0 {
+		t.Errorf("The transfer shouldn't finish without the external clock")
+	}
+	if out := mem.serial.receive(mem, 0x99); out != 0x42 {
+		t.Errorf("Expected the peer to get 0x42 but got 0x%X", out)
+	}
+	if val := mem.Read(0xff01); val != 0x99 {
+		t.Errorf("Expected 0x99 shifted in but got 0x%X", val)
+	}
+	if mem.Read(0xff02)&0x80 != 0 || mem.ram[0xff0f]&intSerial == 0 {
+		t.Errorf("The transfer should be finished with the interrupt")
+	}
+}
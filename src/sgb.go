@@ -0,0 +1,530 @@
+package main
+
+// The Super Game Boy runs the Gameboy inside a SNES, which shows the 160x144 screen in the middle of a
+// 256x224 picture with a border around it. The game talks to the SNES by sending command packets through
+// the joypad register P1 (0xff00):
+//
+//  --------------------------------------------------
+// | P1 bits 5 - 4 | meaning                          |
+// | 0 0           | reset, start of a packet         |
+// | 1 0           | bit 0                            |
+// | 0 1           | bit 1                            |
+// | 1 1           | end of the pulse                 |
+//  --------------------------------------------------
+//
+// Every pulse is followed by writing 1 1. A packet is 16 bytes sent with the least significant bit first,
+// followed by a 0 bit. The first byte holds the command in bits 7 - 3 and the number of packets it spans
+// in bits 2 - 0.
+//
+//  ----------------------------------------------------------------------------
+// | 0x00 - 0x03 | PAL01, PAL23, PAL03, PAL12: set two palettes                 |
+// | 0x04        | ATTR_BLK: assign palettes to rectangles                      |
+// | 0x05        | ATTR_LIN: assign palettes to rows and columns                |
+// | 0x06        | ATTR_DIV: divide the screen into two halves and the line     |
+// | 0x07        | ATTR_CHR: assign palettes cell by cell                       |
+// | 0x0a        | PAL_SET: set all palettes from the system palettes           |
+// | 0x0b        | PAL_TRN: transfer the 512 system palettes                    |
+// | 0x11        | MLT_REQ: request 1, 2 or 4 joypads                           |
+// | 0x13        | CHR_TRN: transfer 128 border tiles                           |
+// | 0x14        | PCT_TRN: transfer the border tile map and palettes           |
+// | 0x15        | ATTR_TRN: transfer the 45 attribute files                    |
+// | 0x16        | ATTR_SET: apply an attribute file                            |
+// | 0x17        | MASK_EN: freeze or blank the screen                          |
+//  ----------------------------------------------------------------------------
+//
+// The screen is colored through four palettes of four colors, where color 0 is shared by all of them. The
+// palette is chosen for every 8x8 cell of the screen (the attribute map, 20x18 cells).
+//
+// The *_TRN commands transfer 4KB through the screen: the SNES reads the next frame as 256 tiles laid out
+// row by row, 20 tiles per row.
+
+const (
+	sgbWidth  = 256
+	sgbHeight = 224
+
+	// position of the game screen within the SGB picture
+	sgbScreenX = 48
+	sgbScreenY = 40
+
+	sgbAttrWidth  = screenWidth / 8
+	sgbAttrHeight = screenHeight / 8
+
+	sgbTransferSize = 0x1000
+	sgbAttrFiles    = 45
+)
+
+// SGB commands
+const (
+	sgbPal01   = 0x00
+	sgbPal23   = 0x01
+	sgbPal03   = 0x02
+	sgbPal12   = 0x03
+	sgbAttrBlk = 0x04
+	sgbAttrLin = 0x05
+	sgbAttrDiv = 0x06
+	sgbAttrChr = 0x07
+	sgbPalSet  = 0x0a
+	sgbPalTrn  = 0x0b
+	sgbMltReq  = 0x11
+	sgbChrTrn  = 0x13
+	sgbPctTrn  = 0x14
+	sgbAttrTrn = 0x15
+	sgbAttrSet = 0x16
+	sgbMaskEn  = 0x17
+)
+
+// MASK_EN modes
+const (
+	sgbMaskOff    = 0
+	sgbMaskFreeze = 1
+	sgbMaskBlack  = 2
+	sgbMaskColor0 = 3
+)
+
+// The palette the SGB starts with, in RGB555.
+var sgbDefaultPalette = [4]uint16{0x67bf, 0x265b, 0x10b5, 0x2866}
+
+type Sgb struct {
+	// packet being received
+	packet    [16]uint8
+	bits      int
+	receiving bool
+	pulse     bool
+	p1        uint8
+
+	// bytes of the command being received, which may span several packets
+	command []uint8
+
+	palettes       [4][4]uint16
+	systemPalettes [512][4]uint16
+	attrs          [sgbAttrHeight][sgbAttrWidth]uint8
+	attrFiles      [sgbAttrFiles][sgbAttrHeight][sgbAttrWidth]uint8
+	mask           uint8
+
+	// joypads requested through MLT_REQ and the one currently selected
+	players int
+	player  int
+
+	// border tiles (4 bits per pixel), tile map and palettes 4 - 7
+	borderTiles    [256 * 32]uint8
+	borderMap      [32 * 28]uint16
+	borderPalettes [4][16]uint16
+
+	// command waiting for a frame to transfer its data, its first parameter and the frames to skip
+	transfer       uint8
+	transferArg    uint8
+	transferFrames int
+
+	lastMode uint8
+	frame    [sgbWidth * sgbHeight * 4]uint8
+}
+
+func newSgb() *Sgb {
+	sgb := &Sgb{players: 1}
+	for i := range sgb.palettes {
+		sgb.palettes[i] = sgbDefaultPalette
+	}
+	return sgb
+}
+
+// Handle a write to P1.
+func (sgb *Sgb) writeP1(val uint8) {
+	val &= 0x30
+	prev := sgb.p1
+	sgb.p1 = val
+
+	switch val {
+	case 0x00:
+		sgb.receiving = true
+		sgb.pulse = false
+		sgb.bits = 0
+		sgb.packet = [16]uint8{}
+	case 0x10, 0x20:
+		if !sgb.receiving || sgb.pulse {
+			return
+		}
+		sgb.pulse = true
+		sgb.receiveBit(val == 0x10)
+	case 0x30:
+		sgb.pulse = false
+		if !sgb.receiving && prev&0x20 == 0 && sgb.players > 1 {
+			sgb.player = (sgb.player + 1) % sgb.players
+		}
+	}
+}
+
+// Receive the next bit of a packet. After 128 bits the stop bit ends the packet.
+func (sgb *Sgb) receiveBit(one bool) {
+	if sgb.bits == 128 {
+		sgb.receiving = false
+		if !one {
+			sgb.receivePacket()
+		}
+		return
+	}
+	if one {
+		sgb.packet[sgb.bits/8] |= 1 << (sgb.bits % 8)
+	}
+	sgb.bits++
+}
+
+// Collect the packets of a command and run it once all of them arrived.
+func (sgb *Sgb) receivePacket() {
+	if len(sgb.command) == 0 && sgb.packet[0]&0x07 == 0 {
+		// a command has to span at least one packet
+		return
+	}
+	sgb.command = append(sgb.command, sgb.packet[:]...)
+	if len(sgb.command) < int(sgb.command[0]&0x07)*16 {
+		return
+	}
+	sgb.run(sgb.command)
+	sgb.command = sgb.command[:0]
+}
+
+// Return the value read from P1. While several joypads are requested and neither button group is
+// selected, the lower bits hold the number of the current joypad.
+func (sgb *Sgb) readP1(val uint8) uint8 {
+	if sgb.players > 1 && val&0x30 == 0x30 {
+		return 0xf0 | (0x0f - uint8(sgb.player))
+	}
+	return val
+}
+
+func (sgb *Sgb) run(data []uint8) {
+	switch data[0] >> 3 {
+	case sgbPal01:
+		sgb.setPalettes(0, 1, data)
+	case sgbPal23:
+		sgb.setPalettes(2, 3, data)
+	case sgbPal03:
+		sgb.setPalettes(0, 3, data)
+	case sgbPal12:
+		sgb.setPalettes(1, 2, data)
+	case sgbAttrBlk:
+		sgb.attrBlk(data)
+	case sgbAttrLin:
+		sgb.attrLin(data)
+	case sgbAttrDiv:
+		sgb.attrDiv(data)
+	case sgbAttrChr:
+		sgb.attrChr(data)
+	case sgbPalSet:
+		sgb.palSet(data)
+	case sgbMltReq:
+		switch data[1] & 0x03 {
+		case 0:
+			sgb.players = 1
+		case 1:
+			sgb.players = 2
+		case 3:
+			sgb.players = 4
+		}
+		sgb.player = 0
+	case sgbPalTrn, sgbChrTrn, sgbPctTrn, sgbAttrTrn:
+		sgb.transfer = data[0] >> 3
+		sgb.transferArg = data[1]
+		sgb.transferFrames = 1
+	case sgbAttrSet:
+		sgb.applyAttrFile(data[1] & 0x3f)
+		if data[1]&0x40 != 0 {
+			sgb.mask = sgbMaskOff
+		}
+	case sgbMaskEn:
+		sgb.mask = data[1] & 0x03
+	}
+}
+
+// Return the little-endian 16-bit value at the given offset.
+func le16(data []uint8, i int) uint16 {
+	return uint16(data[i]) | uint16(data[i+1])<<8
+}
+
+// PAL01, PAL23, PAL03 and PAL12 set color 0 of all palettes and colors 1 - 3 of two palettes.
+func (sgb *Sgb) setPalettes(a, b int, data []uint8) {
+	color0 := le16(data, 1)
+	for i := range sgb.palettes {
+		sgb.palettes[i][0] = color0
+	}
+	for color := 1; color < 4; color++ {
+		sgb.palettes[a][color] = le16(data, 1+color*2)
+		sgb.palettes[b][color] = le16(data, 7+color*2)
+	}
+}
+
+// ATTR_BLK assigns palettes to the inside, the surrounding line and the outside of up to 18 rectangles.
+// If only the inside or only the outside is set, the surrounding line gets the same palette.
+func (sgb *Sgb) attrBlk(data []uint8) {
+	count := int(data[1] & 0x1f)
+	for set := 0; set < count && 2+set*6+6 <= len(data); set++ {
+		d := data[2+set*6:]
+		control := d[0] & 0x07
+		inside, line, outside := d[1]&0x03, (d[1]>>2)&0x03, (d[1]>>4)&0x03
+		switch control {
+		case 0x01:
+			control |= 0x02
+			line = inside
+		case 0x04:
+			control |= 0x02
+			line = outside
+		}
+		x1, y1, x2, y2 := int(d[2]&0x1f), int(d[3]&0x1f), int(d[4]&0x1f), int(d[5]&0x1f)
+
+		for y := 0; y < sgbAttrHeight; y++ {
+			for x := 0; x < sgbAttrWidth; x++ {
+				switch {
+				case x > x1 && x < x2 && y > y1 && y < y2:
+					if control&0x01 != 0 {
+						sgb.attrs[y][x] = inside
+					}
+				case x >= x1 && x <= x2 && y >= y1 && y <= y2:
+					if control&0x02 != 0 {
+						sgb.attrs[y][x] = line
+					}
+				default:
+					if control&0x04 != 0 {
+						sgb.attrs[y][x] = outside
+					}
+				}
+			}
+		}
+	}
+}
+
+// ATTR_LIN assigns palettes to whole rows (bit 7 set) or columns.
+func (sgb *Sgb) attrLin(data []uint8) {
+	count := int(data[1])
+	for i := 0; i < count && 2+i < len(data); i++ {
+		d := data[2+i]
+		n := int(d & 0x1f)
+		palette := (d >> 5) & 0x03
+		if d&0x80 != 0 {
+			if n < sgbAttrHeight {
+				for x := 0; x < sgbAttrWidth; x++ {
+					sgb.attrs[n][x] = palette
+				}
+			}
+		} else if n < sgbAttrWidth {
+			for y := 0; y < sgbAttrHeight; y++ {
+				sgb.attrs[y][n] = palette
+			}
+		}
+	}
+}
+
+// ATTR_DIV divides the screen at a row (bit 6 set) or column into the part before, the line itself and
+// the part after.
+func (sgb *Sgb) attrDiv(data []uint8) {
+	after, before, line := data[1]&0x03, (data[1]>>2)&0x03, (data[1]>>4)&0x03
+	horizontal := data[1]&0x40 != 0
+	n := int(data[2] & 0x1f)
+
+	for y := 0; y < sgbAttrHeight; y++ {
+		for x := 0; x < sgbAttrWidth; x++ {
+			pos := x
+			if horizontal {
+				pos = y
+			}
+			switch {
+			case pos < n:
+				sgb.attrs[y][x] = before
+			case pos == n:
+				sgb.attrs[y][x] = line
+			default:
+				sgb.attrs[y][x] = after
+			}
+		}
+	}
+}
+
+// ATTR_CHR assigns palettes cell by cell, left to right or top to bottom, 4 cells per byte.
+func (sgb *Sgb) attrChr(data []uint8) {
+	x, y := int(data[1]), int(data[2])
+	count := int(le16(data, 3))
+	vertical := data[5]&0x01 != 0
+
+	for i := 0; i < count && 6+i/4 < len(data); i++ {
+		if x >= sgbAttrWidth || y >= sgbAttrHeight {
+			return
+		}
+		sgb.attrs[y][x] = (data[6+i/4] >> (6 - uint(i%4)*2)) & 0x03
+
+		if vertical {
+			y++
+			if y == sgbAttrHeight {
+				y = 0
+				x++
+			}
+		} else {
+			x++
+			if x == sgbAttrWidth {
+				x = 0
+				y++
+			}
+		}
+	}
+}
+
+// PAL_SET sets the four palettes from the system palettes and optionally applies an attribute file.
+func (sgb *Sgb) palSet(data []uint8) {
+	for i := range sgb.palettes {
+		sgb.palettes[i] = sgb.systemPalettes[le16(data, 1+i*2)&0x1ff]
+	}
+	for i := range sgb.palettes {
+		sgb.palettes[i][0] = sgb.palettes[0][0]
+	}
+	if data[9]&0x80 != 0 {
+		sgb.applyAttrFile(data[9] & 0x3f)
+	}
+	if data[9]&0x40 != 0 {
+		sgb.mask = sgbMaskOff
+	}
+}
+
+// Copy one of the attribute files transferred by ATTR_TRN into the attribute map.
+func (sgb *Sgb) applyAttrFile(n uint8) {
+	if int(n) < sgbAttrFiles {
+		sgb.attrs = sgb.attrFiles[n]
+	}
+}
+
+// Advance by one M-cycle. At the start of VBlank the finished frame is used for a pending transfer and
+// drawn into the SGB picture.
+func (sgb *Sgb) tick(ppu *Ppu) {
+	if ppu.mode == modeVBlank && sgb.lastMode != modeVBlank {
+		sgb.vblank(ppu)
+	}
+	sgb.lastMode = ppu.mode
+}
+
+func (sgb *Sgb) vblank(ppu *Ppu) {
+	if sgb.transfer != 0 {
+		// the command may have arrived in the middle of a frame, the data is taken from the next full one
+		if sgb.transferFrames > 0 {
+			sgb.transferFrames--
+		} else {
+			sgb.receiveTransfer(screenData(ppu))
+			sgb.transfer = 0
+		}
+	}
+	sgb.render(ppu)
+}
+
+// Read the 4KB shown on the screen as 256 tiles, 20 per row.
+func screenData(ppu *Ppu) []uint8 {
+	data := make([]uint8, sgbTransferSize)
+	for tile := 0; tile < sgbTransferSize/16; tile++ {
+		tx, ty := tile%20*8, tile/20*8
+		for row := 0; row < 8; row++ {
+			var lo, hi uint8
+			for px := 0; px < 8; px++ {
+				shade := ppu.shades[(ty+row)*screenWidth+tx+px]
+				lo |= (shade & 0x01) << (7 - uint(px))
+				hi |= (shade >> 1) << (7 - uint(px))
+			}
+			data[tile*16+row*2] = lo
+			data[tile*16+row*2+1] = hi
+		}
+	}
+	return data
+}
+
+func (sgb *Sgb) receiveTransfer(data []uint8) {
+	switch sgb.transfer {
+	case sgbPalTrn:
+		for i := range sgb.systemPalettes {
+			for color := 0; color < 4; color++ {
+				sgb.systemPalettes[i][color] = le16(data, i*8+color*2)
+			}
+		}
+	case sgbChrTrn:
+		offset := 0
+		if sgb.transferArg&0x01 != 0 {
+			offset = len(sgb.borderTiles) / 2
+		}
+		copy(sgb.borderTiles[offset:], data)
+	case sgbPctTrn:
+		for i := range sgb.borderMap {
+			sgb.borderMap[i] = le16(data, i*2)
+		}
+		for palette := range sgb.borderPalettes {
+			for color := 0; color < 16; color++ {
+				sgb.borderPalettes[palette][color] = le16(data, 0x800+palette*32+color*2)
+			}
+		}
+	case sgbAttrTrn:
+		for n := range sgb.attrFiles {
+			for cell := 0; cell < sgbAttrWidth*sgbAttrHeight; cell++ {
+				b := data[n*90+cell/4]
+				sgb.attrFiles[n][cell/sgbAttrWidth][cell%sgbAttrWidth] = (b >> (6 - uint(cell%4)*2)) & 0x03
+			}
+		}
+	}
+}
+
+// Draw the border and the game screen into the SGB picture. While the screen is frozen, the game screen
+// keeps showing the last frame.
+func (sgb *Sgb) render(ppu *Ppu) {
+	backdrop := sgb.palettes[0][0]
+	for y := 0; y < sgbHeight; y++ {
+		for x := 0; x < sgbWidth; x++ {
+			if x >= sgbScreenX && x < sgbScreenX+screenWidth && y >= sgbScreenY && y < sgbScreenY+screenHeight {
+				continue
+			}
+			sgb.setPixel(x, y, backdrop)
+			if color, ok := sgb.borderPixel(x, y); ok {
+				sgb.setPixel(x, y, color)
+			}
+		}
+	}
+
+	if sgb.mask == sgbMaskFreeze {
+		return
+	}
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			var color uint16
+			switch sgb.mask {
+			case sgbMaskBlack:
+				color = 0
+			case sgbMaskColor0:
+				color = sgb.palettes[0][0]
+			default:
+				shade := ppu.shades[y*screenWidth+x]
+				color = sgb.palettes[sgb.attrs[y/8][x/8]][shade]
+			}
+			sgb.setPixel(sgbScreenX+x, sgbScreenY+y, color)
+		}
+	}
+}
+
+// Return the color of the border at the given position, if it is not transparent.
+func (sgb *Sgb) borderPixel(x, y int) (uint16, bool) {
+	entry := sgb.borderMap[(y/8)*32+x/8]
+	tile := int(entry & 0xff)
+	// palettes 4 - 7
+	palette := (entry >> 10) & 0x07
+	px, row := x%8, y%8
+	if entry&0x4000 != 0 {
+		px = 7 - px
+	}
+	if entry&0x8000 != 0 {
+		row = 7 - row
+	}
+
+	t := sgb.borderTiles[tile*32:]
+	bit := 7 - uint(px)
+	color := (t[row*2]>>bit)&1 | ((t[row*2+1]>>bit)&1)<<1 | ((t[16+row*2]>>bit)&1)<<2 | ((t[16+row*2+1]>>bit)&1)<<3
+	if color == 0 {
+		return 0, false
+	}
+	return sgb.borderPalettes[palette&0x03][color], true
+}
+
+func (sgb *Sgb) setPixel(x, y int, rgb uint16) {
+	i := (y*sgbWidth + x) * 4
+	sgb.frame[i] = expandColor(uint8(rgb & 0x1f))
+	sgb.frame[i+1] = expandColor(uint8(rgb>>5) & 0x1f)
+	sgb.frame[i+2] = expandColor(uint8(rgb>>10) & 0x1f)
+	sgb.frame[i+3] = 0xff
+}
@@ -0,0 +1,174 @@
+package main
+
+import "testing"
+
+func sgbTestMemory() (*Memory, *Ppu, *Sgb) {
+	mem, ppu := ppuTestMemory()
+	mem.sgb = newSgb()
+	return mem, ppu, mem.sgb
+}
+
+// Send a command through P1, padding every packet to 16 bytes.
+func sendSgbCommand(mem *Memory, data ...uint8) {
+	for len(data)%16 != 0 {
+		data = append(data, 0)
+	}
+	for p := 0; p < len(data); p += 16 {
+		mem.Write(0xff00, 0x00)
+		mem.Write(0xff00, 0x30)
+		for _, b := range data[p : p+16] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(1<<bit) != 0 {
+					mem.Write(0xff00, 0x10)
+				} else {
+					mem.Write(0xff00, 0x20)
+				}
+				mem.Write(0xff00, 0x30)
+			}
+		}
+		// stop bit
+		mem.Write(0xff00, 0x20)
+		mem.Write(0xff00, 0x30)
+	}
+}
+
+// Test that PAL01 received bit by bit through P1 sets the palettes
+func TestSgbPalettes(t *testing.T) {
+	mem, _, sgb := sgbTestMemory()
+	sendSgbCommand(mem, sgbPal01<<3|1, 0x11, 0x11, 0x01, 0x10, 0x02, 0x20, 0x03, 0x30, 0x04, 0x40, 0x05, 0x50, 0x06, 0x60)
+
+	expected := [4]uint16{0x1111, 0x1001, 0x2002, 0x3003}
+	if sgb.palettes[0] != expected {
+		t.Errorf("Palette 0 was not set correctly. Expected %X but got %X", expected, sgb.palettes[0])
+	}
+	expected = [4]uint16{0x1111, 0x4004, 0x5005, 0x6006}
+	if sgb.palettes[1] != expected {
+		t.Errorf("Palette 1 was not set correctly. Expected %X but got %X", expected, sgb.palettes[1])
+	}
+	if sgb.palettes[3][0] != 0x1111 || sgb.palettes[3][1] != sgbDefaultPalette[1] {
+		t.Errorf("Only color 0 of the other palettes should have changed")
+	}
+}
+
+// Test ATTR_BLK, ATTR_LIN, ATTR_DIV and ATTR_CHR
+func TestSgbAttributes(t *testing.T) {
+	mem, _, sgb := sgbTestMemory()
+
+	// inside only: the surrounding line gets the inside palette too
+	sendSgbCommand(mem, sgbAttrBlk<<3|1, 1, 0x01, 0x02, 2, 2, 5, 5)
+	if sgb.attrs[2][2] != 2 || sgb.attrs[3][3] != 2 || sgb.attrs[1][1] != 0 || sgb.attrs[6][6] != 0 {
+		t.Errorf("ATTR_BLK did not assign the palettes correctly")
+	}
+
+	sendSgbCommand(mem, sgbAttrLin<<3|1, 2, 0x80|0x60|10, 0x20|15)
+	if sgb.attrs[10][0] != 3 || sgb.attrs[10][19] != 3 || sgb.attrs[0][15] != 1 || sgb.attrs[17][15] != 1 {
+		t.Errorf("ATTR_LIN did not assign the palettes correctly")
+	}
+
+	// vertical division at x = 5: left palette 1, line palette 2, right palette 3
+	sendSgbCommand(mem, sgbAttrDiv<<3|1, 0x20|0x04|0x03, 5)
+	if sgb.attrs[0][4] != 1 || sgb.attrs[9][5] != 2 || sgb.attrs[17][6] != 3 {
+		t.Errorf("ATTR_DIV did not assign the palettes correctly")
+	}
+
+	// 5 cells from (18, 0) left to right, wrapping to the next row
+	sendSgbCommand(mem, sgbAttrChr<<3|1, 18, 0, 5, 0, 0, 0x1b, 0x40)
+	if sgb.attrs[0][18] != 0 || sgb.attrs[0][19] != 1 || sgb.attrs[1][0] != 2 || sgb.attrs[1][1] != 3 || sgb.attrs[1][2] != 1 {
+		t.Errorf("ATTR_CHR did not assign the palettes correctly")
+	}
+}
+
+// Test that MLT_REQ makes P1 return the current joypad, which advances with P15 going high
+func TestSgbMultiplayer(t *testing.T) {
+	mem, _, _ := sgbTestMemory()
+	sendSgbCommand(mem, sgbMltReq<<3|1, 0x01)
+
+	mem.Write(0xff00, 0x30)
+	first := mem.Read(0xff00) & 0x0f
+	mem.Write(0xff00, 0x10)
+	mem.Write(0xff00, 0x30)
+	second := mem.Read(0xff00) & 0x0f
+	if first == second || (first != 0x0f && first != 0x0e) || (second != 0x0f && second != 0x0e) {
+		t.Errorf("Joypad ID did not advance. Got 0x%X and 0x%X", first, second)
+	}
+	mem.Write(0xff00, 0x10)
+	mem.Write(0xff00, 0x30)
+	if val := mem.Read(0xff00) & 0x0f; val != first {
+		t.Errorf("Joypad ID should wrap around with 2 players. Expected 0x%X but got 0x%X", first, val)
+	}
+}
+
+// Test that the border is transferred through the screen and drawn around the game screen
+func TestSgbBorder(t *testing.T) {
+	_, ppu, sgb := sgbTestMemory()
+
+	// CHR_TRN: tile 1 is solid color 1 (bitplane 0 set)
+	data := make([]uint8, sgbTransferSize)
+	for row := 0; row < 8; row++ {
+		data[32+row*2] = 0xff
+	}
+	sgb.transfer = sgbChrTrn
+	sgb.receiveTransfer(data)
+
+	// PCT_TRN: the top left entry uses tile 1 with palette 4, whose color 1 is red
+	data = make([]uint8, sgbTransferSize)
+	data[0], data[1] = 0x01, 4<<2
+	data[0x800+2], data[0x800+3] = 0x1f, 0x00
+	sgb.transfer = sgbPctTrn
+	sgb.receiveTransfer(data)
+	sgb.transfer = 0
+
+	for i := range ppu.shades {
+		ppu.shades[i] = 3
+	}
+	sgb.render(ppu)
+
+	pixel := func(x, y int) [3]uint8 {
+		i := (y*sgbWidth + x) * 4
+		return [3]uint8{sgb.frame[i], sgb.frame[i+1], sgb.frame[i+2]}
+	}
+	if p := pixel(0, 0); p != [3]uint8{0xff, 0x00, 0x00} {
+		t.Errorf("Border tile is not drawn correctly. Expected red but got %v", p)
+	}
+	if p := pixel(8, 0); p != [3]uint8{0xff, 0xef, 0xce} {
+		t.Errorf("Transparent border should show color 0. Expected 0xFFEFCE but got %v", p)
+	}
+	if p := pixel(sgbScreenX, sgbScreenY); p != [3]uint8{0x31, 0x18, 0x52} {
+		t.Errorf("Game screen is not drawn in palette 0. Expected 0x311852 but got %v", p)
+	}
+}
+
+// Test that ATTR_TRN takes its data from the first full frame after the command
+func TestSgbTransferFromScreen(t *testing.T) {
+	mem, ppu, sgb := sgbTestMemory()
+	sendSgbCommand(mem, sgbAttrTrn<<3|1)
+	// the first byte of the data is 0xe4, which makes attribute file 0 start with cell palettes 3, 2, 1, 0
+	for i, shade := range []uint8{1, 1, 1, 0, 0, 1, 0, 0} {
+		ppu.shades[i] = shade
+	}
+
+	sgb.vblank(ppu)
+	if sgb.transfer == 0 {
+		t.Fatalf("Transfer should wait for the next frame")
+	}
+	sgb.vblank(ppu)
+	if sgb.transfer != 0 {
+		t.Fatalf("Transfer did not happen")
+	}
+
+	sendSgbCommand(mem, sgbAttrSet<<3|1, 0x40)
+	if sgb.attrs[0][0] != 3 || sgb.attrs[0][1] != 2 || sgb.attrs[0][2] != 1 || sgb.attrs[0][3] != 0 {
+		t.Errorf("Attribute file was not transferred correctly. Got %v", sgb.attrs[0][:4])
+	}
+}
+
+// Test that setting up P1 after the boot doesn't start a packet
+func TestSgbPostBoot(t *testing.T) {
+	gb := newGameboy(SGB, testCartridge(), nil)
+	if gb.sgb.receiving {
+		t.Errorf("The SGB shouldn't receive a packet after the boot")
+	}
+	if val := gb.mem.Read(0xff00); val != 0xcf {
+		t.Errorf("Expected P1 0xCF after the boot but got 0x%X", val)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+// In CGB mode the CPU can switch to double speed, running at 8.388608 MHz. The CPU and everything clocked
+// along with it (the timer, serial port and OAM DMA) run twice as fast, while the PPU and APU keep their
+// normal speed. An M-cycle of the CPU is then only two dots long.
+//
+// == KEY1 register (0xff4d) ==
+//
+//  -----------------------------------------
+// | bit 7 | current speed: 1 = double speed |
+// | bit 0 | prepare speed switch            |
+//  -----------------------------------------
+//
+// The switch happens when the CPU executes STOP with bit 0 set. The CPU is stopped for 2050 M-cycles
+// while the clock switches, after that bit 0 is cleared again.
+
+const speedSwitchCycles = 2050
+
+type Speed struct {
+	double bool
+	armed  bool
+
+	// M-cycles left until the CPU runs again after a speed switch
+	pause int
+}
+
+func (s *Speed) read() uint8 {
+	val := uint8(0x7e)
+	if s.double {
+		val |= 0x80
+	}
+	if s.armed {
+		val |= 0x01
+	}
+	return val
+}
+
+func (s *Speed) write(val uint8) {
+	s.armed = val&0x01 != 0
+}
+
+// Switch the speed if it was prepared through KEY1. Called when the CPU executes STOP, returns whether
+// the speed was switched.
+func (s *Speed) stop() bool {
+	if !s.armed {
+		return false
+	}
+	s.double = !s.double
+	s.armed = false
+	s.pause = speedSwitchCycles
+	return true
+}
+
+// Return the number of dots an M-cycle of the CPU takes at the current speed.
+func (s *Speed) dotsPerCycle() int {
+	if s.double {
+		return 2
+	}
+	return 4
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+// Test that STOP switches to double speed after KEY1 was prepared and the PPU keeps its speed
+func TestSpeedSwitch(t *testing.T) {
+	initOpCodes()
+	cart := testCartridge()
+	cart.rom[0x0143] = 0x80
+	cart.rom[0x0100] = 0x10 // STOP
+	cart.rom[0x0101] = 0x00
+
+	gb := newGameboy(CGB, cart, nil)
+	if val := gb.mem.Read(0xff4d); val != 0x7e {
+		t.Errorf("KEY1 should start in normal speed. Expected 0x7E but got 0x%X", val)
+	}
+	gb.mem.Write(0xff4d, 0x01)
+	if val := gb.mem.Read(0xff4d); val != 0x7f {
+		t.Errorf("Speed switch was not prepared. Expected 0x7F but got 0x%X", val)
+	}
+
+	gb.step()
+	if gb.cpu.PC != 0x0102 {
+		t.Errorf("STOP should take two bytes. Expected PC 0x0102 but got 0x%X", gb.cpu.PC)
+	}
+	if val := gb.mem.Read(0xff4d); val != 0xfe {
+		t.Errorf("CPU did not switch to double speed. Expected 0xFE but got 0x%X", val)
+	}
+
+	for i := 0; i < speedSwitchCycles; i++ {
+		gb.step()
+	}
+	if gb.cpu.PC != 0x0102 {
+		t.Errorf("CPU should be stopped during the speed switch. Expected PC 0x0102 but got 0x%X", gb.cpu.PC)
+	}
+
+	gb.dots = 0
+	gb.step()
+	if gb.dots != 2 {
+		t.Errorf("An M-cycle should take two dots in double speed. Expected 2 but got %d", gb.dots)
+	}
+}
+
+// Test that STOP does not switch the speed outside of CGB mode
+func TestSpeedSwitchDmgMode(t *testing.T) {
+	initOpCodes()
+	cart := testCartridge()
+	cart.rom[0x0100] = 0x10 // STOP
+
+	gb := newGameboy(CGB, cart, nil)
+	gb.mem.Write(0xff4d, 0x01)
+	gb.step()
+	if val := gb.mem.Read(0xff4d); val != 0xff {
+		t.Errorf("KEY1 should not be mapped in DMG compatibility mode. Expected 0xFF but got 0x%X", val)
+	}
+	if gb.mem.speed.double {
+		t.Errorf("CPU should not switch to double speed in DMG compatibility mode")
+	}
+}
+
+// Test the work RAM banks selected through SVBK
+func TestWramBanks(t *testing.T) {
+	mem := newMemory(nil)
+	mem.cgb = true
+
+	for bank := uint8(0); bank < 8; bank++ {
+		mem.Write(0xff70, bank)
+		mem.Write(0xd000, bank+0x10)
+	}
+	mem.Write(0xff70, 0x00)
+	if val := mem.Read(0xd000); val != 0x11 {
+		t.Errorf("Bank 0 should select bank 1. Expected 0x11 but got 0x%X", val)
+	}
+	for bank := uint8(2); bank < 8; bank++ {
+		mem.Write(0xff70, 0xf8|bank)
+		if val := mem.Read(0xd000); val != bank+0x10 {
+			t.Errorf("Bank %d was not selected. Expected 0x%X but got 0x%X", bank, bank+0x10, val)
+		}
+	}
+	if val := mem.Read(0xff70); val != 0xff {
+		t.Errorf("SVBK was not read correctly. Expected 0xFF but got 0x%X", val)
+	}
+	mem.Write(0xc000, 0xab)
+	if val := mem.Read(0xc000); val != 0xab {
+		t.Errorf("Bank 0 should not be switched. Expected 0xAB but got 0x%X", val)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+// The timer is built around a 16-bit counter which increases with every clock of the CPU, so by 4 every
+// M-cycle. Its upper 8 bits are visible as DIV (0xff04), writing any value to DIV resets the whole counter.
+//
+// == TAC register (0xff07) ==
+//
+//  -------------------------------------------------
+// | bit 2     | enable TIMA                         |
+// | bit 1 - 0 | clock: 00 = 4096 Hz (counter bit 9) |
+// |           |        01 = 262144 Hz (bit 3)       |
+// |           |        10 = 65536 Hz (bit 5)        |
+// |           |        11 = 16384 Hz (bit 7)        |
+//  -------------------------------------------------
+//
+// TIMA (0xff05) increases whenever the selected counter bit AND the enable bit fall from 1 to 0. That is why
+// writing DIV or TAC can increase TIMA as well: resetting the counter or switching to another bit or
+// disabling the timer can make the signal fall.
+//
+// When TIMA overflows it reads 0x00 for one M-cycle. Only in the M-cycle after that TMA (0xff06) is loaded
+// into TIMA and the timer interrupt is requested. Writing TIMA in the M-cycle of the overflow cancels both,
+// writing it in the M-cycle of the reload is ignored, and writing TMA in that M-cycle loads the new value
+// into TIMA as well.
+//
+// The timer is clocked by the CPU, so it runs twice as fast in CGB double speed mode.
+
+// Counter bits selected by bits 1 - 0 of TAC.
+var timerBits = [4]uint{9, 3, 5, 7}
+
+type Timer struct {
+	counter uint16
+	tima    uint8
+	tma     uint8
+	tac     uint8
+
+	// TIMA overflowed in the last M-cycle, it is reloaded in this one
+	overflow bool
+	// TIMA is reloaded from TMA in the current M-cycle
+	reloading bool
+}
+
+func (t *Timer) read(addr uint16) uint8 {
+	switch addr {
+	case 0xff04:
+		return uint8(t.counter >> 8)
+	case 0xff05:
+		return t.tima
+	case 0xff06:
+		return t.tma
+	}
+	return t.tac | 0xf8
+}
+
+func (t *Timer) write(addr uint16, val uint8) {
+	switch addr {
+	case 0xff04:
+		before := t.signal()
+		t.counter = 0
+		t.checkEdge(before)
+	case 0xff05:
+		if t.reloading {
+			return
+		}
+		t.overflow = false
+		t.tima = val
+	case 0xff06:
+		t.tma = val
+		if t.reloading {
+			t.tima = val
+		}
+	case 0xff07:
+		before := t.signal()
+		t.tac = val & 0x07
+		t.checkEdge(before)
+	}
+}
+
+// The signal TIMA counts the falling edges of.
+func (t *Timer) signal() bool {
+	return t.tac&0x04 != 0 && t.counter&(1<<timerBits[t.tac&0x03]) != 0
+}
+
+func (t *Timer) checkEdge(before bool) {
+	if before && !t.signal() {
+		t.tima++
+		if t.tima == 0 {
+			t.overflow = true
+		}
+	}
+}
+
+// Advance the timer by one M-cycle.
+func (t *Timer) tick(mem *Memory) {
+	t.reloading = false
+	if t.overflow {
+		t.overflow = false
+		t.reloading = true
+		t.tima = t.tma
+		mem.requestInterrupt(intTimer)
+	}
+
+	before := t.signal()
+	t.counter += 4
+	t.checkEdge(before)
+}
@@ -0,0 +1,158 @@
+package main
+
+import "testing"
+
+func timerTestMemory() (*Memory, *Timer) {
+	mem := newMemory(nil)
+	return mem, mem.timer
+}
+
+func tickTimer(mem *Memory, cycles int) {
+	for i := 0; i < cycles; i++ {
+		mem.timer.tick(mem)
+	}
+}
+
+// Test that DIV shows the upper bits of the counter and writing it resets the counter
+func TestTimerDiv(t *testing.T) {
+	mem, _ := timerTestMemory()
+	tickTimer(mem, 64*3)
+	if val := mem.Read(0xff04); val != 3 {
+		t.Errorf("Expected DIV 3 but got %d", val)
+	}
+	mem.Write(0xff04, 0x55)
+	if val := mem.Read(0xff04); val != 0 {
+		t.Errorf("Writing DIV should reset it. Expected 0 but got %d", val)
+	}
+}
+
+// Test the rate of TIMA for every clock selected by TAC
+func TestTimerRates(t *testing.T) {
+	for tac, cycles := range []int{256, 4, 16, 64} {
+		mem, timer := timerTestMemory()
+		mem.Write(0xff07, 0x04|uint8(tac))
+		tickTimer(mem, cycles-1)
+		if timer.tima != 0 {
+			t.Errorf("TAC %d: TIMA increased too early", tac)
+		}
+		tickTimer(mem, 1)
+		if timer.tima != 1 {
+			t.Errorf("TAC %d: Expected TIMA 1 after %d M-cycles but got %d", tac, cycles, timer.tima)
+		}
+	}
+}
+
+// Test that TMA is reloaded and the interrupt requested one M-cycle after the overflow
+func TestTimerOverflow(t *testing.T) {
+	mem, timer := timerTestMemory()
+	mem.Write(0xff06, 0xab)
+	mem.Write(0xff05, 0xff)
+	mem.Write(0xff07, 0x05)
+
+	tickTimer(mem, 4)
+	if timer.tima != 0x00 || mem.ram[0xff0f]&intTimer != 0 {
+		t.Errorf("TIMA should read 0x00 without an interrupt right after the overflow but got 0x%X", timer.tima)
+	}
+	tickTimer(mem, 1)
+	if timer.tima != 0xab {
+		t.Errorf("TMA should be reloaded. Expected 0xAB but got 0x%X", timer.tima)
+	}
+	if mem.ram[0xff0f]&intTimer == 0 {
+		t.Errorf("The timer interrupt should be requested")
+	}
+}
+
+// Test writes to TIMA and TMA around the overflow
+func TestTimerReloadWrites(t *testing.T) {
+	// writing TIMA in the M-cycle of the overflow cancels the reload and the interrupt
+	mem, timer := timerTestMemory()
+	mem.Write(0xff06, 0xab)
+	mem.Write(0xff05, 0xff)
+	mem.Write(0xff07, 0x05)
+	tickTimer(mem, 4)
+	mem.Write(0xff05, 0x12)
+	tickTimer(mem, 1)
+	if timer.tima != 0x12 || mem.ram[0xff0f]&intTimer != 0 {
+		t.Errorf("The reload should be cancelled. Expected 0x12 but got 0x%X", timer.tima)
+	}
+
+	// writing TIMA in the M-cycle of the reload is ignored, writing TMA goes to TIMA as well
+	mem, timer = timerTestMemory()
+	mem.Write(0xff06, 0xab)
+	mem.Write(0xff05, 0xff)
+	mem.Write(0xff07, 0x05)
+	tickTimer(mem, 5)
+	mem.Write(0xff05, 0x12)
+	if timer.tima != 0xab {
+		t.Errorf("Writing TIMA during the reload should be ignored. Expected 0xAB but got 0x%X", timer.tima)
+	}
+	mem.Write(0xff06, 0x34)
+	if timer.tima != 0x34 {
+		t.Errorf("Writing TMA during the reload should load TIMA. Expected 0x34 but got 0x%X", timer.tima)
+	}
+	tickTimer(mem, 1)
+	mem.Write(0xff05, 0x56)
+	if timer.tima != 0x56 {
+		t.Errorf("Writing TIMA after the reload should work. Expected 0x56 but got 0x%X", timer.tima)
+	}
+}
+
+// Test that writing DIV or TAC increases TIMA if the selected counter bit falls
+func TestTimerGlitches(t *testing.T) {
+	mem, timer := timerTestMemory()
+	mem.Write(0xff07, 0x05) // bit 3
+	tickTimer(mem, 2)
+	mem.Write(0xff04, 0x00)
+	if timer.tima != 1 {
+		t.Errorf("Resetting DIV with bit 3 set should increase TIMA. Expected 1 but got %d", timer.tima)
+	}
+
+	tickTimer(mem, 2)
+	mem.Write(0xff07, 0x01)
+	if timer.tima != 2 {
+		t.Errorf("Disabling the timer with bit 3 set should increase TIMA. Expected 2 but got %d", timer.tima)
+	}
+
+	mem.Write(0xff07, 0x05)
+	mem.Write(0xff07, 0x06) // bit 5, which is 0
+	if timer.tima != 3 {
+		t.Errorf("Switching to a cleared bit should increase TIMA. Expected 3 but got %d", timer.tima)
+	}
+
+	mem.Write(0xff04, 0x00)
+	mem.Write(0xff07, 0x04) // bit 9
+	if timer.tima != 3 {
+		t.Errorf("Switching between cleared bits shouldn't increase TIMA. Expected 3 but got %d", timer.tima)
+	}
+}
+
+// Test that a CPU write to TIMA lands in the last M-cycle of LDH (n),A: it cancels an overflow in that M-cycle
+// and is ignored during the reload in it
+func TestTimerCpuWrite(t *testing.T) {
+	initOpCodes()
+	cart := testCartridge()
+	copy(cart.rom[0x0100:], []uint8{0xe0, 0x05}) // LDH (0x05),A
+
+	// counter 0x04 overflows TIMA in the third M-cycle, 0x08 in the second one
+	for _, test := range []struct {
+		counter uint16
+		tima    uint8
+	}{{0x04, 0x12}, {0x08, 0xab}} {
+		gb := newGameboy(DMG, cart, nil)
+		gb.cpu.setA(0x12)
+		gb.mem.ram[0xff0f] = 0
+		gb.mem.timer.counter = test.counter
+		gb.mem.Write(0xff06, 0xab)
+		gb.mem.Write(0xff05, 0xff)
+		gb.mem.Write(0xff07, 0x05)
+
+		gb.step()
+		gb.tick()
+		if gb.mem.timer.tima != test.tima {
+			t.Errorf("Counter 0x%02X: expected TIMA 0x%X but got 0x%X", test.counter, test.tima, gb.mem.timer.tima)
+		}
+		if interrupt := gb.mem.ram[0xff0f]&intTimer != 0; interrupt != (test.tima == 0xab) {
+			t.Errorf("Counter 0x%02X: the timer interrupt should only be requested with the reload", test.counter)
+		}
+	}
+}
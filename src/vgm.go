@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+)
+
+// Logging of the APU register writes into a VGM file (version 1.61), which chiptune players can play back
+// with their own emulation of the Game Boy DMG sound chip. The file starts with a 0x100 byte header, of which
+// only a few fields are used here:
+//
+//  ---------------------------------------------------
+// | 0x00 | "Vgm "                                     |
+// | 0x04 | file size - 4                              |
+// | 0x08 | version (0x161)                            |
+// | 0x18 | total number of samples                    |
+// | 0x34 | offset of the data, relative to 0x34       |
+// | 0x80 | clock of the Game Boy DMG                  |
+//  ---------------------------------------------------
+//
+// The data is a list of commands, where the time is counted in samples of 44100 Hz:
+//
+//  ---------------------------------------------------
+// | 0xb3 aa dd | write dd to the register 0xff10 + aa |
+// | 0x61 nn nn | wait nnnn samples                    |
+// | 0x62       | wait 735 samples (1/60 s)            |
+// | 0x63       | wait 882 samples (1/50 s)            |
+// | 0x7n       | wait n + 1 samples                   |
+// | 0x66       | end of the data                      |
+//  ---------------------------------------------------
+//
+// The waits are derived from the dots passed since the logging started, so the same run of a game always
+// gives the same file.
+
+const (
+	vgmHeaderSize = 0x100
+	vgmSampleRate = 44100
+)
+
+type vgmLogger struct {
+	file   *os.File
+	writer *bufio.Writer
+	size   int
+
+	// dots since the logging started and samples waited for so far
+	dots    int64
+	samples int64
+}
+
+func createVgm(path string) (*vgmLogger, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, vgmHeaderSize)
+	copy(header, "Vgm ")
+	binary.LittleEndian.PutUint32(header[0x08:], 0x161)
+	binary.LittleEndian.PutUint32(header[0x34:], vgmHeaderSize-0x34)
+	binary.LittleEndian.PutUint32(header[0x80:], clockRate)
+
+	v := &vgmLogger{file: file, writer: bufio.NewWriter(file)}
+	v.emit(header...)
+	return v, nil
+}
+
+func (v *vgmLogger) emit(data ...byte) {
+	v.writer.Write(data)
+	v.size += len(data)
+}
+
+func (v *vgmLogger) tick(dots int) {
+	v.dots += int64(dots)
+}
+
+// Log a write to an APU register.
+func (v *vgmLogger) write(addr uint16, val uint8) {
+	v.wait()
+	v.emit(0xb3, uint8(addr-0xff10), val)
+}
+
+// Log the current state of the APU, so a log started in the middle of a game plays back correctly. The
+// channels aren't triggered, they start with the next write of the game.
+func (v *vgmLogger) writeState(apu *Apu) {
+	if !apu.power {
+		v.write(0xff26, 0x00)
+		return
+	}
+	v.write(0xff26, 0x80)
+	for i, val := range apu.wave.ram {
+		v.write(0xff30+uint16(i), val)
+	}
+	for addr := uint16(0xff10); addr < 0xff26; addr++ {
+		val := apu.regs[addr-0xff10]
+		if addr == 0xff14 || addr == 0xff19 || addr == 0xff1e || addr == 0xff23 {
+			val &^= 0x80
+		}
+		v.write(addr, val)
+	}
+}
+
+// Catch up with the time passed since the last command.
+func (v *vgmLogger) wait() {
+	delta := v.dots*vgmSampleRate/clockRate - v.samples
+	v.samples += delta
+	for delta > 0 {
+		switch {
+		case delta == 735:
+			v.emit(0x62)
+			delta = 0
+		case delta == 882:
+			v.emit(0x63)
+			delta = 0
+		case delta <= 16:
+			v.emit(0x70 + uint8(delta-1))
+			delta = 0
+		default:
+			n := delta
+			if n > 0xffff {
+				n = 0xffff
+			}
+			v.emit(0x61, uint8(n), uint8(n>>8))
+			delta -= n
+		}
+	}
+}
+
+// End the data, fill in the header and close the file.
+func (v *vgmLogger) close() error {
+	v.wait()
+	v.emit(0x66)
+	if err := v.writer.Flush(); err != nil {
+		v.file.Close()
+		return err
+	}
+	var buf [4]byte
+	for _, field := range []struct {
+		offset int64
+		val    uint32
+	}{{0x04, uint32(v.size - 4)}, {0x18, uint32(v.samples)}} {
+		binary.LittleEndian.PutUint32(buf[:], field.val)
+		if _, err := v.file.WriteAt(buf[:], field.offset); err != nil {
+			v.file.Close()
+			return err
+		}
+	}
+	return v.file.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that register writes are logged with waits derived from the dots between them
+func TestVgmLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.vgm")
+	v, err := createVgm(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, apu := apuTestMemory()
+	apu.vgm = v
+
+	mem.Write(0xff12, 0xf0)
+	apu.tick(69906) // 735 samples
+	mem.Write(0xff14, 0x87)
+	apu.tick(4 * 95)
+	mem.Write(0xff30, 0x12)
+	mem.Write(0xff27, 0x34)
+	apu.tick(clockRate)
+	if err := v.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:4]) != "Vgm " {
+		t.Fatalf("Invalid VGM header % X", data[:4])
+	}
+	if size := binary.LittleEndian.Uint32(data[0x04:]); int(size) != len(data)-4 {
+		t.Errorf("Expected EOF offset %d but got %d", len(data)-4, size)
+	}
+	if samples := binary.LittleEndian.Uint32(data[0x18:]); samples != 735+4+44100 {
+		t.Errorf("Expected %d samples but got %d", 735+4+44100, samples)
+	}
+
+	expected := []byte{
+		0xb3, 0x02, 0xf0,
+		0x62,
+		0xb3, 0x04, 0x87,
+		0x73,
+		0xb3, 0x20, 0x12,
+		0x61, 0x44, 0xac,
+		0x66,
+	}
+	if !bytes.Equal(data[vgmHeaderSize:], expected) {
+		t.Errorf("Expected commands % X but got % X", expected, data[vgmHeaderSize:])
+	}
+}
+
+// Test that writes the APU ignores while it is off are not logged
+func TestVgmLogPower(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.vgm")
+	v, err := createVgm(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, apu := apuTestMemory()
+	apu.vgm = v
+
+	mem.Write(0xff12, 0xf0)
+	mem.Write(0xff26, 0x00)
+	mem.Write(0xff12, 0xf0)
+	mem.Write(0xff26, 0x80)
+	if err := v.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0xb3, 0x02, 0xf0,
+		0xb3, 0x16, 0x00,
+		0xb3, 0x16, 0x80,
+		0x66,
+	}
+	if !bytes.Equal(data[vgmHeaderSize:], expected) {
+		t.Errorf("Expected commands % X but got % X", expected, data[vgmHeaderSize:])
+	}
+}
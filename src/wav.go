@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Recording of the sound into WAV files with 16-bit PCM samples. Besides the stereo mix as it is played, every
+// channel is written to a mono file of its own with the level of its DAC, before panning and volume:
+//
+//  ------------------------------------------------
+// | file            | content                      |
+// | name.wav        | stereo mix                   |
+// | name.ch1.wav    | channel 1, square with sweep |
+// | name.ch2.wav    | channel 2, square            |
+// | name.ch3.wav    | channel 3, wave              |
+// | name.ch4.wav    | channel 4, noise             |
+//  ------------------------------------------------
+
+const wavHeaderSize = 44
+
+type wavWriter struct {
+	file     *os.File
+	writer   *bufio.Writer
+	channels int
+	frames   int
+}
+
+// Create a WAV file, the sizes in the header are filled in on close.
+func createWav(path string, channels, sampleRate int) (*wavWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{file: file, writer: bufio.NewWriter(file), channels: channels}
+
+	blockAlign := channels * 2
+	header := []interface{}{
+		[]byte("RIFF"), uint32(0), []byte("WAVE"),
+		[]byte("fmt "), uint32(16), uint16(1), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * blockAlign), uint16(blockAlign), uint16(16),
+		[]byte("data"), uint32(0),
+	}
+	for _, field := range header {
+		binary.Write(w.writer, binary.LittleEndian, field)
+	}
+	return w, nil
+}
+
+// Write a frame with a sample from -1 to 1 for every channel.
+func (w *wavWriter) write(samples ...float32) {
+	for _, sample := range samples {
+		binary.Write(w.writer, binary.LittleEndian, toInt16(sample, 1))
+	}
+	w.frames++
+}
+
+// Fill in the sizes of the header and close the file.
+func (w *wavWriter) close() error {
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	dataSize := uint32(w.frames * w.channels * 2)
+	for _, field := range []struct {
+		offset int64
+		size   uint32
+	}{{4, wavHeaderSize - 8 + dataSize}, {40, dataSize}} {
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], field.size)
+		if _, err := w.file.WriteAt(buf[:], field.offset); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+type wavRecorder struct {
+	mix      *wavWriter
+	channels [4]*wavWriter
+}
+
+// Start recording into the given file and the per channel files next to it.
+func newWavRecorder(path string, sampleRate int) (*wavRecorder, error) {
+	r := &wavRecorder{}
+	var err error
+	if r.mix, err = createWav(path, 2, sampleRate); err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(path, ".wav")
+	for i := range r.channels {
+		if r.channels[i], err = createWav(fmt.Sprintf("%s.ch%d.wav", base, i+1), 1, sampleRate); err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *wavRecorder) record(left, right float32, levels [4]float32) {
+	r.mix.write(left, right)
+	for i, level := range levels {
+		r.channels[i].write(level)
+	}
+}
+
+// Finish all files, returning the first error.
+func (r *wavRecorder) close() error {
+	var first error
+	for _, w := range append([]*wavWriter{r.mix}, r.channels[:]...) {
+		if w == nil {
+			continue
+		}
+		if err := w.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
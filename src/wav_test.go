@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that the recorder writes the stereo mix and the channels with correct WAV headers
+func TestWavRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wav")
+	r, err := newWavRecorder(path, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.record(1, -1, [4]float32{0.5, 0, 0, -0.5})
+	r.record(0, 0, [4]float32{})
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mix, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mix) != wavHeaderSize+8 {
+		t.Fatalf("Expected %d bytes but got %d", wavHeaderSize+8, len(mix))
+	}
+	if string(mix[0:4]) != "RIFF" || string(mix[8:12]) != "WAVE" || string(mix[36:40]) != "data" {
+		t.Errorf("Invalid WAV header % X", mix[:wavHeaderSize])
+	}
+	for _, field := range []struct {
+		offset   int
+		expected uint32
+	}{{4, 44}, {24, 48000}, {28, 48000 * 4}, {40, 8}} {
+		if val := binary.LittleEndian.Uint32(mix[field.offset:]); val != field.expected {
+			t.Errorf("Header field at %d: expected %d but got %d", field.offset, field.expected, val)
+		}
+	}
+	if left, right := int16(binary.LittleEndian.Uint16(mix[44:])), int16(binary.LittleEndian.Uint16(mix[46:])); left != 32767 || right != -32767 {
+		t.Errorf("Expected 32767/-32767 but got %d/%d", left, right)
+	}
+
+	ch4, err := os.ReadFile(filepath.Join(filepath.Dir(path), "test.ch4.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels := binary.LittleEndian.Uint16(ch4[22:]); channels != 1 {
+		t.Errorf("Channel files should be mono but have %d channels", channels)
+	}
+	if sample := int16(binary.LittleEndian.Uint16(ch4[44:])); sample != -16383 {
+		t.Errorf("Expected -16383 but got %d", sample)
+	}
+}